@@ -1,159 +1,96 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
-	"errors"
-	"flag"
+	"bytes"
 	"fmt"
-	"log"
-	"net/url"
 	"os"
-	"strings"
-	"time"
 
-	"code.cloudfoundry.org/cli/cf/api/logs"
 	"code.cloudfoundry.org/cli/plugin"
-	"github.com/cloudfoundry/noaa/consumer"
-	"github.com/contraband/autopilot/rewind"
+	"github.com/contraband/autopilot/deploy"
 )
 
+// fatalIf exits with the exit code for the kind of error err is.
 func fatalIf(err error) {
 	if err != nil {
-		fmt.Fprintln(os.Stdout, "error:", err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(deploy.ExitCode(err))
 	}
 }
 
 func main() {
-	plugin.Start(&AutopilotPlugin{})
-}
-
-type AutopilotPlugin struct{}
+	// the cf CLI starts plugins with a port number as the first argument, so
+	// a command name means that autopilot has been run on its own
+	if len(os.Args) > 1 && isCommand(os.Args[1]) {
+		runStandalone(os.Args[1:])
+		return
+	}
 
-func venerableAppName(appName string) string {
-	return fmt.Sprintf("%s-venerable", appName)
+	plugin.Start(&AutopilotPlugin{})
 }
 
-func getActionsForApp(appRepo *ApplicationRepo, appName, manifestPath, appPath, stackName string, vars []string, varsFiles []string, showLogs bool) []rewind.Action {
-	venName := venerableAppName(appName)
-	var err error
-	var curApp, venApp *AppEntity
-	var haveVenToCleanup bool
-
-	return []rewind.Action{
-		// get info about current app
-		{
-			Forward: func() error {
-				curApp, err = appRepo.GetAppMetadata(appName)
-				if err != ErrAppNotFound {
-					return err
-				}
-				curApp = nil
-				return nil
-			},
-		},
-		// get info about ven app
-		{
-			Forward: func() error {
-				venApp, err = appRepo.GetAppMetadata(venName)
-				if err != ErrAppNotFound {
-					return err
-				}
-				venApp = nil
-				return nil
-			},
-		},
-		// rename any existing app such so that next step can push to a clear space
-		{
-			Forward: func() error {
-				// Unless otherwise specified, go with our start state
-				haveVenToCleanup = (venApp != nil)
-
-				// If there is no current app running, that's great, we're done here
-				if curApp == nil {
-					return nil
-				}
-
-				// If current app isn't started, then we'll just delete it, and we're done
-				if curApp.State != "STARTED" {
-					return appRepo.DeleteApplication(appName)
-				}
+// runStandalone runs a command without the cf CLI.
+func runStandalone(args []string) {
+	config, err := deploy.StandaloneConfigFromEnv(os.Getenv)
+	if err != nil {
+		fatalIf(deploy.ErrValidation{Err: err})
+	}
 
-				// Do we have a ven app that will stop a rename?
-				if venApp != nil {
-					// Finally, since the current app claims to be healthy, we'll delete the venerable app, and rename the current over the top
-					err = appRepo.DeleteApplication(venName)
-					if err != nil {
-						return err
-					}
-				}
+	conn, err := deploy.NewStandaloneConnection(config, os.Stdout)
+	if err != nil {
+		fatalIf(deploy.ErrPreflight{Err: err})
+	}
 
-				// Finally, rename
-				haveVenToCleanup = true
-				return appRepo.RenameApplication(appName, venName)
-			},
-		},
-		// push
-		{
-			Forward: func() error {
-				return appRepo.PushApplication(appName, manifestPath, appPath, stackName, vars, varsFiles, showLogs)
-			},
-			ReversePrevious: func() error {
-				if !haveVenToCleanup {
-					return nil
-				}
+	AutopilotPlugin{}.Run(conn, args)
+}
 
-				// If the app cannot start we'll have a lingering application
-				// We delete this application so that the rename can succeed
-				appRepo.DeleteApplication(appName)
+// commands are the commands that autopilot provides.
+var commands = []string{"zero-downtime-push", "zero-downtime-restage", "zero-downtime-set-env", "zero-downtime-scale", "zero-downtime-change-stack", "autopilot-promote"}
 
-				return appRepo.RenameApplication(venName, appName)
-			},
-		},
-		// delete
-		{
-			Forward: func() error {
-				if !haveVenToCleanup {
-					return nil
-				}
-				return appRepo.DeleteApplication(venName)
-			},
-		},
+func isCommand(name string) bool {
+	for _, command := range commands {
+		if name == command {
+			return true
+		}
 	}
+	return false
 }
 
-func getActionsForNewApp(appRepo *ApplicationRepo, appName, manifestPath, appPath, stackName string, vars []string, varsFiles []string, showLogs bool) []rewind.Action {
-	return []rewind.Action{
-		// push
-		{
-			Forward: func() error {
-				return appRepo.PushApplication(appName, manifestPath, appPath, stackName, vars, varsFiles, showLogs)
-			},
-		},
-	}
-}
+type AutopilotPlugin struct{}
 
 func (plugin AutopilotPlugin) Run(cliConnection plugin.CliConnection, args []string) {
 	// only handle if actually invoked, else it can't be uninstalled cleanly
-	if args[0] != "zero-downtime-push" {
+	if !isCommand(args[0]) {
 		return
 	}
 
-	appRepo := NewApplicationRepo(cliConnection)
-	appName, manifestPath, appPath, stackName, vars, varsFiles, showLogs, err := ParseArgs(args)
-	fatalIf(err)
+	opts, err := deploy.ParseArgs(args)
+	if err != nil {
+		fatalIf(deploy.ErrValidation{Err: err})
+	}
 
-	fatalIf((&rewind.Actions{
-		Actions:              getActionsForApp(appRepo, appName, manifestPath, appPath, stackName, vars, varsFiles, showLogs),
-		RewindFailureMessage: "Oh no. Something's gone wrong. I've tried to roll back but you should check to see if everything is OK.",
-	}).Execute())
+	deployer := deploy.NewDeployer(cliConnection)
+	deployer.OnReport = func(report deploy.Report) {
+		// written in one go so that reports on parallel deploys don't mix
+		var out bytes.Buffer
+		if opts.Report != deploy.ReportJSON {
+			verb := "pushed"
+			if opts.Change != nil {
+				verb = "deployed"
+			}
+			fmt.Fprintf(&out, "\nA new version of your application has successfully been %s to %s!\n\n", verb, report.Target())
+		}
+		_ = report.Write(&out, opts.Report)
+		os.Stdout.Write(out.Bytes())
+	}
 
-	fmt.Println()
-	fmt.Println("A new version of your application has successfully been pushed!")
-	fmt.Println()
+	err = deployer.Deploy(opts)
+
+	if opts.Report != deploy.ReportJSON && len(deployer.Metrics()) > 0 {
+		fmt.Println()
+		_ = deploy.WriteMetrics(os.Stdout, deployer.Metrics())
+	}
 
-	_ = appRepo.ListApplications()
+	fatalIf(err)
 }
 
 func (AutopilotPlugin) GetMetadata() plugin.PluginMetadata {
@@ -169,191 +106,44 @@ func (AutopilotPlugin) GetMetadata() plugin.PluginMetadata {
 				Name:     "zero-downtime-push",
 				HelpText: "Perform a zero-downtime push of an application over the top of an old one",
 				UsageDetails: plugin.Usage{
-					Usage: "$ cf zero-downtime-push application-to-replace \\ \n \t-f path/to/new_manifest.yml \\ \n \t-p path/to/new/path",
+					Usage: "$ cf zero-downtime-push [application-to-replace] \\ \n \t-f path/to/new_manifest.yml \\ \n \t-p path/to/new/path \\ \n \t[--droplet guid|path] [--org org] [--space space ...] [--parallel] \\ \n \t[--report table|json] [--metrics-file path] [--statsd host:port] \\ \n \t[--observe duration]",
+				},
+			},
+			{
+				Name:     "zero-downtime-restage",
+				HelpText: "Restage an application without downtime by staging a copy of it alongside the old one",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf zero-downtime-restage application \\ \n \t[--org org] [--space space ...] [--parallel] \\ \n \t[--report table|json] [--observe duration]",
+				},
+			},
+			{
+				Name:     "zero-downtime-set-env",
+				HelpText: "Set an environment variable of an application without downtime by starting a copy of it alongside the old one",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf zero-downtime-set-env application NAME VALUE \\ \n \t[--org org] [--space space ...] [--parallel] \\ \n \t[--report table|json] [--observe duration]",
+				},
+			},
+			{
+				Name:     "zero-downtime-scale",
+				HelpText: "Change the instances, memory or disk of an application without downtime by starting a copy of it alongside the old one",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf zero-downtime-scale application [-i instances] [-m memory] [-k disk] \\ \n \t[--org org] [--space space ...] [--parallel] \\ \n \t[--report table|json] [--observe duration]",
+				},
+			},
+			{
+				Name:     "zero-downtime-change-stack",
+				HelpText: "Move an application to another stack without downtime by restaging a copy of it alongside the old one",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf zero-downtime-change-stack application stack \\ \n \t[--org org] [--space space ...] [--parallel] \\ \n \t[--report table|json] [--observe duration]",
+				},
+			},
+			{
+				Name:     "autopilot-promote",
+				HelpText: "Promote an application from one space to another without downtime by running a copy of its droplet alongside the old version",
+				UsageDetails: plugin.Usage{
+					Usage: "$ cf autopilot-promote application --from-space space [--from-org org] \\ \n \t[--to-space space ...] [--org org] [--parallel] \\ \n \t[--report table|json] [--observe duration]",
 				},
 			},
 		},
 	}
 }
-
-type StringSlice []string
-
-func (s *StringSlice) String() string {
-	return fmt.Sprint(*s)
-}
-
-func (s *StringSlice) Set(value string) error {
-	*s = append(*s, value)
-	return nil
-}
-
-func ParseArgs(args []string) (string, string, string, string, []string, []string, bool, error) {
-	flags := flag.NewFlagSet("zero-downtime-push", flag.ContinueOnError)
-
-	var vars StringSlice
-	var varsFiles StringSlice
-
-	manifestPath := flags.String("f", "", "path to an application manifest")
-	appPath := flags.String("p", "", "path to application files")
-	stackName := flags.String("s", "", "name of the stack to use")
-	showLogs := flags.Bool("show-app-log", false, "tail and show application log during application start")
-	flags.Var(&vars, "var", "Variable key value pair for variable substitution, (e.g., name=app1); can specify multiple times")
-	flags.Var(&varsFiles, "vars-file", "Path to a variable substitution file for manifest; can specify multiple times")
-
-	if len(args) < 2 || strings.HasPrefix(args[1], "-") {
-		return "", "", "", "", []string{}, []string{}, false, ErrNoArgs
-	}
-	err := flags.Parse(args[2:])
-	if err != nil {
-		return "", "", "", "", []string{}, []string{}, false, err
-	}
-
-	appName := args[1]
-
-	if *manifestPath == "" {
-		return "", "", "", "", []string{}, []string{}, false, ErrNoManifest
-	}
-
-	return appName, *manifestPath, *appPath, *stackName, vars, varsFiles, *showLogs, nil
-}
-
-var (
-	ErrNoArgs     = errors.New("app name must be specified")
-	ErrNoManifest = errors.New("a manifest is required to push this application")
-)
-
-type ApplicationRepo struct {
-	conn plugin.CliConnection
-}
-
-func NewApplicationRepo(conn plugin.CliConnection) *ApplicationRepo {
-	return &ApplicationRepo{
-		conn: conn,
-	}
-}
-
-func (repo *ApplicationRepo) RenameApplication(oldName, newName string) error {
-	_, err := repo.conn.CliCommand("rename", oldName, newName)
-	return err
-}
-
-func (repo *ApplicationRepo) PushApplication(appName, manifestPath, appPath, stackName string, vars []string, varsFiles []string, showLogs bool) error {
-	args := []string{"push", appName, "-f", manifestPath, "--no-start"}
-
-	if appPath != "" {
-		args = append(args, "-p", appPath)
-	}
-
-	if stackName != "" {
-		args = append(args, "-s", stackName)
-	}
-
-	for _, varPair := range vars {
-		args = append(args, "--var", varPair)
-	}
-
-	for _, varsFile := range varsFiles {
-		args = append(args, "--vars-file", varsFile)
-	}
-
-	_, err := repo.conn.CliCommand(args...)
-	if err != nil {
-		return err
-	}
-
-	if showLogs {
-		app, err := repo.conn.GetApp(appName)
-		if err != nil {
-			return err
-		}
-		dopplerEndpoint, err := repo.conn.DopplerEndpoint()
-		if err != nil {
-			return err
-		}
-		token, err := repo.conn.AccessToken()
-		if err != nil {
-			return err
-		}
-
-		cons := consumer.New(dopplerEndpoint, nil, nil)
-		defer cons.Close()
-
-		messages, errors := cons.TailingLogs(app.Guid, token)
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		go func() {
-			for {
-				select {
-				case m := <-messages:
-					if m.GetSourceType() != "STG" { // skip STG messages as the cf tool already prints them
-						os.Stderr.WriteString(logs.NewNoaaLogMessage(m).ToLog(time.Local) + "\n")
-					}
-				case e := <-errors:
-					log.Println("error reading logs:", e)
-				case <-ctx.Done():
-					return
-				}
-			}
-		}()
-	}
-
-	_, err = repo.conn.CliCommand("start", appName)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (repo *ApplicationRepo) DeleteApplication(appName string) error {
-	_, err := repo.conn.CliCommand("delete", appName, "-f")
-	return err
-}
-
-func (repo *ApplicationRepo) ListApplications() error {
-	_, err := repo.conn.CliCommand("apps")
-	return err
-}
-
-type AppEntity struct {
-	State string `json:"state"`
-}
-
-var (
-	ErrAppNotFound = errors.New("application not found")
-)
-
-// GetAppMetadata returns metadata about an app with appName
-func (repo *ApplicationRepo) GetAppMetadata(appName string) (*AppEntity, error) {
-	space, err := repo.conn.GetCurrentSpace()
-	if err != nil {
-		return nil, err
-	}
-
-	path := fmt.Sprintf(`v2/apps?q=name:%s&q=space_guid:%s`, url.QueryEscape(appName), space.Guid)
-	result, err := repo.conn.CliCommandWithoutTerminalOutput("curl", path)
-
-	if err != nil {
-		return nil, err
-	}
-
-	jsonResp := strings.Join(result, "")
-
-	output := struct {
-		Resources []struct {
-			Entity AppEntity `json:"entity"`
-		} `json:"resources"`
-	}{}
-	err = json.Unmarshal([]byte(jsonResp), &output)
-
-	if err != nil {
-		return nil, err
-	}
-
-	if len(output.Resources) == 0 {
-		return nil, ErrAppNotFound
-	}
-
-	return &output.Resources[0].Entity, nil
-}
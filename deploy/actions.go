@@ -0,0 +1,394 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/contraband/autopilot/rewind"
+)
+
+// candidateOptions returns the options used to stage the new code before the
+// current application is touched. The candidate has no routes so that it
+// never receives any traffic.
+func candidateOptions(opts Options) Options {
+	candidate := opts
+	candidate.AppName = opts.CandidateAppName()
+	candidate.Domain = ""
+	candidate.Hostname = ""
+	candidate.NoHostname = false
+	candidate.RandomRoute = false
+	candidate.RoutePath = ""
+	candidate.NoRoute = true
+	return candidate
+}
+
+// candidateManifest gives the candidate a manifest of its own when the manifest
+// describes several applications, as cf push can't push one of them under the
+// candidate's name. The returned function removes that manifest.
+func candidateManifest(opts Options, candidate Options) (Options, func(), error) {
+	count, err := manifestAppCount(opts.ManifestPath)
+	if os.IsNotExist(err) {
+		// cf push reports a missing manifest itself
+		return candidate, func() {}, nil
+	}
+	if err != nil {
+		return candidate, nil, err
+	}
+	if count < 2 {
+		return candidate, func() {}, nil
+	}
+
+	manifestPath, err := writeAppManifest(opts.ManifestPath, opts.Vars, opts.VarsFiles, opts.AppName, candidate.AppName)
+	if err != nil {
+		return candidate, nil, err
+	}
+
+	candidate.ManifestPath = manifestPath
+	candidate.Vars = nil
+	candidate.VarsFiles = nil
+	return candidate, func() { os.Remove(manifestPath) }, nil
+}
+
+func getActionsForApp(appRepo *ApplicationRepo, opts Options, report *Report) []rewind.Action {
+	appName := opts.AppName
+	venName := opts.VenerableAppName()
+	candidate := candidateOptions(opts)
+	// a droplet given up front needs no staging
+	prestage := opts.Strategy != StrategyRename && opts.Droplet == ""
+	var err error
+	var curApp, venApp *AppEntity
+	var haveVenToCleanup bool
+	var dropletGUID, venGUID string
+
+	rollBack := func() error {
+		if prestage {
+			appRepo.DeleteApplication(candidate.AppName)
+		}
+
+		if !haveVenToCleanup {
+			return nil
+		}
+
+		// If the app cannot start we'll have a lingering application
+		// We delete this application so that the rename can succeed
+		appRepo.DeleteApplication(appName)
+
+		return appRepo.RenameApplication(venName, appName)
+	}
+
+	return []rewind.Action{
+		// get info about current app
+		{
+			Name: "find current app",
+			Forward: func() error {
+				curApp, err = appRepo.GetAppMetadata(appName)
+				if err != ErrAppNotFound {
+					return err
+				}
+				curApp = nil
+				return nil
+			},
+		},
+		// get info about ven app
+		{
+			Name: "find venerable app",
+			Forward: func() error {
+				venApp, err = appRepo.GetAppMetadata(venName)
+				if err == ErrAppNotFound {
+					venApp = nil
+				} else if err != nil {
+					return err
+				}
+
+				// A venerable app without a current app means that an earlier
+				// deploy died after the rename
+				if curApp != nil || venApp == nil {
+					return nil
+				}
+
+				switch opts.StaleVenerable {
+				case StaleVenerableAbort:
+					return ErrStaleVenerable{AppName: appName, VenerableName: venName}
+				case StaleVenerablePromote:
+					err = appRepo.RenameApplication(venName, appName)
+					if err != nil {
+						return err
+					}
+					curApp, venApp = venApp, nil
+				}
+
+				return nil
+			},
+		},
+		// stage the new code first so that a staging failure leaves the current app alone
+		{
+			Name: "stage candidate",
+			Kind: stagingAction,
+			Forward: func() error {
+				if !prestage {
+					return nil
+				}
+				staged, cleanup, err := candidateManifest(opts, candidate)
+				if err != nil {
+					return stagingError(err)
+				}
+				defer cleanup()
+
+				dropletGUID, err = appRepo.StageApplication(staged)
+				if err != nil {
+					return stagingError(err)
+				}
+				return nil
+			},
+			ReversePrevious: func() error {
+				return appRepo.DeleteApplication(candidate.AppName)
+			},
+		},
+		// run the pre-cutover task (e.g. migrations) with the new droplet before it gets any traffic
+		{
+			Name: "pre-cutover task",
+			Forward: func() error {
+				if opts.PreCutoverTask == "" {
+					return nil
+				}
+				err = appRepo.RunTask(candidate.AppName, opts.PreCutoverTask, opts.ShowLogs, opts.TaskTimeout)
+				if err != nil {
+					return ErrVerification{Err: err}
+				}
+				return nil
+			},
+			ReversePrevious: func() error {
+				return appRepo.DeleteApplication(candidate.AppName)
+			},
+		},
+		// rename any existing app such so that next step can push to a clear space
+		{
+			Name: "rename current app",
+			Kind: cutoverAction,
+			Forward: func() error {
+				// Unless otherwise specified, go with our start state
+				haveVenToCleanup = (venApp != nil)
+
+				// If there is no current app running, that's great, we're done here
+				if curApp == nil {
+					return nil
+				}
+
+				// If current app isn't started, then we'll just delete it, and we're done
+				if curApp.State != "STARTED" {
+					return appRepo.DeleteApplication(appName)
+				}
+
+				// A started app may still have nothing running, in which case it's
+				// not much of a rollback target
+				err = appRepo.GetInstanceStats(curApp)
+				if err != nil {
+					return err
+				}
+				if !curApp.Healthy() {
+					switch opts.UnhealthyCurrent {
+					case UnhealthyCurrentAbort:
+						return ErrUnhealthyCurrent{AppName: appName, Instances: curApp.Instances}
+					case UnhealthyCurrentDelete:
+						return appRepo.DeleteApplication(appName)
+					}
+				}
+
+				// Do we have a ven app that will stop a rename?
+				if venApp != nil {
+					// Finally, since we're keeping the current app, we'll delete the venerable app, and rename the current over the top
+					err = appRepo.DeleteApplication(venName)
+					if err != nil {
+						return err
+					}
+				}
+
+				// Finally, rename
+				haveVenToCleanup = true
+				venGUID = curApp.GUID
+				report.Replaced = curApp.GUID
+				return appRepo.RenameApplication(appName, venName)
+			},
+			ReversePrevious: func() error {
+				if !prestage {
+					return nil
+				}
+				return appRepo.DeleteApplication(candidate.AppName)
+			},
+		},
+		// push
+		{
+			Name: "push",
+			Kind: startAction,
+			Forward: func() error {
+				// docker droplets can't be copied between apps but staging
+				// them again only pulls the image that we know is good
+				switch {
+				case opts.dropletGUID() != "":
+					err = appRepo.PushApplicationWithDroplet(opts, opts.dropletGUID())
+				case !prestage || opts.IsDocker():
+					err = appRepo.PushApplication(opts)
+				default:
+					err = appRepo.PushApplicationWithDroplet(opts, dropletGUID)
+				}
+				return pushError(err)
+			},
+			ReversePrevious: rollBack,
+		},
+		// make sure that the new app serves every route that the old one did before the old one goes
+		{
+			Name: "verify routes",
+			Forward: func() error {
+				if opts.LostRoutes == LostRoutesIgnore || venGUID == "" {
+					return nil
+				}
+				lost, err := appRepo.lostRoutes(venGUID, appName)
+				if err != nil {
+					return err
+				}
+				if len(lost) == 0 {
+					return nil
+				}
+				if opts.LostRoutes == LostRoutesWarn {
+					fmt.Fprintf(os.Stderr, "warning: the new version of %s is not mapped to %s, which will stop being served\n", appName, strings.Join(lost, ", "))
+					return nil
+				}
+				return ErrVerification{Err: ErrLostRoutes{AppName: appName, Routes: lost}}
+			},
+			ReversePrevious: rollBack,
+		},
+		// run the post-deploy task while the old app is still around to roll back to
+		{
+			Name: "post-deploy task",
+			Forward: func() error {
+				if opts.PostDeployTask == "" {
+					return nil
+				}
+				err = appRepo.RunTask(appName, opts.PostDeployTask, opts.ShowLogs, opts.TaskTimeout)
+				if err != nil {
+					return ErrVerification{Err: err}
+				}
+				return nil
+			},
+			ReversePrevious: rollBack,
+		},
+		// compare the new and old apps while they share the same routes, before the old app goes
+		{
+			Name: "observe new version",
+			Forward: func() error {
+				if opts.ObserveWindow == 0 || venGUID == "" {
+					return nil
+				}
+				newApp, err := appRepo.GetAppMetadata(appName)
+				if err != nil {
+					return err
+				}
+				err = appRepo.Observe(appName, venGUID, newApp.GUID, opts.ObserveWindow, opts.RouteThresholds, opts.LogThresholds)
+				if err != nil {
+					return ErrVerification{Err: err}
+				}
+				return nil
+			},
+			ReversePrevious: rollBack,
+		},
+		// delete
+		{
+			Name: "delete old apps",
+			Forward: func() error {
+				if prestage {
+					err = appRepo.DeleteApplication(candidate.AppName)
+					if err != nil {
+						return err
+					}
+				}
+
+				if !haveVenToCleanup || opts.keepVenerable {
+					report.VenerableKept = haveVenToCleanup
+					return nil
+				}
+				return appRepo.DeleteApplication(venName)
+			},
+		},
+	}
+}
+
+type ErrStaleVenerable struct {
+	AppName       string
+	VenerableName string
+}
+
+func (e ErrStaleVenerable) Error() string {
+	return fmt.Sprintf("%s exists but %s does not, an earlier deploy may have failed part way through; rename or delete %s, or use --stale-venerable=promote or --stale-venerable=delete", e.VenerableName, e.AppName, e.VenerableName)
+}
+
+type ErrUnhealthyCurrent struct {
+	AppName   string
+	Instances int
+}
+
+func (e ErrUnhealthyCurrent) Error() string {
+	return fmt.Sprintf("%s is started but none of its %d instances are running; fix it or use --unhealthy-current=delete or --unhealthy-current=keep", e.AppName, e.Instances)
+}
+
+// ErrLostRoutes is returned when the new version of an app is not mapped to
+// routes that the old version was, so they would stop being served once the
+// old version is deleted.
+type ErrLostRoutes struct {
+	AppName string
+	Routes  []string
+}
+
+func (e ErrLostRoutes) Error() string {
+	return fmt.Sprintf("the new version of %s is not mapped to %s, which would be lost with the old version; check the routes in the manifest or use --lost-routes=warn", e.AppName, strings.Join(e.Routes, ", "))
+}
+
+// lostRoutes returns the routes of the old app that the app called appName is
+// not mapped to.
+func (repo *ApplicationRepo) lostRoutes(oldGUID, appName string) ([]string, error) {
+	oldRoutes, err := repo.appRoutes(oldGUID)
+	if err != nil {
+		return nil, err
+	}
+
+	newApp, err := repo.GetAppMetadata(appName)
+	if err != nil {
+		return nil, err
+	}
+	newRoutes, err := repo.appRoutes(newApp.GUID)
+	if err != nil {
+		return nil, err
+	}
+
+	var lost []string
+	for _, route := range oldRoutes {
+		if !containsString(newRoutes, route) {
+			lost = append(lost, route)
+		}
+	}
+	return lost, nil
+}
+
+func getActionsForNewApp(appRepo *ApplicationRepo, opts Options) []rewind.Action {
+	return []rewind.Action{
+		// push
+		{
+			Name: "push",
+			Kind: startAction,
+			Forward: func() error {
+				return pushError(appRepo.PushApplication(opts))
+			},
+		},
+	}
+}
+
+// pushError classifies a failed push: staging failures, including a droplet
+// copy that failed or timed out, are kept as they are and anything else is a
+// failure to start.
+func pushError(err error) error {
+	switch err.(type) {
+	case nil, ErrStaging:
+		return err
+	}
+	return ErrStart{Err: err}
+}
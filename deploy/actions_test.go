@@ -0,0 +1,402 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"code.cloudfoundry.org/cli/plugin/pluginfakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/contraband/autopilot/rewind"
+)
+
+// fakeSpace is a minimal model of the apps in a space which answers the cf
+// commands used by the rename strategy.
+type fakeSpace struct {
+	apps      map[string]string
+	unhealthy map[string]bool
+	commands  []string
+	failPush  bool
+
+	// failStaging fails cf start while it stages the app
+	failStaging bool
+
+	// failCommand fails the command with these arguments, e.g. "start app"
+	failCommand string
+
+	// failLock fails taking the deploy lock
+	failLock bool
+}
+
+func (space *fakeSpace) cliCommand(args ...string) ([]string, error) {
+	space.commands = append(space.commands, strings.Join(args, " "))
+
+	if strings.Join(args, " ") == space.failCommand {
+		return nil, errors.New(args[0] + " failed")
+	}
+
+	switch args[0] {
+	case "rename":
+		space.apps[args[2]] = space.apps[args[1]]
+		delete(space.apps, args[1])
+	case "delete":
+		delete(space.apps, args[1])
+	case "push":
+		if space.failPush {
+			return nil, errors.New("push failed")
+		}
+		space.apps[args[1]] = "STOPPED"
+	case "start":
+		if space.failStaging {
+			return nil, errors.New("start failed")
+		}
+		space.apps[args[1]] = "STARTED"
+	}
+
+	return nil, nil
+}
+
+func (space *fakeSpace) curl(args ...string) ([]string, error) {
+	if strings.HasPrefix(args[1], "/v2/user_provided_service_instances") {
+		if space.failLock {
+			return nil, errors.New("lock failed")
+		}
+		return []string{`{"metadata":{"guid":"lock-guid"}}`}, nil
+	}
+
+	if strings.HasSuffix(args[1], "/processes/web/stats") {
+		name := strings.TrimSuffix(strings.TrimPrefix(args[1], "/v3/apps/"), "-guid/processes/web/stats")
+		if space.unhealthy[name] {
+			return []string{`{"resources":[{"state":"CRASHED"},{"state":"DOWN"}]}`}, nil
+		}
+		return []string{`{"resources":[{"state":"RUNNING"},{"state":"RUNNING"}]}`}, nil
+	}
+
+	if strings.HasSuffix(args[1], "/tasks") {
+		return []string{`{"guid":"task-guid","state":"FAILED","result":{"failure_reason":"Exited with status 1"}}`}, nil
+	}
+
+	if strings.HasPrefix(args[1], "/v3/builds?") {
+		if space.failStaging {
+			return []string{`{"resources":[{"state":"FAILED"}]}`}, nil
+		}
+		return []string{`{"resources":[{"state":"STAGED"}]}`}, nil
+	}
+
+	if strings.HasSuffix(args[1], "/droplets/current") {
+		return []string{`{"guid":"droplet-guid","stack":"cflinuxfs3","buildpacks":[{"name":"ruby_buildpack"}]}`}, nil
+	}
+
+	if strings.HasSuffix(args[1], "/processes/web") {
+		return []string{`{"instances":2,"memory_in_mb":256,"disk_in_mb":1024}`}, nil
+	}
+
+	if strings.HasSuffix(args[1], "/routes") {
+		return []string{`{"resources":[{"url":"app.example.com"}]}`}, nil
+	}
+
+	query, err := url.ParseQuery(strings.SplitN(args[1], "?", 2)[1])
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimPrefix(query["q"][0], "name:")
+
+	state, ok := space.apps[name]
+	if !ok {
+		return []string{`{"resources":[]}`}, nil
+	}
+	return []string{fmt.Sprintf(`{"resources":[{"metadata":{"guid":"%s-guid"},"entity":{"state":"%s"}}]}`, name, state)}, nil
+}
+
+func runActions(repo *ApplicationRepo, opts Options) error {
+	return rewind.Actions{Actions: getActionsForApp(repo, opts, &Report{})}.Execute()
+}
+
+var _ = Describe("getActionsForApp", func() {
+	var (
+		space *fakeSpace
+		repo  *ApplicationRepo
+		opts  Options
+	)
+
+	BeforeEach(func() {
+		space = &fakeSpace{apps: map[string]string{}, unhealthy: map[string]bool{}}
+
+		cliConn := &pluginfakes.FakeCliConnection{}
+		cliConn.CliCommandStub = space.cliCommand
+		cliConn.CliCommandWithoutTerminalOutputStub = space.curl
+		repo = NewApplicationRepo(cliConn)
+
+		opts = defaultOptions()
+		opts.AppName = "app"
+		opts.ManifestPath = "manifest.yml"
+		opts.Strategy = StrategyRename
+	})
+
+	deploy := func() error {
+		return runActions(repo, opts)
+	}
+
+	It("replaces a running app", func() {
+		space.apps["app"] = "STARTED"
+
+		Expect(deploy()).To(Succeed())
+
+		Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+		Expect(space.commands).To(ContainElement("rename app app-venerable"))
+		Expect(space.commands).To(ContainElement("delete app-venerable -f"))
+	})
+
+	It("restores the running app if the push fails", func() {
+		space.apps["app"] = "STARTED"
+		space.failPush = true
+
+		err := deploy()
+		Expect(err).To(MatchError("push failed"))
+		Expect(err).To(BeAssignableToTypeOf(ErrStart{}))
+
+		Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+	})
+
+	It("rolls back if the post-deploy task fails", func() {
+		space.apps["app"] = "STARTED"
+		opts.PostDeployTask = "rake cache:warm"
+
+		err := deploy()
+		Expect(err).To(BeAssignableToTypeOf(ErrVerification{}))
+		Expect(err.(ErrVerification).Err).To(MatchError(`task "rake cache:warm" failed: Exited with status 1`))
+		Expect(err.(ErrVerification).Err).ToNot(BeAssignableToTypeOf(ErrVerification{}))
+
+		Expect(space.commands).To(ContainElement("rename app-venerable app"))
+	})
+
+	It("keeps the venerable app when asked to", func() {
+		space.apps["app"] = "STARTED"
+		opts.keepVenerable = true
+
+		Expect(deploy()).To(Succeed())
+
+		Expect(space.apps).To(Equal(map[string]string{"app": "STARTED", "app-venerable": "STARTED"}))
+	})
+
+	It("copies a droplet given by GUID instead of staging", func() {
+		space.apps["app"] = "STARTED"
+		opts.Strategy = StrategyPrestage
+		opts.Droplet = "8a9b6c2e-1f3d-4e5a-9b7c-0d1e2f3a4b5c"
+
+		copying := &changeSpace{
+			fakeSpace: space,
+			responses: map[string]string{
+				"POST /v3/droplets?source_guid=" + opts.Droplet:         `{"guid":"droplet-copy-guid","state":"STAGED"}`,
+				"PATCH /v3/apps/app-guid/relationships/current_droplet": `{}`,
+				"POST /v3/apps/app-guid/actions/start":                  `{}`,
+			},
+			bodies: map[string]string{},
+		}
+		cliConn := &pluginfakes.FakeCliConnection{}
+		cliConn.CliCommandStub = copying.cliCommand
+		cliConn.CliCommandWithoutTerminalOutputStub = copying.curl
+		repo = NewApplicationRepo(cliConn)
+
+		Expect(deploy()).To(Succeed())
+
+		Expect(copying.log).To(ContainElement("POST /v3/droplets?source_guid=" + opts.Droplet))
+		Expect(copying.log).ToNot(ContainElement(HavePrefix("push app-candidate")))
+		Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+	})
+
+	Describe("a new app that is missing some of the current app's routes", func() {
+		BeforeEach(func() {
+			space.apps["app"] = "STARTED"
+
+			// the current and new apps share a GUID in the fake, so the
+			// first lookup of the routes is the current app's
+			routeLookups := 0
+			cliConn := &pluginfakes.FakeCliConnection{}
+			cliConn.CliCommandStub = space.cliCommand
+			cliConn.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+				if args[1] == "/v3/apps/app-guid/routes" {
+					routeLookups++
+					if routeLookups == 1 {
+						return []string{`{"resources":[{"url":"app.example.com"},{"url":"api.example.com"}]}`}, nil
+					}
+				}
+				return space.curl(args...)
+			}
+			repo = NewApplicationRepo(cliConn)
+		})
+
+		It("rolls back rather than lose them", func() {
+			err := deploy()
+			Expect(err).To(BeAssignableToTypeOf(ErrVerification{}))
+			Expect(err.(ErrVerification).Err).To(Equal(ErrLostRoutes{AppName: "app", Routes: []string{"api.example.com"}}))
+
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+			Expect(space.commands).To(ContainElement("rename app-venerable app"))
+		})
+
+		It("carries on when only asked to warn", func() {
+			opts.LostRoutes = LostRoutesWarn
+
+			Expect(deploy()).To(Succeed())
+
+			Expect(space.commands).To(ContainElement("delete app-venerable -f"))
+		})
+	})
+
+	It("restores a kept venerable app", func() {
+		space.apps["app"] = "STARTED"
+		space.apps["app-venerable"] = "STARTED"
+
+		Expect(repo.restoreVenerable(opts)).To(Succeed())
+
+		Expect(space.commands).To(Equal([]string{"delete app -f", "rename app-venerable app"}))
+		Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+	})
+
+	It("leaves an app without a venerable app when restoring", func() {
+		space.apps["app"] = "STARTED"
+
+		Expect(repo.restoreVenerable(opts)).To(Succeed())
+
+		Expect(space.commands).To(BeEmpty())
+	})
+
+	Describe("a venerable app left behind without a current app", func() {
+		BeforeEach(func() {
+			space.apps["app-venerable"] = "STARTED"
+		})
+
+		It("deletes it after a successful push by default", func() {
+			Expect(deploy()).To(Succeed())
+
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+			Expect(space.commands).ToNot(ContainElement("rename app-venerable app"))
+			Expect(space.commands).To(ContainElement("delete app-venerable -f"))
+		})
+
+		It("promotes it back to the current app", func() {
+			opts.StaleVenerable = StaleVenerablePromote
+
+			Expect(deploy()).To(Succeed())
+
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+			Expect(space.commands[0]).To(Equal("rename app-venerable app"))
+			Expect(space.commands).To(ContainElement("rename app app-venerable"))
+		})
+
+		It("keeps the promoted app if the push fails", func() {
+			opts.StaleVenerable = StaleVenerablePromote
+			space.failPush = true
+
+			Expect(deploy()).To(MatchError("push failed"))
+
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+		})
+
+		It("aborts without touching anything", func() {
+			opts.StaleVenerable = StaleVenerableAbort
+
+			err := deploy()
+			Expect(err).To(BeAssignableToTypeOf(ErrStaleVenerable{}))
+
+			Expect(space.apps).To(Equal(map[string]string{"app-venerable": "STARTED"}))
+			Expect(space.commands).To(BeEmpty())
+		})
+	})
+
+	Describe("a current app that is started but has nothing running", func() {
+		BeforeEach(func() {
+			space.apps["app"] = "STARTED"
+			space.unhealthy["app"] = true
+		})
+
+		It("keeps it to roll back to by default", func() {
+			Expect(deploy()).To(Succeed())
+
+			Expect(space.commands).To(ContainElement("rename app app-venerable"))
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+		})
+
+		It("deletes it when asked to", func() {
+			opts.UnhealthyCurrent = UnhealthyCurrentDelete
+
+			Expect(deploy()).To(Succeed())
+
+			Expect(space.commands).ToNot(ContainElement("rename app app-venerable"))
+			Expect(space.commands).To(ContainElement("delete app -f"))
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+		})
+
+		It("aborts when asked to", func() {
+			opts.UnhealthyCurrent = UnhealthyCurrentAbort
+
+			err := deploy()
+			Expect(err).To(BeAssignableToTypeOf(ErrUnhealthyCurrent{}))
+
+			Expect(space.commands).To(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("candidateManifest", func() {
+	var (
+		dir  string
+		opts Options
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "autopilot-manifest")
+		Expect(err).ToNot(HaveOccurred())
+
+		opts = defaultOptions()
+		opts.AppName = "web"
+		opts.ManifestPath = filepath.Join(dir, "manifest.yml")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("uses the manifest as it is when it describes one app", func() {
+		Expect(ioutil.WriteFile(opts.ManifestPath, []byte("applications:\n- name: web\n"), 0644)).To(Succeed())
+
+		candidate, cleanup, err := candidateManifest(opts, candidateOptions(opts))
+		Expect(err).ToNot(HaveOccurred())
+		defer cleanup()
+
+		Expect(candidate.ManifestPath).To(Equal(opts.ManifestPath))
+	})
+
+	It("writes the app to a manifest of its own under the candidate's name", func() {
+		Expect(ioutil.WriteFile(opts.ManifestPath, []byte("applications:\n- name: worker\n  path: worker\n- name: web\n  path: ((dir))\n  memory: 256M\n"), 0644)).To(Succeed())
+		opts.Vars = []string{"dir=web"}
+
+		candidate, cleanup, err := candidateManifest(opts, candidateOptions(opts))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(candidate.ManifestPath).ToNot(Equal(opts.ManifestPath))
+		Expect(candidate.Vars).To(BeEmpty())
+		written, err := ioutil.ReadFile(candidate.ManifestPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(written)).To(Equal(fmt.Sprintf("applications:\n- name: web-candidate\n  path: %s\n  memory: 256M\n", filepath.Join(dir, "web"))))
+
+		cleanup()
+		Expect(candidate.ManifestPath).ToNot(BeAnExistingFile())
+	})
+
+	It("errors if the manifest does not describe the app", func() {
+		Expect(ioutil.WriteFile(opts.ManifestPath, []byte("applications:\n- name: worker\n- name: api\n"), 0644)).To(Succeed())
+
+		_, _, err := candidateManifest(opts, candidateOptions(opts))
+		Expect(err).To(MatchError("the manifest has no application called web"))
+	})
+})
@@ -0,0 +1,800 @@
+package deploy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/contraband/autopilot/rewind"
+)
+
+// Change describes a new version of an app that is made from the running app
+// rather than pushed from a manifest and source.
+type Change struct {
+	// Restage stages the app's current package again rather than reusing
+	// its current droplet, e.g. so that buildpacks see changed environment
+	// variables or newly bound services.
+	Restage bool
+
+	// Env is merged into the app's environment variables.
+	Env map[string]string
+
+	// Stack moves the app to another stack. It needs the app to be
+	// restaged as well.
+	Stack string
+
+	// From promotes the app in another space: the new version is a copy of
+	// that app with the routes, services and environment variables of the
+	// app it replaces.
+	From *Target
+
+	// CopyEnv takes the environment variables of a promoted app from the
+	// app in the From space as well.
+	CopyEnv bool
+
+	// Instances, MemoryMB and DiskMB rescale the app's web process when
+	// they are not zero.
+	Instances int
+	MemoryMB  int
+	DiskMB    int
+}
+
+var (
+	// ErrNoScale is returned when zero-downtime-scale is given nothing to
+	// change.
+	ErrNoScale = errors.New("zero-downtime-scale needs at least one of -i, -m or -k")
+
+	// ErrNoSourceSpace is returned when autopilot-promote is not told where
+	// to promote the app from.
+	ErrNoSourceSpace = errors.New("autopilot-promote needs --from-space")
+)
+
+// changeCommands are the commands that change a running app, with the
+// number of arguments each takes before any flags.
+var changeCommands = map[string]int{
+	"zero-downtime-restage":      1,
+	"zero-downtime-set-env":      3,
+	"zero-downtime-scale":        1,
+	"zero-downtime-change-stack": 2,
+	"autopilot-promote":          1,
+}
+
+// newChange builds the change made by command from its arguments.
+func newChange(command string, args []string) *Change {
+	switch command {
+	case "zero-downtime-restage":
+		return &Change{Restage: true}
+	case "zero-downtime-set-env":
+		return &Change{Env: map[string]string{args[1]: args[2]}}
+	case "zero-downtime-scale":
+		return &Change{}
+	case "zero-downtime-change-stack":
+		return &Change{Restage: true, Stack: args[1]}
+	case "autopilot-promote":
+		return &Change{}
+	}
+	return nil
+}
+
+// scaleFrom takes the -i, -m and -k flags out of opts and into the change, as
+// they describe the scale of the copy rather than a push.
+func (change *Change) scaleFrom(opts *Options) error {
+	if opts.Instances == "" && opts.Memory == "" && opts.DiskQuota == "" {
+		return ErrNoScale
+	}
+
+	if opts.Instances != "" {
+		instances, err := strconv.Atoi(opts.Instances)
+		if err != nil || instances <= 0 {
+			return fmt.Errorf("invalid number of instances %q: must be a positive integer", opts.Instances)
+		}
+		change.Instances = instances
+	}
+
+	if opts.Memory != "" {
+		memory, err := bytefmt.ToMegabytes(opts.Memory)
+		if err != nil {
+			return fmt.Errorf("invalid memory limit %q: %s", opts.Memory, err)
+		}
+		change.MemoryMB = int(memory)
+	}
+
+	if opts.DiskQuota != "" {
+		disk, err := bytefmt.ToMegabytes(opts.DiskQuota)
+		if err != nil {
+			return fmt.Errorf("invalid disk limit %q: %s", opts.DiskQuota, err)
+		}
+		change.DiskMB = int(disk)
+	}
+
+	opts.Instances, opts.Memory, opts.DiskQuota = "", "", ""
+	return nil
+}
+
+// promoteFrom takes the space to promote from out of opts and into the change.
+func (change *Change) promoteFrom(opts *Options) error {
+	if opts.FromSpace == "" {
+		return ErrNoSourceSpace
+	}
+
+	change.From = &Target{Org: opts.FromOrg, Space: opts.FromSpace}
+	change.CopyEnv = opts.CopyEnv
+	opts.FromOrg, opts.FromSpace, opts.CopyEnv = "", "", false
+	return nil
+}
+
+// appSpec is everything about an app that is copied to its new version.
+type appSpec struct {
+	GUID      string
+	Lifecycle appLifecycle
+	Env       map[string]string
+	Processes []appProcess
+
+	DropletGUID string
+	PackageGUID string
+
+	Routes           []appRoute
+	ServiceInstances []string
+}
+
+type appLifecycle struct {
+	Type string `json:"type"`
+	Data struct {
+		Buildpacks []string `json:"buildpacks,omitempty"`
+		Stack      string   `json:"stack,omitempty"`
+	} `json:"data"`
+}
+
+// appProcess is one of the processes of an app, such as web or worker.
+type appProcess struct {
+	Type        string          `json:"type"`
+	Instances   int             `json:"instances"`
+	MemoryMB    int             `json:"memory_in_mb"`
+	DiskMB      int             `json:"disk_in_mb"`
+	Command     *string         `json:"command"`
+	HealthCheck json.RawMessage `json:"health_check"`
+}
+
+type appRoute struct {
+	GUID string `json:"guid"`
+	URL  string `json:"url"`
+}
+
+// readApp reads the spec of an app.
+func (repo *ApplicationRepo) readApp(appGUID string) (*appSpec, error) {
+	spec := &appSpec{GUID: appGUID}
+
+	app := struct {
+		Lifecycle appLifecycle `json:"lifecycle"`
+	}{}
+	err := repo.curl("GET", "/v3/apps/"+appGUID, nil, &app)
+	if err != nil {
+		return nil, err
+	}
+	spec.Lifecycle = app.Lifecycle
+
+	env := struct {
+		Var map[string]string `json:"var"`
+	}{}
+	err = repo.curl("GET", fmt.Sprintf("/v3/apps/%s/environment_variables", appGUID), nil, &env)
+	if err != nil {
+		return nil, err
+	}
+	spec.Env = env.Var
+
+	processes := struct {
+		Resources []appProcess `json:"resources"`
+	}{}
+	err = repo.curl("GET", fmt.Sprintf("/v3/apps/%s/processes", appGUID), nil, &processes)
+	if err != nil {
+		return nil, err
+	}
+	for _, listed := range processes.Resources {
+		// lists hide the commands, so each process is read on its own
+		var process appProcess
+		err = repo.curl("GET", fmt.Sprintf("/v3/apps/%s/processes/%s", appGUID, listed.Type), nil, &process)
+		if err != nil {
+			return nil, err
+		}
+		process.Type = listed.Type
+		spec.Processes = append(spec.Processes, process)
+	}
+
+	droplet := struct {
+		GUID string `json:"guid"`
+	}{}
+	err = repo.curl("GET", fmt.Sprintf("/v3/apps/%s/droplets/current", appGUID), nil, &droplet)
+	if err != nil {
+		return nil, err
+	}
+	spec.DropletGUID = droplet.GUID
+
+	packages := struct {
+		Resources []struct {
+			GUID string `json:"guid"`
+		} `json:"resources"`
+	}{}
+	err = repo.curl("GET", fmt.Sprintf("/v3/apps/%s/packages?order_by=-created_at&per_page=1", appGUID), nil, &packages)
+	if err != nil {
+		return nil, err
+	}
+	if len(packages.Resources) > 0 {
+		spec.PackageGUID = packages.Resources[0].GUID
+	}
+
+	routes := struct {
+		Resources []appRoute `json:"resources"`
+	}{}
+	err = repo.curl("GET", fmt.Sprintf("/v3/apps/%s/routes", appGUID), nil, &routes)
+	if err != nil {
+		return nil, err
+	}
+	spec.Routes = routes.Resources
+
+	bindings := struct {
+		Resources []struct {
+			Entity struct {
+				ServiceInstanceGUID string `json:"service_instance_guid"`
+			} `json:"entity"`
+		} `json:"resources"`
+	}{}
+	err = repo.curl("GET", fmt.Sprintf("/v2/apps/%s/service_bindings", appGUID), nil, &bindings)
+	if err != nil {
+		return nil, err
+	}
+	for _, binding := range bindings.Resources {
+		spec.ServiceInstances = append(spec.ServiceInstances, binding.Entity.ServiceInstanceGUID)
+	}
+
+	return spec, nil
+}
+
+// promoted returns the spec of the source app in place of the current app.
+// Routes and service instances belong to a space, so the current app's are
+// kept. So are its environment variables, which tend to hold credentials
+// and URLs for the space, unless copyEnv is set.
+func promoted(current, source appSpec, copyEnv bool) appSpec {
+	source.GUID = current.GUID
+	source.Routes = current.Routes
+	source.ServiceInstances = current.ServiceInstances
+	if !copyEnv {
+		source.Env = current.Env
+	}
+	return source
+}
+
+// process returns the process of the given type, or nil if the app has none.
+func (spec appSpec) process(processType string) *appProcess {
+	for i := range spec.Processes {
+		if spec.Processes[i].Type == processType {
+			return &spec.Processes[i]
+		}
+	}
+	return nil
+}
+
+// findApp returns the GUID of the app called appName in the target space. The
+// org defaults to the targeted one.
+func (repo *ApplicationRepo) findApp(target Target, appName string) (string, error) {
+	resources := struct {
+		Resources []struct {
+			GUID string `json:"guid"`
+		} `json:"resources"`
+	}{}
+
+	orgGUID := ""
+	if target.Org == "" {
+		org, err := repo.conn.GetCurrentOrg()
+		if err != nil {
+			return "", err
+		}
+		orgGUID = org.Guid
+	} else {
+		err := repo.curl("GET", "/v3/organizations?names="+url.QueryEscape(target.Org), nil, &resources)
+		if err != nil {
+			return "", err
+		}
+		if len(resources.Resources) == 0 {
+			return "", fmt.Errorf("org %s not found", target.Org)
+		}
+		orgGUID = resources.Resources[0].GUID
+	}
+
+	err := repo.curl("GET", fmt.Sprintf("/v3/spaces?names=%s&organization_guids=%s", url.QueryEscape(target.Space), orgGUID), nil, &resources)
+	if err != nil {
+		return "", err
+	}
+	if len(resources.Resources) == 0 {
+		return "", fmt.Errorf("space %s not found", target.Space)
+	}
+	spaceGUID := resources.Resources[0].GUID
+
+	err = repo.curl("GET", fmt.Sprintf("/v3/apps?names=%s&space_guids=%s", url.QueryEscape(appName), spaceGUID), nil, &resources)
+	if err != nil {
+		return "", err
+	}
+	if len(resources.Resources) == 0 {
+		return "", fmt.Errorf("%s not found in space %s", appName, target.Space)
+	}
+	return resources.Resources[0].GUID, nil
+}
+
+// apply returns the spec with the change made to it.
+func (change Change) apply(spec appSpec) appSpec {
+	env := map[string]string{}
+	for name, value := range spec.Env {
+		env[name] = value
+	}
+	for name, value := range change.Env {
+		env[name] = value
+	}
+	spec.Env = env
+
+	if change.Stack != "" {
+		spec.Lifecycle.Data.Stack = change.Stack
+	}
+
+	spec.Processes = append([]appProcess(nil), spec.Processes...)
+	if web := spec.process("web"); web != nil {
+		if change.Instances != 0 {
+			web.Instances = change.Instances
+		}
+		if change.MemoryMB != 0 {
+			web.MemoryMB = change.MemoryMB
+		}
+		if change.DiskMB != 0 {
+			web.DiskMB = change.DiskMB
+		}
+	}
+
+	return spec
+}
+
+// createApp creates a stopped app called name in the targeted space from
+// spec, returning its GUID. It has no droplet, routes or services yet.
+func (repo *ApplicationRepo) createApp(name string, spec appSpec) (string, error) {
+	space, err := repo.conn.GetCurrentSpace()
+	if err != nil {
+		return "", err
+	}
+
+	app := struct {
+		GUID string `json:"guid"`
+	}{}
+	err = repo.curl("POST", "/v3/apps", map[string]interface{}{
+		"name": name,
+		"relationships": map[string]interface{}{
+			"space": map[string]interface{}{
+				"data": map[string]string{"guid": space.Guid},
+			},
+		},
+		"lifecycle":             spec.Lifecycle,
+		"environment_variables": spec.Env,
+	}, &app)
+	if err != nil {
+		return "", err
+	}
+
+	return app.GUID, nil
+}
+
+// configureApp sets up the processes and services of a newly created app with
+// a droplet to match spec.
+func (repo *ApplicationRepo) configureApp(appGUID string, spec appSpec) error {
+	for _, process := range spec.Processes {
+		err := repo.configureProcess(appGUID, process)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, serviceInstance := range spec.ServiceInstances {
+		err := repo.curl("POST", "/v2/service_bindings", map[string]string{
+			"service_instance_guid": serviceInstance,
+			"app_guid":              appGUID,
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// configureProcess scales one of the processes of a newly created app and sets
+// its command and health check.
+func (repo *ApplicationRepo) configureProcess(appGUID string, process appProcess) error {
+	err := repo.curl("POST", fmt.Sprintf("/v3/apps/%s/processes/%s/actions/scale", appGUID, process.Type), map[string]int{
+		"instances":    process.Instances,
+		"memory_in_mb": process.MemoryMB,
+		"disk_in_mb":   process.DiskMB,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	created := struct {
+		GUID string `json:"guid"`
+	}{}
+	err = repo.curl("GET", fmt.Sprintf("/v3/apps/%s/processes/%s", appGUID, process.Type), nil, &created)
+	if err != nil {
+		return err
+	}
+
+	update := map[string]interface{}{}
+	if process.Command != nil {
+		update["command"] = *process.Command
+	}
+	if len(process.HealthCheck) > 0 {
+		update["health_check"] = process.HealthCheck
+	}
+	if len(update) == 0 {
+		return nil
+	}
+	return repo.curl("PATCH", "/v3/processes/"+created.GUID, update, nil)
+}
+
+// currentStack returns the stack that the app's current droplet was staged
+// on.
+func (repo *ApplicationRepo) currentStack(appGUID string) (string, error) {
+	droplet := struct {
+		Stack string `json:"stack"`
+	}{}
+	err := repo.curl("GET", fmt.Sprintf("/v3/apps/%s/droplets/current", appGUID), nil, &droplet)
+	return droplet.Stack, err
+}
+
+// mapRoutes maps the routes to the app as well as to whatever they are
+// already mapped to.
+func (repo *ApplicationRepo) mapRoutes(appGUID string, routes []appRoute) error {
+	for _, route := range routes {
+		err := repo.curl("POST", fmt.Sprintf("/v3/routes/%s/destinations", route.GUID), map[string]interface{}{
+			"destinations": []interface{}{
+				map[string]interface{}{
+					"app": map[string]string{"guid": appGUID},
+				},
+			},
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourceApp returns the spec of the app of the same name in the space it is
+// promoted from.
+func sourceApp(appRepo *ApplicationRepo, source Target, appName, currentGUID string) (*appSpec, error) {
+	sourceGUID, err := appRepo.findApp(source, appName)
+	if err != nil {
+		return nil, ErrPreflight{Err: err}
+	}
+	if sourceGUID == currentGUID {
+		return nil, ErrPreflight{Err: fmt.Errorf("%s is already in space %s", appName, source.Space)}
+	}
+
+	sourceSpec, err := appRepo.readApp(sourceGUID)
+	if err != nil {
+		return nil, err
+	}
+	if sourceSpec.DropletGUID == "" {
+		return nil, ErrPreflight{Err: fmt.Errorf("%s has never been staged in space %s", appName, source.Space)}
+	}
+
+	return sourceSpec, nil
+}
+
+// getActionsForChange replaces a running app with a changed copy of itself.
+// The copy is started alongside the app and given its routes before the two
+// swap names, so there is always something serving them.
+func getActionsForChange(appRepo *ApplicationRepo, opts Options, report *Report) []rewind.Action {
+	appName := opts.AppName
+	venName := opts.VenerableAppName()
+	candidateName := opts.CandidateAppName()
+	var err error
+	var curApp *AppEntity
+	var spec appSpec
+	var candidateGUID string
+	var renamedCurrent, renamedCandidate bool
+
+	rollBack := func() error {
+		if renamedCandidate {
+			err := appRepo.RenameApplication(appName, candidateName)
+			if err != nil {
+				return err
+			}
+			renamedCandidate = false
+		}
+
+		if renamedCurrent {
+			err := appRepo.RenameApplication(venName, appName)
+			if err != nil {
+				return err
+			}
+			renamedCurrent = false
+		}
+
+		return appRepo.DeleteApplication(candidateName)
+	}
+
+	return []rewind.Action{
+		// read everything about the current app that the new one is made from
+		{
+			Name: "find current app",
+			Forward: func() error {
+				curApp, err = appRepo.GetAppMetadata(appName)
+				if err == ErrAppNotFound {
+					return ErrPreflight{Err: fmt.Errorf("%s not found", appName)}
+				} else if err != nil {
+					return err
+				}
+
+				var current *appSpec
+				current, err = appRepo.readApp(curApp.GUID)
+				if err != nil {
+					return err
+				}
+				if opts.Change.From != nil {
+					var source *appSpec
+					source, err = sourceApp(appRepo, *opts.Change.From, appName, curApp.GUID)
+					if err != nil {
+						return err
+					}
+					*current = promoted(*current, *source, opts.Change.CopyEnv)
+				}
+				if current.DropletGUID == "" {
+					return ErrPreflight{Err: fmt.Errorf("%s has never been staged", appName)}
+				}
+				if opts.Change.Restage && current.PackageGUID == "" {
+					return ErrPreflight{Err: ErrNoPackage}
+				}
+				if opts.Change.Stack != "" && current.Lifecycle.Type != "buildpack" {
+					return ErrPreflight{Err: fmt.Errorf("%s is a %s app, which has no stack to change", appName, current.Lifecycle.Type)}
+				}
+				if opts.Change.Stack != "" && current.Lifecycle.Data.Stack == opts.Change.Stack {
+					return ErrPreflight{Err: fmt.Errorf("%s is already on %s", appName, opts.Change.Stack)}
+				}
+
+				spec = opts.Change.apply(*current)
+				return nil
+			},
+		},
+		// create the new app without any routes, clearing away any left over by an earlier deploy
+		{
+			Name: "create candidate",
+			Forward: func() error {
+				err = appRepo.DeleteApplication(candidateName)
+				if err != nil {
+					return err
+				}
+				candidateGUID, err = appRepo.createApp(candidateName, spec)
+				return err
+			},
+			ReversePrevious: rollBack,
+		},
+		// give it a droplet, either a copy of the current one or one staged from the current package
+		{
+			Name: "stage candidate",
+			Kind: stagingAction,
+			Forward: func() error {
+				if !opts.Change.Restage {
+					_, err = appRepo.copyDroplet(spec.DropletGUID, candidateGUID, opts.StartupTimeout)
+					if err != nil {
+						return stagingError(err)
+					}
+					return nil
+				}
+
+				err = appRepo.copyPackage(spec.PackageGUID, candidateGUID, opts.StartupTimeout)
+				if err != nil {
+					return stagingError(err)
+				}
+				_, err = appRepo.stageLatestPackage(&AppEntity{GUID: candidateGUID}, opts.ShowLogs, opts.StartupTimeout)
+				if err != nil {
+					return stagingError(err)
+				}
+				return nil
+			},
+			ReversePrevious: rollBack,
+		},
+		// start it and wait for every instance to be running
+		{
+			Name: "start candidate",
+			Kind: startAction,
+			Forward: func() error {
+				err = appRepo.configureApp(candidateGUID, spec)
+				if err != nil {
+					return err
+				}
+
+				if opts.ShowLogs {
+					stop, err := appRepo.tailLogs(candidateGUID, false)
+					if err != nil {
+						return err
+					}
+					defer stop()
+				}
+
+				err = appRepo.curl("POST", fmt.Sprintf("/v3/apps/%s/actions/start", candidateGUID), nil, nil)
+				if err == nil {
+					err = appRepo.waitForRunning(candidateGUID, opts.StartupTimeout)
+				}
+				if err != nil {
+					return ErrStart{Err: err}
+				}
+				return nil
+			},
+			ReversePrevious: rollBack,
+		},
+		// make sure that what is running is on the stack that was asked for
+		{
+			Name: "verify stack",
+			Forward: func() error {
+				if opts.Change.Stack == "" {
+					return nil
+				}
+
+				var stack string
+				stack, err = appRepo.currentStack(candidateGUID)
+				if err != nil {
+					return err
+				}
+				if stack != opts.Change.Stack {
+					return ErrVerification{Err: fmt.Errorf("the new version of %s is running on %s rather than %s", appName, stack, opts.Change.Stack)}
+				}
+				return nil
+			},
+			ReversePrevious: rollBack,
+		},
+		// share the current app's routes with it
+		{
+			Name: "map routes",
+			Forward: func() error {
+				return appRepo.mapRoutes(candidateGUID, spec.Routes)
+			},
+			ReversePrevious: rollBack,
+		},
+		// swap the names so that the new app takes over from the current one
+		{
+			Name: "rename current app",
+			Kind: cutoverAction,
+			Forward: func() error {
+				err = appRepo.DeleteApplication(venName)
+				if err != nil {
+					return err
+				}
+
+				err = appRepo.RenameApplication(appName, venName)
+				if err != nil {
+					return err
+				}
+				renamedCurrent = true
+				report.Replaced = curApp.GUID
+
+				err = appRepo.RenameApplication(candidateName, appName)
+				if err != nil {
+					return err
+				}
+				renamedCandidate = true
+				return nil
+			},
+			ReversePrevious: rollBack,
+		},
+		// compare the new and old apps while they share the same routes, before the old app goes
+		{
+			Name: "observe new version",
+			Forward: func() error {
+				if opts.ObserveWindow == 0 {
+					return nil
+				}
+				err = appRepo.Observe(appName, curApp.GUID, candidateGUID, opts.ObserveWindow, opts.RouteThresholds, opts.LogThresholds)
+				if err != nil {
+					return ErrVerification{Err: err}
+				}
+				return nil
+			},
+			ReversePrevious: rollBack,
+		},
+		// delete
+		{
+			Name: "delete old apps",
+			Forward: func() error {
+				if opts.keepVenerable {
+					report.VenerableKept = true
+					return nil
+				}
+				return appRepo.DeleteApplication(venName)
+			},
+		},
+	}
+}
+
+// getActionsForFirstPromotion promotes an app to a space that doesn't have it
+// yet. There is nothing to replace, so the copy is created under the app's
+// name, without any routes or services of its own, and without environment
+// variables unless they are copied. If it can't be started it is deleted
+// again, so that the next attempt also starts from scratch.
+func getActionsForFirstPromotion(appRepo *ApplicationRepo, opts Options, report *Report) []rewind.Action {
+	appName := opts.AppName
+	var err error
+	var spec appSpec
+	var appGUID string
+
+	removeApp := func() error {
+		if appGUID == "" {
+			return nil
+		}
+		return appRepo.DeleteApplication(appName)
+	}
+
+	return []rewind.Action{
+		// read the app being promoted
+		{
+			Name: "find source app",
+			Forward: func() error {
+				var source *appSpec
+				source, err = sourceApp(appRepo, *opts.Change.From, appName, "")
+				if err != nil {
+					return err
+				}
+				*source = promoted(appSpec{}, *source, opts.Change.CopyEnv)
+				spec = opts.Change.apply(*source)
+				return nil
+			},
+		},
+		// create the app with a copy of the source app's droplet
+		{
+			Name: "create app",
+			Forward: func() error {
+				appGUID, err = appRepo.createApp(appName, spec)
+				if err != nil {
+					return err
+				}
+				_, err = appRepo.copyDroplet(spec.DropletGUID, appGUID, opts.StartupTimeout)
+				if err != nil {
+					return stagingError(err)
+				}
+				return nil
+			},
+			ReversePrevious: removeApp,
+		},
+		// start it and wait for every instance to be running
+		{
+			Name: "start app",
+			Kind: startAction,
+			Forward: func() error {
+				err = appRepo.configureApp(appGUID, spec)
+				if err != nil {
+					return err
+				}
+
+				err = appRepo.curl("POST", fmt.Sprintf("/v3/apps/%s/actions/start", appGUID), nil, nil)
+				if err == nil {
+					err = appRepo.waitForRunning(appGUID, opts.StartupTimeout)
+				}
+				if err != nil {
+					return ErrStart{Err: err}
+				}
+				return nil
+			},
+			ReversePrevious: removeApp,
+		},
+	}
+}
+
+// isFirstPromotion returns whether opts promotes an app to a space that
+// doesn't have it yet.
+func isFirstPromotion(appRepo *ApplicationRepo, opts Options) (bool, error) {
+	if opts.Change == nil || opts.Change.From == nil {
+		return false, nil
+	}
+
+	_, err := appRepo.GetAppMetadata(opts.AppName)
+	if err == ErrAppNotFound {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,362 @@
+package deploy
+
+import (
+	"encoding/json"
+	"strings"
+
+	"code.cloudfoundry.org/cli/plugin/pluginfakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/contraband/autopilot/rewind"
+)
+
+// changeSpace extends fakeSpace with the Cloud Controller requests made when
+// an app is copied, logging them in order alongside the cf commands.
+type changeSpace struct {
+	*fakeSpace
+	responses map[string]string
+	bodies    map[string]string
+	log       []string
+}
+
+func (space *changeSpace) cliCommand(args ...string) ([]string, error) {
+	space.log = append(space.log, strings.Join(args, " "))
+	return space.fakeSpace.cliCommand(args...)
+}
+
+func (space *changeSpace) curl(args ...string) ([]string, error) {
+	method := "GET"
+	body := ""
+	for i := 2; i+1 < len(args); i += 2 {
+		switch args[i] {
+		case "-X":
+			method = args[i+1]
+		case "-d":
+			body = args[i+1]
+		}
+	}
+
+	request := method + " " + args[1]
+	response, ok := space.responses[request]
+	if !ok {
+		return space.fakeSpace.curl(args...)
+	}
+
+	space.log = append(space.log, request)
+	space.bodies[request] = body
+	if request == "POST /v3/apps" {
+		var app struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal([]byte(body), &app)
+		space.apps[app.Name] = "STARTED"
+	}
+	if strings.HasSuffix(request, "-guid/actions/start") {
+		name := strings.TrimSuffix(strings.TrimPrefix(request, "POST /v3/apps/"), "-guid/actions/start")
+		if _, ok := space.apps[name]; ok {
+			space.apps[name] = "STARTED"
+		}
+	}
+	return []string{response}, nil
+}
+
+var _ = Describe("getActionsForChange", func() {
+	var (
+		space *changeSpace
+		repo  *ApplicationRepo
+		opts  Options
+	)
+
+	BeforeEach(func() {
+		space = &changeSpace{
+			fakeSpace: &fakeSpace{apps: map[string]string{"app": "STARTED"}, unhealthy: map[string]bool{}},
+			responses: map[string]string{
+				"GET /v3/apps/app-guid":                                                    `{"lifecycle":{"type":"buildpack","data":{"buildpacks":["ruby_buildpack"],"stack":"cflinuxfs3"}}}`,
+				"GET /v3/apps/app-guid/environment_variables":                              `{"var":{"EXISTING":"1"}}`,
+				"GET /v3/apps/app-guid/processes":                                          `{"resources":[{"type":"web"},{"type":"worker"}]}`,
+				"GET /v3/apps/app-guid/processes/web":                                      `{"instances":2,"memory_in_mb":256,"disk_in_mb":1024,"command":null,"health_check":{"type":"http"}}`,
+				"GET /v3/apps/app-guid/processes/worker":                                   `{"instances":3,"memory_in_mb":512,"disk_in_mb":1024,"command":"bundle exec sidekiq","health_check":{"type":"process"}}`,
+				"GET /v3/apps/app-guid/droplets/current":                                   `{"guid":"droplet-guid"}`,
+				"GET /v3/apps/app-guid/packages?order_by=-created_at&per_page=1":           `{"resources":[{"guid":"package-guid"}]}`,
+				"GET /v3/apps/app-guid/routes":                                             `{"resources":[{"guid":"route-guid","url":"app.example.com"}]}`,
+				"GET /v2/apps/app-guid/service_bindings":                                   `{"resources":[{"entity":{"service_instance_guid":"db-guid"}}]}`,
+				"POST /v3/apps":                                                            `{"guid":"app-candidate-guid"}`,
+				"POST /v3/droplets?source_guid=droplet-guid":                               `{"guid":"droplet-copy-guid","state":"STAGED"}`,
+				"PATCH /v3/apps/app-candidate-guid/relationships/current_droplet":          `{}`,
+				"POST /v3/packages?source_guid=package-guid":                               `{"guid":"package-copy-guid","state":"READY"}`,
+				"GET /v3/apps/app-candidate-guid/packages?order_by=-created_at&per_page=1": `{"resources":[{"guid":"package-copy-guid"}]}`,
+				"POST /v3/builds":                                                          `{"guid":"build-guid","state":"STAGED","droplet":{"guid":"new-droplet-guid"}}`,
+				"POST /v3/apps/app-candidate-guid/processes/web/actions/scale":             `{}`,
+				"GET /v3/apps/app-candidate-guid/processes/web":                            `{"guid":"process-guid"}`,
+				"PATCH /v3/processes/process-guid":                                         `{}`,
+				"POST /v3/apps/app-candidate-guid/processes/worker/actions/scale":          `{}`,
+				"GET /v3/apps/app-candidate-guid/processes/worker":                         `{"guid":"worker-process-guid"}`,
+				"PATCH /v3/processes/worker-process-guid":                                  `{}`,
+				"POST /v2/service_bindings":                                                `{}`,
+				"POST /v3/apps/app-candidate-guid/actions/start":                           `{}`,
+				"POST /v3/routes/route-guid/destinations":                                  `{}`,
+			},
+			bodies: map[string]string{},
+		}
+
+		cliConn := &pluginfakes.FakeCliConnection{}
+		cliConn.CliCommandStub = space.cliCommand
+		cliConn.CliCommandWithoutTerminalOutputStub = space.curl
+		repo = NewApplicationRepo(cliConn)
+
+		opts = defaultOptions()
+		opts.AppName = "app"
+	})
+
+	change := func() error {
+		return rewind.Actions{Actions: getActionsForChange(repo, opts, &Report{})}.Execute()
+	}
+
+	It("replaces the app with a copy of its droplet that has the new environment", func() {
+		opts.Change = &Change{Env: map[string]string{"NEW": "2"}}
+
+		Expect(change()).To(Succeed())
+
+		Expect(space.bodies["POST /v3/apps"]).To(ContainSubstring(`"environment_variables":{"EXISTING":"1","NEW":"2"}`))
+		Expect(space.bodies["POST /v3/apps/app-candidate-guid/processes/web/actions/scale"]).To(Equal(`{"disk_in_mb":1024,"instances":2,"memory_in_mb":256}`))
+		Expect(space.bodies["PATCH /v3/processes/process-guid"]).To(Equal(`{"health_check":{"type":"http"}}`))
+		Expect(space.bodies["POST /v2/service_bindings"]).To(ContainSubstring(`"service_instance_guid":"db-guid"`))
+		Expect(space.log).To(ContainElement("POST /v3/droplets?source_guid=droplet-guid"))
+		Expect(space.log).ToNot(ContainElement("POST /v3/builds"))
+
+		Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+		Expect(space.log).To(ContainElement("delete app-venerable -f"))
+	})
+
+	It("starts the new app at its new scale", func() {
+		opts.Change = &Change{Instances: 4, MemoryMB: 2048}
+
+		Expect(change()).To(Succeed())
+
+		Expect(space.bodies["POST /v3/apps/app-candidate-guid/processes/web/actions/scale"]).To(Equal(`{"disk_in_mb":1024,"instances":4,"memory_in_mb":2048}`))
+		Expect(space.bodies["POST /v3/apps/app-candidate-guid/processes/worker/actions/scale"]).To(Equal(`{"disk_in_mb":1024,"instances":3,"memory_in_mb":512}`))
+		Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+	})
+
+	It("scales every process of the new app to match the current one", func() {
+		opts.Change = &Change{}
+
+		Expect(change()).To(Succeed())
+
+		Expect(space.bodies["POST /v3/apps/app-candidate-guid/processes/worker/actions/scale"]).To(Equal(`{"disk_in_mb":1024,"instances":3,"memory_in_mb":512}`))
+		Expect(space.bodies["PATCH /v3/processes/worker-process-guid"]).To(Equal(`{"command":"bundle exec sidekiq","health_check":{"type":"process"}}`))
+	})
+
+	It("maps the routes to the new app before it takes over the name", func() {
+		opts.Change = &Change{}
+
+		Expect(change()).To(Succeed())
+
+		var order []string
+		for _, entry := range space.log {
+			if entry == "POST /v3/routes/route-guid/destinations" || strings.HasPrefix(entry, "rename ") {
+				order = append(order, entry)
+			}
+		}
+		Expect(order).To(Equal([]string{
+			"POST /v3/routes/route-guid/destinations",
+			"rename app app-venerable",
+			"rename app-candidate app",
+		}))
+	})
+
+	It("measures how long the new app took to become healthy", func() {
+		opts.Change = &Change{Restage: true}
+
+		timings, err := rewind.Actions{Actions: getActionsForChange(repo, opts, &Report{})}.ExecuteTimed()
+		Expect(err).ToNot(HaveOccurred())
+
+		var stage, start rewind.Timing
+		for _, timing := range timings {
+			switch timing.Name {
+			case "stage candidate":
+				stage = timing
+			case "start candidate":
+				start = timing
+			}
+		}
+		metrics := newMetrics(Report{}, timings, 0, nil)
+		Expect(metrics.Staging).To(Equal(stage.Duration()))
+		Expect(metrics.TimeToHealthy).To(Equal(start.Duration()))
+		Expect(metrics.TimeToHealthy).To(BeNumerically(">", 0))
+	})
+
+	It("restages a copy of the current package", func() {
+		opts.Change = &Change{Restage: true}
+
+		Expect(change()).To(Succeed())
+
+		Expect(space.log).To(ContainElement("POST /v3/packages?source_guid=package-guid"))
+		Expect(space.bodies["POST /v3/builds"]).To(Equal(`{"package":{"guid":"package-copy-guid"}}`))
+		Expect(space.log).ToNot(ContainElement("POST /v3/droplets?source_guid=droplet-guid"))
+	})
+
+	Describe("changing stack", func() {
+		BeforeEach(func() {
+			opts.Change = &Change{Restage: true, Stack: "cflinuxfs4"}
+		})
+
+		It("restages the app on the new stack", func() {
+			space.responses["GET /v3/apps/app-candidate-guid/droplets/current"] = `{"guid":"new-droplet-guid","stack":"cflinuxfs4"}`
+
+			Expect(change()).To(Succeed())
+
+			Expect(space.bodies["POST /v3/apps"]).To(ContainSubstring(`"lifecycle":{"type":"buildpack","data":{"buildpacks":["ruby_buildpack"],"stack":"cflinuxfs4"}}`))
+			Expect(space.log).To(ContainElement("POST /v3/builds"))
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+		})
+
+		It("rolls back if the new app isn't running on the new stack", func() {
+			err := change()
+			Expect(err).To(BeAssignableToTypeOf(ErrVerification{}))
+			Expect(err).To(MatchError("the new version of app is running on cflinuxfs3 rather than cflinuxfs4"))
+
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+			Expect(space.log).To(ContainElement("delete app-candidate -f"))
+		})
+
+		It("refuses to move an app to the stack it is already on", func() {
+			opts.Change.Stack = "cflinuxfs3"
+
+			err := change()
+			Expect(err).To(BeAssignableToTypeOf(ErrPreflight{}))
+			Expect(space.log).ToNot(ContainElement("POST /v3/apps"))
+		})
+	})
+
+	Describe("promoting from another space", func() {
+		BeforeEach(func() {
+			opts.Change = &Change{From: &Target{Space: "staging"}}
+
+			for request, response := range map[string]string{
+				"GET /v3/spaces?names=staging&organization_guids=":                  `{"resources":[{"guid":"staging-guid"}]}`,
+				"GET /v3/apps?names=app&space_guids=staging-guid":                   `{"resources":[{"guid":"staged-guid"}]}`,
+				"GET /v3/apps/staged-guid":                                          `{"lifecycle":{"type":"buildpack","data":{"buildpacks":["go_buildpack"],"stack":"cflinuxfs4"}}}`,
+				"GET /v3/apps/staged-guid/environment_variables":                    `{"var":{"STAGING":"1"}}`,
+				"GET /v3/apps/staged-guid/processes":                                `{"resources":[{"type":"web"}]}`,
+				"GET /v3/apps/staged-guid/processes/web":                            `{"instances":1,"memory_in_mb":128,"disk_in_mb":512,"command":"./server","health_check":{"type":"port"}}`,
+				"GET /v3/apps/staged-guid/droplets/current":                         `{"guid":"staged-droplet-guid"}`,
+				"GET /v3/apps/staged-guid/packages?order_by=-created_at&per_page=1": `{"resources":[{"guid":"staged-package-guid"}]}`,
+				"GET /v3/apps/staged-guid/routes":                                   `{"resources":[{"guid":"staging-route-guid","url":"app.staging.example.com"}]}`,
+				"GET /v2/apps/staged-guid/service_bindings":                         `{"resources":[{"entity":{"service_instance_guid":"staging-db-guid"}}]}`,
+				"POST /v3/droplets?source_guid=staged-droplet-guid":                 `{"guid":"droplet-copy-guid","state":"STAGED"}`,
+			} {
+				space.responses[request] = response
+			}
+		})
+
+		It("runs a copy of the other space's app with this space's routes, services and environment", func() {
+			Expect(change()).To(Succeed())
+
+			Expect(space.log).To(ContainElement("POST /v3/droplets?source_guid=staged-droplet-guid"))
+			Expect(space.bodies["POST /v3/apps"]).To(ContainSubstring(`"stack":"cflinuxfs4"`))
+			Expect(space.bodies["POST /v3/apps"]).To(ContainSubstring(`"environment_variables":{"EXISTING":"1"}`))
+			Expect(space.bodies["POST /v3/apps/app-candidate-guid/processes/web/actions/scale"]).To(Equal(`{"disk_in_mb":512,"instances":1,"memory_in_mb":128}`))
+			Expect(space.bodies["PATCH /v3/processes/process-guid"]).To(Equal(`{"command":"./server","health_check":{"type":"port"}}`))
+			Expect(space.bodies["POST /v2/service_bindings"]).To(ContainSubstring(`"service_instance_guid":"db-guid"`))
+			Expect(space.log).To(ContainElement("POST /v3/routes/route-guid/destinations"))
+			Expect(space.log).ToNot(ContainElement("POST /v3/routes/staging-route-guid/destinations"))
+
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+		})
+
+		It("copies the other space's environment when asked to", func() {
+			opts.Change.CopyEnv = true
+
+			Expect(change()).To(Succeed())
+
+			Expect(space.bodies["POST /v3/apps"]).To(ContainSubstring(`"environment_variables":{"STAGING":"1"}`))
+		})
+
+		It("refuses to promote an app onto itself", func() {
+			space.responses["GET /v3/apps?names=app&space_guids=staging-guid"] = `{"resources":[{"guid":"app-guid"}]}`
+
+			err := change()
+			Expect(err).To(BeAssignableToTypeOf(ErrPreflight{}))
+			Expect(space.log).ToNot(ContainElement("POST /v3/apps"))
+		})
+
+		It("refuses to promote from a space without the app", func() {
+			space.responses["GET /v3/apps?names=app&space_guids=staging-guid"] = `{"resources":[]}`
+
+			err := change()
+			Expect(err).To(MatchError("app not found in space staging"))
+		})
+
+		It("creates the app in a space that doesn't have it yet", func() {
+			delete(space.apps, "app")
+
+			first, err := isFirstPromotion(repo, opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(first).To(BeTrue())
+
+			Expect(rewind.Actions{Actions: getActionsForFirstPromotion(repo, opts, &Report{})}.Execute()).To(Succeed())
+
+			Expect(space.bodies["POST /v3/apps"]).To(ContainSubstring(`"name":"app"`))
+			Expect(space.bodies["POST /v3/apps"]).To(ContainSubstring(`"environment_variables":{}`))
+			Expect(space.log).To(ContainElement("POST /v3/droplets?source_guid=staged-droplet-guid"))
+			Expect(space.log).To(ContainElement("POST /v3/apps/app-candidate-guid/actions/start"))
+			Expect(space.log).ToNot(ContainElement("POST /v2/service_bindings"))
+			Expect(space.log).ToNot(ContainElement(HavePrefix("POST /v3/routes/")))
+			Expect(space.log).ToNot(ContainElement(HavePrefix("rename ")))
+		})
+
+		It("creates the app with the other space's environment when asked to", func() {
+			delete(space.apps, "app")
+			opts.Change.CopyEnv = true
+
+			Expect(rewind.Actions{Actions: getActionsForFirstPromotion(repo, opts, &Report{})}.Execute()).To(Succeed())
+
+			Expect(space.bodies["POST /v3/apps"]).To(ContainSubstring(`"environment_variables":{"STAGING":"1"}`))
+		})
+
+		It("deletes the app it created if it fails to start", func() {
+			delete(space.apps, "app")
+			// every app created here is given the candidate's GUID
+			space.unhealthy["app-candidate"] = true
+
+			err := rewind.Actions{Actions: getActionsForFirstPromotion(repo, opts, &Report{})}.Execute()
+			Expect(err).To(BeAssignableToTypeOf(ErrStart{}))
+
+			Expect(space.log).To(ContainElement("delete app -f"))
+			Expect(space.apps).To(BeEmpty())
+		})
+	})
+
+	It("deletes the new app and leaves the current one alone if it fails to start", func() {
+		opts.Change = &Change{Restage: true}
+		space.unhealthy["app-candidate"] = true
+
+		err := change()
+		Expect(err).To(BeAssignableToTypeOf(ErrStart{}))
+
+		Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+		Expect(space.log).To(ContainElement("delete app-candidate -f"))
+		Expect(space.log).ToNot(ContainElement("rename app app-venerable"))
+	})
+
+	It("refuses to restage an app that has no package", func() {
+		opts.Change = &Change{Restage: true}
+		space.responses["GET /v3/apps/app-guid/packages?order_by=-created_at&per_page=1"] = `{"resources":[]}`
+
+		err := change()
+		Expect(err).To(BeAssignableToTypeOf(ErrPreflight{}))
+		Expect(space.log).ToNot(ContainElement("POST /v3/apps"))
+	})
+
+	It("refuses to change an app that doesn't exist", func() {
+		opts.Change = &Change{}
+		delete(space.apps, "app")
+
+		err := change()
+		Expect(err).To(BeAssignableToTypeOf(ErrPreflight{}))
+		Expect(err).To(MatchError("app not found"))
+	})
+})
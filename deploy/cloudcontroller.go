@@ -0,0 +1,498 @@
+package deploy
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoPackage = errors.New("no package was uploaded for the application")
+)
+
+// pollInterval is how long to wait between checks of asynchronous Cloud
+// Controller operations such as staging.
+var pollInterval = 2 * time.Second
+
+// ccErrors matches the error responses of both the v2 and v3 APIs.
+type ccErrors struct {
+	Errors []struct {
+		Detail string `json:"detail"`
+		Title  string `json:"title"`
+	} `json:"errors"`
+
+	ErrorCode   string `json:"error_code"`
+	Description string `json:"description"`
+}
+
+// APIError is returned when the Cloud Controller rejects a request. Code is
+// the error's title, such as CF-ServiceInstanceNameTaken.
+type APIError struct {
+	Method string
+	Path   string
+	Code   string
+	Detail string
+}
+
+func (e APIError) Error() string {
+	return fmt.Sprintf("%s %s failed: %s", e.Method, e.Path, e.Detail)
+}
+
+// curl performs a Cloud Controller request through cf curl and decodes the
+// response into result (which may be nil).
+func (repo *ApplicationRepo) curl(method, path string, body interface{}, result interface{}) error {
+	args := []string{"curl", path, "-X", method}
+
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		args = append(args, "-d", string(encoded))
+	}
+
+	output, err := repo.conn.CliCommandWithoutTerminalOutput(args...)
+	if err != nil {
+		return err
+	}
+
+	jsonResp := strings.Join(output, "")
+	if jsonResp == "" {
+		return nil
+	}
+
+	var apiErrors ccErrors
+	if err := json.Unmarshal([]byte(jsonResp), &apiErrors); err == nil {
+		if len(apiErrors.Errors) > 0 {
+			return APIError{Method: method, Path: path, Code: apiErrors.Errors[0].Title, Detail: apiErrors.Errors[0].Detail}
+		}
+		if apiErrors.ErrorCode != "" {
+			return APIError{Method: method, Path: path, Code: apiErrors.ErrorCode, Detail: apiErrors.Description}
+		}
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal([]byte(jsonResp), result)
+}
+
+type v3Build struct {
+	GUID    string `json:"guid"`
+	State   string `json:"state"`
+	Error   string `json:"error"`
+	Droplet *struct {
+		GUID string `json:"guid"`
+	} `json:"droplet"`
+}
+
+type v3Droplet struct {
+	GUID  string `json:"guid"`
+	State string `json:"state"`
+	Error string `json:"error"`
+}
+
+// StageApplication pushes the application without routes under the name in
+// opts, stages its newest package and makes the result its current droplet.
+// It returns the GUID of that droplet, or the staging error if the build
+// failed.
+func (repo *ApplicationRepo) StageApplication(opts Options) (string, error) {
+	err := repo.push(opts)
+	if err != nil {
+		return "", err
+	}
+
+	app, err := repo.GetAppMetadata(opts.AppName)
+	if err != nil {
+		return "", err
+	}
+
+	return repo.stageLatestPackage(app, opts.ShowLogs, opts.StartupTimeout)
+}
+
+// stagingTimeout is returned when staging or copying the new code does not
+// finish in time.
+func stagingTimeout(what string, timeout time.Duration) error {
+	return ErrStaging{Err: fmt.Errorf("%s did not finish within %s", what, timeout)}
+}
+
+// stageLatestPackage stages the newest package of the app and makes the
+// result its current droplet, returning the droplet's GUID. Staging that
+// takes longer than timeout fails.
+func (repo *ApplicationRepo) stageLatestPackage(app *AppEntity, showLogs bool, timeout time.Duration) (string, error) {
+	if timeout == 0 {
+		timeout = defaultStartupTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	packages := struct {
+		Resources []struct {
+			GUID string `json:"guid"`
+		} `json:"resources"`
+	}{}
+	err := repo.curl("GET", fmt.Sprintf("/v3/apps/%s/packages?order_by=-created_at&per_page=1", app.GUID), nil, &packages)
+	if err != nil {
+		return "", err
+	}
+	if len(packages.Resources) == 0 {
+		return "", ErrNoPackage
+	}
+
+	if showLogs {
+		stop, err := repo.tailLogs(app.GUID, true)
+		if err != nil {
+			return "", err
+		}
+		defer stop()
+	}
+
+	var build v3Build
+	err = repo.curl("POST", "/v3/builds", map[string]interface{}{
+		"package": map[string]string{"guid": packages.Resources[0].GUID},
+	}, &build)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		switch build.State {
+		case "STAGED":
+			if build.Droplet == nil {
+				return "", fmt.Errorf("build %s has no droplet", build.GUID)
+			}
+			return build.Droplet.GUID, repo.setCurrentDroplet(app.GUID, build.Droplet.GUID)
+		case "FAILED":
+			return "", fmt.Errorf("staging failed: %s", build.Error)
+		}
+
+		if time.Now().After(deadline) {
+			return "", stagingTimeout("staging", timeout)
+		}
+		time.Sleep(pollInterval)
+
+		err = repo.curl("GET", "/v3/builds/"+build.GUID, nil, &build)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// PushApplicationWithDroplet pushes the application configuration without
+// staging it, then runs it using a copy of an already staged droplet. It
+// returns once every instance is running.
+func (repo *ApplicationRepo) PushApplicationWithDroplet(opts Options, dropletGUID string) error {
+	pushOpts := opts
+	if opts.dropletGUID() != "" {
+		// there are no files to push with a droplet given up front, so
+		// push an empty droplet for the copy to replace
+		placeholder, err := writeEmptyDroplet()
+		if err != nil {
+			return err
+		}
+		defer os.Remove(placeholder)
+		pushOpts.Droplet = placeholder
+	}
+
+	err := repo.push(pushOpts)
+	if err != nil {
+		return err
+	}
+
+	app, err := repo.GetAppMetadata(opts.AppName)
+	if err != nil {
+		return err
+	}
+
+	_, err = repo.copyDroplet(dropletGUID, app.GUID, opts.StartupTimeout)
+	if err != nil {
+		return stagingError(err)
+	}
+
+	if opts.ShowLogs {
+		stop, err := repo.tailLogs(app.GUID, false)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	err = repo.curl("POST", fmt.Sprintf("/v3/apps/%s/actions/start", app.GUID), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return repo.waitForRunning(app.GUID, opts.StartupTimeout)
+}
+
+// writeEmptyDroplet writes a droplet tarball with nothing in it to a
+// temporary file and returns its path.
+func writeEmptyDroplet() (string, error) {
+	f, err := ioutil.TempFile("", "autopilot-droplet")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	err = tar.NewWriter(gz).Close()
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// copyDroplet copies a droplet to the app and makes the copy its current
+// droplet, returning the copy's GUID. A copy that takes longer than timeout
+// fails.
+func (repo *ApplicationRepo) copyDroplet(dropletGUID, appGUID string, timeout time.Duration) (string, error) {
+	if timeout == 0 {
+		timeout = defaultStartupTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	var droplet v3Droplet
+	err := repo.curl("POST", "/v3/droplets?source_guid="+dropletGUID, map[string]interface{}{
+		"relationships": map[string]interface{}{
+			"app": map[string]interface{}{
+				"data": map[string]string{"guid": appGUID},
+			},
+		},
+	}, &droplet)
+	if err != nil {
+		return "", err
+	}
+
+	for droplet.State != "STAGED" {
+		if droplet.State == "FAILED" || droplet.State == "EXPIRED" {
+			return "", fmt.Errorf("copying droplet failed: %s", droplet.Error)
+		}
+
+		if time.Now().After(deadline) {
+			return "", stagingTimeout("copying the droplet", timeout)
+		}
+		time.Sleep(pollInterval)
+
+		err = repo.curl("GET", "/v3/droplets/"+droplet.GUID, nil, &droplet)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return droplet.GUID, repo.setCurrentDroplet(appGUID, droplet.GUID)
+}
+
+// copyPackage copies a package to the app, returning once the copy is ready
+// to be staged. A copy that takes longer than timeout fails.
+func (repo *ApplicationRepo) copyPackage(packageGUID, appGUID string, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = defaultStartupTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	pkg := struct {
+		GUID  string `json:"guid"`
+		State string `json:"state"`
+	}{}
+	err := repo.curl("POST", "/v3/packages?source_guid="+packageGUID, map[string]interface{}{
+		"relationships": map[string]interface{}{
+			"app": map[string]interface{}{
+				"data": map[string]string{"guid": appGUID},
+			},
+		},
+	}, &pkg)
+	if err != nil {
+		return err
+	}
+
+	for pkg.State != "READY" {
+		if pkg.State == "FAILED" || pkg.State == "EXPIRED" {
+			return fmt.Errorf("copying package failed: package is %s", strings.ToLower(pkg.State))
+		}
+
+		if time.Now().After(deadline) {
+			return stagingTimeout("copying the package", timeout)
+		}
+		time.Sleep(pollInterval)
+
+		err = repo.curl("GET", "/v3/packages/"+pkg.GUID, nil, &pkg)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (repo *ApplicationRepo) setCurrentDroplet(appGUID, dropletGUID string) error {
+	return repo.curl("PATCH", fmt.Sprintf("/v3/apps/%s/relationships/current_droplet", appGUID), map[string]interface{}{
+		"data": map[string]string{"guid": dropletGUID},
+	}, nil)
+}
+
+// RunTask runs command as a task using the current droplet of the application
+// and waits for it to finish. An error is returned if the task fails. A task
+// still running after timeout is cancelled.
+func (repo *ApplicationRepo) RunTask(appName, command string, showLogs bool, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = defaultTaskTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	app, err := repo.GetAppMetadata(appName)
+	if err != nil {
+		return err
+	}
+
+	if showLogs {
+		stop, err := repo.tailLogs(app.GUID, false)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	task := struct {
+		GUID   string `json:"guid"`
+		State  string `json:"state"`
+		Result struct {
+			FailureReason string `json:"failure_reason"`
+		} `json:"result"`
+	}{}
+	err = repo.curl("POST", fmt.Sprintf("/v3/apps/%s/tasks", app.GUID), map[string]string{
+		"command": command,
+	}, &task)
+	if err != nil {
+		return err
+	}
+
+	for {
+		switch task.State {
+		case "SUCCEEDED":
+			return nil
+		case "FAILED":
+			return fmt.Errorf("task %q failed: %s", command, task.Result.FailureReason)
+		}
+
+		if time.Now().After(deadline) {
+			err = repo.curl("POST", fmt.Sprintf("/v3/tasks/%s/actions/cancel", task.GUID), nil, nil)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("task %q did not finish within %s and was cancelled", command, timeout)
+		}
+		time.Sleep(pollInterval)
+
+		err = repo.curl("GET", "/v3/tasks/"+task.GUID, nil, &task)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// instanceStates returns the state of each instance of the app's web process.
+func (repo *ApplicationRepo) instanceStates(appGUID string) ([]string, error) {
+	stats := struct {
+		Resources []struct {
+			State string `json:"state"`
+		} `json:"resources"`
+	}{}
+	err := repo.curl("GET", fmt.Sprintf("/v3/apps/%s/processes/web/stats", appGUID), nil, &stats)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]string, len(stats.Resources))
+	for i, instance := range stats.Resources {
+		states[i] = instance.State
+	}
+	return states, nil
+}
+
+// GetInstanceStats fills in how many instances of a started app are running.
+func (repo *ApplicationRepo) GetInstanceStats(app *AppEntity) error {
+	app.RunningInstances = 0
+
+	if app.State != "STARTED" {
+		return nil
+	}
+
+	states, err := repo.instanceStates(app.GUID)
+	if err != nil {
+		return err
+	}
+
+	for _, state := range states {
+		if state == "RUNNING" {
+			app.RunningInstances++
+		}
+	}
+
+	return nil
+}
+
+// waitForRunning waits for every instance of the app's web process to be
+// running. An app with no instances has not started yet, unless it was
+// scaled to none.
+func (repo *ApplicationRepo) waitForRunning(appGUID string, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = defaultStartupTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		states, err := repo.instanceStates(appGUID)
+		if err != nil {
+			return err
+		}
+
+		running := 0
+		for _, state := range states {
+			switch state {
+			case "RUNNING":
+				running++
+			case "CRASHED":
+				return errors.New("application crashed while starting")
+			}
+		}
+		if running == len(states) {
+			if running > 0 {
+				return nil
+			}
+			scaledToNone, err := repo.scaledToNone(appGUID)
+			if err != nil || scaledToNone {
+				return err
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("application did not start within %s", timeout)
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// scaledToNone returns whether the app's web process has been scaled to no
+// instances.
+func (repo *ApplicationRepo) scaledToNone(appGUID string) (bool, error) {
+	process := struct {
+		Instances int `json:"instances"`
+	}{}
+	err := repo.curl("GET", fmt.Sprintf("/v3/apps/%s/processes/web", appGUID), nil, &process)
+	if err != nil {
+		return false, err
+	}
+	return process.Instances == 0, nil
+}
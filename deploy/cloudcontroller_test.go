@@ -0,0 +1,324 @@
+package deploy_test
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cli/plugin/pluginfakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/contraband/autopilot/deploy"
+)
+
+// fakeCloudController answers cf curl requests made through the fake CLI
+// connection from a map of "METHOD path" to response body. Responses queued
+// for a request are used up, in order, before falling back to the map.
+type fakeCloudController struct {
+	responses map[string]string
+	queued    map[string][]string
+	requests  []string
+}
+
+func (cc *fakeCloudController) queue(request string, responses ...string) {
+	if cc.queued == nil {
+		cc.queued = map[string][]string{}
+	}
+	cc.queued[request] = append(cc.queued[request], responses...)
+}
+
+func (cc *fakeCloudController) curl(args ...string) ([]string, error) {
+	if args[0] != "curl" {
+		return nil, errors.New("unexpected command: " + strings.Join(args, " "))
+	}
+
+	method := "GET"
+	for i, arg := range args {
+		if arg == "-X" && i+1 < len(args) {
+			method = args[i+1]
+		}
+	}
+
+	path := args[1]
+	if strings.HasPrefix(path, "v2/apps?") {
+		path = "v2/apps"
+	}
+
+	request := method + " " + path
+	cc.requests = append(cc.requests, strings.Join(args, " "))
+
+	if queued := cc.queued[request]; len(queued) > 0 {
+		cc.queued[request] = queued[1:]
+		return []string{queued[0]}, nil
+	}
+
+	response, ok := cc.responses[request]
+	if !ok {
+		return nil, errors.New("unexpected request: " + request)
+	}
+	return []string{response}, nil
+}
+
+var _ = Describe("Cloud Controller operations", func() {
+	var (
+		cliConn *pluginfakes.FakeCliConnection
+		repo    *ApplicationRepo
+		cc      *fakeCloudController
+	)
+
+	BeforeEach(func() {
+		cliConn = &pluginfakes.FakeCliConnection{}
+		repo = NewApplicationRepo(cliConn)
+		cc = &fakeCloudController{
+			responses: map[string]string{
+				"GET v2/apps": `{"resources":[{"metadata":{"guid":"app-guid"},"entity":{"state":"STOPPED"}}]}`,
+			},
+		}
+		cliConn.CliCommandWithoutTerminalOutputStub = cc.curl
+	})
+
+	Describe("StageApplication", func() {
+		opts := Options{
+			AppName:      "app-candidate",
+			ManifestPath: "manifest.yml",
+			NoRoute:      true,
+		}
+
+		BeforeEach(func() {
+			cc.responses["GET /v3/apps/app-guid/packages?order_by=-created_at&per_page=1"] = `{"resources":[{"guid":"package-guid"}]}`
+			cc.responses["PATCH /v3/apps/app-guid/relationships/current_droplet"] = `{}`
+		})
+
+		It("pushes without starting and returns the staged droplet", func() {
+			cc.responses["POST /v3/builds"] = `{"guid":"build-guid","state":"STAGED","droplet":{"guid":"droplet-guid"}}`
+
+			dropletGUID, err := repo.StageApplication(opts)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dropletGUID).To(Equal("droplet-guid"))
+
+			Expect(cliConn.CliCommandCallCount()).To(Equal(1))
+			Expect(cliConn.CliCommandArgsForCall(0)).To(Equal([]string{
+				"push", "app-candidate",
+				"-f", "manifest.yml",
+				"--no-start",
+				"--no-route",
+			}))
+			Expect(cc.requests).To(ContainElement(`curl /v3/builds -X POST -d {"package":{"guid":"package-guid"}}`))
+			Expect(cc.requests).To(ContainElement(`curl /v3/apps/app-guid/relationships/current_droplet -X PATCH -d {"data":{"guid":"droplet-guid"}}`))
+		})
+
+		It("sets the endpoint of the http health check after pushing", func() {
+			cc.responses["POST /v3/builds"] = `{"guid":"build-guid","state":"STAGED","droplet":{"guid":"droplet-guid"}}`
+			cc.responses["GET /v3/apps/app-guid/processes/web"] = `{"guid":"process-guid"}`
+			cc.responses["PATCH /v3/processes/process-guid"] = `{}`
+
+			endpointOpts := opts
+			endpointOpts.HealthCheckEndpoint = "/health"
+			_, err := repo.StageApplication(endpointOpts)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(cliConn.CliCommandArgsForCall(0)).ToNot(ContainElement("--endpoint"))
+			Expect(cc.requests).To(ContainElement(`curl /v3/processes/process-guid -X PATCH -d {"health_check":{"data":{"endpoint":"/health"},"type":"http"}}`))
+		})
+
+		It("returns the staging error if the build fails", func() {
+			cc.responses["POST /v3/builds"] = `{"guid":"build-guid","state":"FAILED","error":"NoAppDetectedError"}`
+
+			_, err := repo.StageApplication(opts)
+			Expect(err).To(MatchError("staging failed: NoAppDetectedError"))
+		})
+
+		It("gives up on staging that takes too long", func() {
+			cc.responses["POST /v3/builds"] = `{"guid":"build-guid","state":"STAGING"}`
+
+			timeoutOpts := opts
+			timeoutOpts.StartupTimeout = time.Nanosecond
+			_, err := repo.StageApplication(timeoutOpts)
+			Expect(err).To(BeAssignableToTypeOf(ErrStaging{}))
+			Expect(err).To(MatchError("staging did not finish within 1ns"))
+		})
+
+		It("returns errors from the Cloud Controller", func() {
+			cc.responses["POST /v3/builds"] = `{"errors":[{"detail":"Package is not ready","title":"CF-UnprocessableEntity"}]}`
+
+			_, err := repo.StageApplication(opts)
+			Expect(err).To(MatchError(ContainSubstring("Package is not ready")))
+		})
+
+		It("errors if no package was uploaded", func() {
+			cc.responses["GET /v3/apps/app-guid/packages?order_by=-created_at&per_page=1"] = `{"resources":[]}`
+
+			_, err := repo.StageApplication(opts)
+			Expect(err).To(MatchError(ErrNoPackage))
+		})
+
+		It("returns errors from the push", func() {
+			cliConn.CliCommandReturns([]string{}, errors.New("bad app"))
+
+			_, err := repo.StageApplication(opts)
+			Expect(err).To(MatchError("bad app"))
+		})
+	})
+
+	Describe("PushApplicationWithDroplet", func() {
+		opts := Options{
+			AppName:      "app",
+			ManifestPath: "manifest.yml",
+		}
+
+		BeforeEach(func() {
+			cc.responses["POST /v3/droplets?source_guid=droplet-guid"] = `{"guid":"copied-droplet-guid","state":"STAGED"}`
+			cc.responses["PATCH /v3/apps/app-guid/relationships/current_droplet"] = `{}`
+			cc.responses["POST /v3/apps/app-guid/actions/start"] = `{}`
+			cc.responses["GET /v3/apps/app-guid/processes/web/stats"] = `{"resources":[{"state":"RUNNING"},{"state":"RUNNING"}]}`
+		})
+
+		It("pushes without staging and starts the app with a copy of the droplet", func() {
+			err := repo.PushApplicationWithDroplet(opts, "droplet-guid")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(cliConn.CliCommandCallCount()).To(Equal(1))
+			Expect(cliConn.CliCommandArgsForCall(0)).To(Equal([]string{
+				"push", "app",
+				"-f", "manifest.yml",
+				"--no-start",
+			}))
+			Expect(cc.requests).To(ContainElement(`curl /v3/droplets?source_guid=droplet-guid -X POST -d {"relationships":{"app":{"data":{"guid":"app-guid"}}}}`))
+			Expect(cc.requests).To(ContainElement(`curl /v3/apps/app-guid/relationships/current_droplet -X PATCH -d {"data":{"guid":"copied-droplet-guid"}}`))
+			Expect(cc.requests).To(ContainElement(`curl /v3/apps/app-guid/actions/start -X POST`))
+		})
+
+		It("pushes an empty droplet rather than the app's files for a droplet given by GUID", func() {
+			dropletOpts := opts
+			dropletOpts.Droplet = "8a9b6c2e-1f3d-4e5a-9b7c-0d1e2f3a4b5c"
+			cc.responses["POST /v3/droplets?source_guid="+dropletOpts.Droplet] = `{"guid":"copied-droplet-guid","state":"STAGED"}`
+
+			var placeholder string
+			cliConn.CliCommandStub = func(args ...string) ([]string, error) {
+				placeholder = args[len(args)-1]
+				Expect(placeholder).To(BeAnExistingFile())
+				return nil, nil
+			}
+
+			err := repo.PushApplicationWithDroplet(dropletOpts, dropletOpts.Droplet)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(cliConn.CliCommandArgsForCall(0)).To(Equal([]string{
+				"push", "app",
+				"-f", "manifest.yml",
+				"--no-start",
+				"--droplet", placeholder,
+			}))
+			Expect(placeholder).ToNot(BeAnExistingFile())
+			Expect(cc.requests).To(ContainElement(`curl /v3/apps/app-guid/relationships/current_droplet -X PATCH -d {"data":{"guid":"copied-droplet-guid"}}`))
+		})
+
+		It("fails if an instance crashes", func() {
+			cc.responses["GET /v3/apps/app-guid/processes/web/stats"] = `{"resources":[{"state":"RUNNING"},{"state":"CRASHED"}]}`
+
+			err := repo.PushApplicationWithDroplet(opts, "droplet-guid")
+			Expect(err).To(MatchError("application crashed while starting"))
+		})
+
+		It("fails if the droplet cannot be copied", func() {
+			cc.responses["POST /v3/droplets?source_guid=droplet-guid"] = `{"guid":"copied-droplet-guid","state":"FAILED","error":"out of space"}`
+
+			err := repo.PushApplicationWithDroplet(opts, "droplet-guid")
+			Expect(err).To(MatchError("copying droplet failed: out of space"))
+		})
+
+		It("gives up on a droplet copy that takes too long", func() {
+			cc.responses["POST /v3/droplets?source_guid=droplet-guid"] = `{"guid":"copied-droplet-guid","state":"COPYING"}`
+
+			timeoutOpts := opts
+			timeoutOpts.StartupTimeout = time.Nanosecond
+			err := repo.PushApplicationWithDroplet(timeoutOpts, "droplet-guid")
+			Expect(err).To(BeAssignableToTypeOf(ErrStaging{}))
+			Expect(err).To(MatchError("copying the droplet did not finish within 1ns"))
+		})
+
+		It("does not count an app with no instances yet as started", func() {
+			cc.responses["GET /v3/apps/app-guid/processes/web/stats"] = `{"resources":[]}`
+			cc.responses["GET /v3/apps/app-guid/processes/web"] = `{"instances":2}`
+
+			timeoutOpts := opts
+			timeoutOpts.StartupTimeout = time.Nanosecond
+			err := repo.PushApplicationWithDroplet(timeoutOpts, "droplet-guid")
+			Expect(err).To(MatchError("application did not start within 1ns"))
+		})
+
+		It("counts an app scaled to no instances as started", func() {
+			cc.responses["GET /v3/apps/app-guid/processes/web/stats"] = `{"resources":[]}`
+			cc.responses["GET /v3/apps/app-guid/processes/web"] = `{"instances":0}`
+
+			err := repo.PushApplicationWithDroplet(opts, "droplet-guid")
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("RunTask", func() {
+		It("runs the command as a task and waits for it to succeed", func() {
+			cc.responses["POST /v3/apps/app-guid/tasks"] = `{"guid":"task-guid","state":"SUCCEEDED"}`
+
+			err := repo.RunTask("app", "rake db:migrate", false, 0)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(cc.requests).To(ContainElement(`curl /v3/apps/app-guid/tasks -X POST -d {"command":"rake db:migrate"}`))
+		})
+
+		It("returns the failure reason if the task fails", func() {
+			cc.responses["POST /v3/apps/app-guid/tasks"] = `{"guid":"task-guid","state":"FAILED","result":{"failure_reason":"Exited with status 1"}}`
+
+			err := repo.RunTask("app", "rake db:migrate", false, 0)
+			Expect(err).To(MatchError(`task "rake db:migrate" failed: Exited with status 1`))
+		})
+
+		It("cancels a task that runs for too long", func() {
+			cc.responses["POST /v3/apps/app-guid/tasks"] = `{"guid":"task-guid","state":"RUNNING"}`
+			cc.responses["POST /v3/tasks/task-guid/actions/cancel"] = `{"guid":"task-guid","state":"CANCELING"}`
+
+			err := repo.RunTask("app", "rake db:migrate", false, time.Nanosecond)
+			Expect(err).To(MatchError(`task "rake db:migrate" did not finish within 1ns and was cancelled`))
+			Expect(cc.requests).To(ContainElement(`curl /v3/tasks/task-guid/actions/cancel -X POST`))
+		})
+
+		It("returns errors if the app does not exist", func() {
+			cc.responses["GET v2/apps"] = `{"resources":[]}`
+
+			err := repo.RunTask("app", "rake db:migrate", false, 0)
+			Expect(err).To(MatchError(ErrAppNotFound))
+		})
+	})
+
+	Describe("GetInstanceStats", func() {
+		It("counts the running instances of a started app", func() {
+			cc.responses["GET /v3/apps/app-guid/processes/web/stats"] = `{"resources":[{"state":"RUNNING"},{"state":"CRASHED"},{"state":"RUNNING"}]}`
+
+			app := &AppEntity{GUID: "app-guid", State: "STARTED", Instances: 3}
+			Expect(repo.GetInstanceStats(app)).To(Succeed())
+
+			Expect(app.RunningInstances).To(Equal(2))
+			Expect(app.Healthy()).To(BeTrue())
+		})
+
+		It("treats a started app with nothing running as unhealthy", func() {
+			cc.responses["GET /v3/apps/app-guid/processes/web/stats"] = `{"resources":[{"state":"CRASHED"}]}`
+
+			app := &AppEntity{GUID: "app-guid", State: "STARTED", Instances: 1}
+			Expect(repo.GetInstanceStats(app)).To(Succeed())
+
+			Expect(app.RunningInstances).To(Equal(0))
+			Expect(app.Healthy()).To(BeFalse())
+		})
+
+		It("doesn't ask for the stats of a stopped app", func() {
+			app := &AppEntity{GUID: "app-guid", State: "STOPPED", Instances: 1}
+			Expect(repo.GetInstanceStats(app)).To(Succeed())
+
+			Expect(cc.requests).To(BeEmpty())
+			Expect(app.Healthy()).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,296 @@
+package deploy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigFileName is the name of the config file that is looked for next to
+// the manifest when --config isn't given.
+const ConfigFileName = "autopilot.yml"
+
+// Config is the contents of an autopilot config file. Any setting left out
+// falls back to the environment or the defaults and any setting can be
+// overridden on the command line.
+type Config struct {
+	Strategy         string `yaml:"strategy"`
+	StartupTimeout   string `yaml:"startup_timeout"`
+	TaskTimeout      string `yaml:"task_timeout"`
+	LockTTL          string `yaml:"lock_ttl"`
+	StaleVenerable   string `yaml:"stale_venerable"`
+	UnhealthyCurrent string `yaml:"unhealthy_current"`
+	LostRoutes       string `yaml:"lost_routes"`
+	Report           string `yaml:"report"`
+
+	HealthCheck struct {
+		Type     string `yaml:"type"`
+		Endpoint string `yaml:"endpoint"`
+		Timeout  int    `yaml:"timeout"`
+	} `yaml:"health_check"`
+
+	Hooks struct {
+		PreCutoverTask string `yaml:"pre_cutover_task"`
+		PostDeployTask string `yaml:"post_deploy_task"`
+	} `yaml:"hooks"`
+
+	Naming struct {
+		VenerableSuffix string `yaml:"venerable_suffix"`
+		CandidateSuffix string `yaml:"candidate_suffix"`
+	} `yaml:"naming"`
+
+	Notifications struct {
+		Webhooks      []string `yaml:"webhooks"`
+		SlackWebhooks []string `yaml:"slack_webhooks"`
+	} `yaml:"notifications"`
+
+	Observation struct {
+		Window          string   `yaml:"window"`
+		Max5xxIncrease  *float64 `yaml:"max_5xx_increase"`
+		MaxLatencyRatio *float64 `yaml:"max_latency_ratio"`
+		MinRequests     *int     `yaml:"min_requests"`
+		ErrorPatterns   []string `yaml:"error_patterns"`
+		MaxErrorRatio   *float64 `yaml:"max_error_log_ratio"`
+		MinErrors       *int     `yaml:"min_errors"`
+	} `yaml:"observation"`
+
+	Metrics struct {
+		PrometheusFile string `yaml:"prometheus_file"`
+		StatsD         string `yaml:"statsd"`
+	} `yaml:"metrics"`
+
+	Targets  []Target `yaml:"targets"`
+	Parallel bool     `yaml:"parallel"`
+
+	startupTimeout time.Duration
+	taskTimeout    time.Duration
+	lockTTL        time.Duration
+	observeWindow  time.Duration
+}
+
+// LoadConfig reads the config file at path. Unknown settings are rejected so
+// that typos don't go unnoticed.
+func LoadConfig(path string) (Config, error) {
+	var config Config
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("cannot read config file: %s", err)
+	}
+
+	err = yaml.UnmarshalStrict(raw, &config)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+
+	if config.StartupTimeout != "" {
+		config.startupTimeout, err = time.ParseDuration(config.StartupTimeout)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid config file %s: startup_timeout: %s", path, err)
+		}
+	}
+
+	if config.TaskTimeout != "" {
+		config.taskTimeout, err = time.ParseDuration(config.TaskTimeout)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid config file %s: task_timeout: %s", path, err)
+		}
+	}
+
+	if config.LockTTL != "" {
+		config.lockTTL, err = time.ParseDuration(config.LockTTL)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid config file %s: lock_ttl: %s", path, err)
+		}
+	}
+
+	if config.Observation.Window != "" {
+		config.observeWindow, err = time.ParseDuration(config.Observation.Window)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid config file %s: observation.window: %s", path, err)
+		}
+	}
+
+	if config.HealthCheck.Timeout < 0 {
+		return Config{}, fmt.Errorf("invalid config file %s: health_check.timeout must be a positive number of seconds", path)
+	}
+
+	return config, nil
+}
+
+func (config Config) apply(opts *Options) {
+	setString := func(dest *string, value string) {
+		if value != "" {
+			*dest = value
+		}
+	}
+
+	setString(&opts.Strategy, config.Strategy)
+	setString(&opts.StaleVenerable, config.StaleVenerable)
+	setString(&opts.UnhealthyCurrent, config.UnhealthyCurrent)
+	setString(&opts.LostRoutes, config.LostRoutes)
+	setString(&opts.Report, config.Report)
+	setString(&opts.HealthCheckType, config.HealthCheck.Type)
+	setString(&opts.HealthCheckEndpoint, config.HealthCheck.Endpoint)
+	setString(&opts.PreCutoverTask, config.Hooks.PreCutoverTask)
+	setString(&opts.PostDeployTask, config.Hooks.PostDeployTask)
+	setString(&opts.VenerableSuffix, config.Naming.VenerableSuffix)
+	setString(&opts.CandidateSuffix, config.Naming.CandidateSuffix)
+	setString(&opts.MetricsFile, config.Metrics.PrometheusFile)
+	setString(&opts.StatsDAddress, config.Metrics.StatsD)
+
+	if config.startupTimeout != 0 {
+		opts.StartupTimeout = config.startupTimeout
+	}
+
+	if config.taskTimeout != 0 {
+		opts.TaskTimeout = config.taskTimeout
+	}
+
+	if config.lockTTL != 0 {
+		opts.LockTTL = config.lockTTL
+	}
+
+	if config.observeWindow != 0 {
+		opts.ObserveWindow = config.observeWindow
+	}
+
+	if config.Observation.Max5xxIncrease != nil {
+		opts.RouteThresholds.MaxErrorRateIncrease = *config.Observation.Max5xxIncrease
+	}
+
+	if config.Observation.MaxLatencyRatio != nil {
+		opts.RouteThresholds.MaxLatencyRatio = *config.Observation.MaxLatencyRatio
+	}
+
+	if config.Observation.MinRequests != nil {
+		opts.RouteThresholds.MinRequests = *config.Observation.MinRequests
+	}
+
+	if len(config.Observation.ErrorPatterns) > 0 {
+		opts.LogThresholds.Patterns = config.Observation.ErrorPatterns
+	}
+
+	if config.Observation.MaxErrorRatio != nil {
+		opts.LogThresholds.MaxErrorRatio = *config.Observation.MaxErrorRatio
+	}
+
+	if config.Observation.MinErrors != nil {
+		opts.LogThresholds.MinErrors = *config.Observation.MinErrors
+	}
+
+	if config.HealthCheck.Timeout != 0 {
+		opts.Timeout = fmt.Sprint(config.HealthCheck.Timeout)
+	}
+
+	if len(config.Notifications.Webhooks) > 0 {
+		opts.Webhooks = config.Notifications.Webhooks
+	}
+
+	if len(config.Notifications.SlackWebhooks) > 0 {
+		opts.SlackWebhooks = config.Notifications.SlackWebhooks
+	}
+
+	if len(config.Targets) > 0 {
+		opts.Targets = config.Targets
+	}
+
+	if config.Parallel {
+		opts.Parallel = true
+	}
+}
+
+// findConfig returns the path of the config file to use, if any. An
+// explicitly given path (by flag or AUTOPILOT_CONFIG) must exist whereas the
+// file next to the manifest is optional.
+func findConfig(configPath, manifestPath string) (string, error) {
+	if configPath == "" {
+		configPath = os.Getenv("AUTOPILOT_CONFIG")
+	}
+
+	if configPath != "" {
+		if _, err := os.Stat(configPath); err != nil {
+			return "", fmt.Errorf("cannot read config file: %s", err)
+		}
+		return configPath, nil
+	}
+
+	if manifestPath == "" {
+		return "", nil
+	}
+
+	discovered := filepath.Join(filepath.Dir(manifestPath), ConfigFileName)
+	if _, err := os.Stat(discovered); err != nil {
+		return "", nil
+	}
+
+	return discovered, nil
+}
+
+// applyEnvironment overrides opts with any AUTOPILOT_* environment variables
+// that are set. Lists of webhooks are comma separated.
+func applyEnvironment(opts *Options, getenv func(string) string) error {
+	stringSettings := map[string]*string{
+		"AUTOPILOT_STRATEGY":              &opts.Strategy,
+		"AUTOPILOT_STALE_VENERABLE":       &opts.StaleVenerable,
+		"AUTOPILOT_UNHEALTHY_CURRENT":     &opts.UnhealthyCurrent,
+		"AUTOPILOT_LOST_ROUTES":           &opts.LostRoutes,
+		"AUTOPILOT_REPORT":                &opts.Report,
+		"AUTOPILOT_HEALTH_CHECK_TYPE":     &opts.HealthCheckType,
+		"AUTOPILOT_HEALTH_CHECK_ENDPOINT": &opts.HealthCheckEndpoint,
+		"AUTOPILOT_PRE_CUTOVER_TASK":      &opts.PreCutoverTask,
+		"AUTOPILOT_POST_DEPLOY_TASK":      &opts.PostDeployTask,
+		"AUTOPILOT_VENERABLE_SUFFIX":      &opts.VenerableSuffix,
+		"AUTOPILOT_CANDIDATE_SUFFIX":      &opts.CandidateSuffix,
+		"AUTOPILOT_METRICS_FILE":          &opts.MetricsFile,
+		"AUTOPILOT_STATSD":                &opts.StatsDAddress,
+	}
+	for name, dest := range stringSettings {
+		if value := getenv(name); value != "" {
+			*dest = value
+		}
+	}
+
+	listSettings := map[string]*[]string{
+		"AUTOPILOT_WEBHOOKS":       &opts.Webhooks,
+		"AUTOPILOT_SLACK_WEBHOOKS": &opts.SlackWebhooks,
+	}
+	for name, dest := range listSettings {
+		if value := getenv(name); value != "" {
+			*dest = splitList(value)
+		}
+	}
+
+	durationSettings := map[string]*time.Duration{
+		"AUTOPILOT_STARTUP_TIMEOUT": &opts.StartupTimeout,
+		"AUTOPILOT_TASK_TIMEOUT":    &opts.TaskTimeout,
+		"AUTOPILOT_LOCK_TTL":        &opts.LockTTL,
+		"AUTOPILOT_OBSERVE":         &opts.ObserveWindow,
+	}
+	for name, dest := range durationSettings {
+		if value := getenv(name); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", name, err)
+			}
+			*dest = duration
+		}
+	}
+
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
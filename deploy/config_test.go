@@ -0,0 +1,227 @@
+package deploy_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/contraband/autopilot/deploy"
+)
+
+var _ = Describe("Config", func() {
+	var (
+		dir          string
+		manifestPath string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "autopilot-config")
+		Expect(err).ToNot(HaveOccurred())
+
+		manifestPath = filepath.Join(dir, "manifest.yml")
+		Expect(ioutil.WriteFile(manifestPath, []byte("applications:\n- name: app\n"), 0644)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+		os.Unsetenv("AUTOPILOT_STRATEGY")
+		os.Unsetenv("AUTOPILOT_STARTUP_TIMEOUT")
+		os.Unsetenv("AUTOPILOT_WEBHOOKS")
+	})
+
+	writeConfig := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+		return path
+	}
+
+	It("uses the defaults when there is no config file", func() {
+		opts, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.ConfigPath).To(BeEmpty())
+		Expect(opts.Strategy).To(Equal(StrategyPrestage))
+		Expect(opts.StartupTimeout).To(Equal(5 * time.Minute))
+		Expect(opts.VenerableAppName()).To(Equal("app-venerable"))
+		Expect(opts.CandidateAppName()).To(Equal("app-candidate"))
+		Expect(opts.Report).To(Equal(ReportTable))
+		Expect(opts.LostRoutes).To(Equal(LostRoutesFail))
+	})
+
+	It("reads autopilot.yml from next to the manifest", func() {
+		writeConfig("autopilot.yml", `
+strategy: rename
+startup_timeout: 10m
+task_timeout: 1h
+report: json
+lost_routes: warn
+observation:
+  window: 5m
+  max_5xx_increase: 0
+  min_requests: 100
+  error_patterns:
+  - '^\[ERROR\]'
+  max_error_log_ratio: 3
+metrics:
+  prometheus_file: /var/lib/node_exporter/autopilot.prom
+  statsd: statsd.example.com:8125
+health_check:
+  type: http
+  endpoint: /health
+  timeout: 120
+hooks:
+  post_deploy_task: rake cache:warm
+naming:
+  venerable_suffix: -old
+  candidate_suffix: -new
+notifications:
+  webhooks:
+  - https://example.com/deploys
+  slack_webhooks:
+  - https://hooks.slack.com/services/T/B/X
+`)
+
+		opts, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.ConfigPath).To(Equal(filepath.Join(dir, "autopilot.yml")))
+		Expect(opts.Strategy).To(Equal(StrategyRename))
+		Expect(opts.StartupTimeout).To(Equal(10 * time.Minute))
+		Expect(opts.TaskTimeout).To(Equal(time.Hour))
+		Expect(opts.Report).To(Equal(ReportJSON))
+		Expect(opts.LostRoutes).To(Equal(LostRoutesWarn))
+		Expect(opts.MetricsFile).To(Equal("/var/lib/node_exporter/autopilot.prom"))
+		Expect(opts.StatsDAddress).To(Equal("statsd.example.com:8125"))
+		Expect(opts.ObserveWindow).To(Equal(5 * time.Minute))
+		Expect(opts.RouteThresholds).To(Equal(RouteThresholds{MaxErrorRateIncrease: 0, MaxLatencyRatio: 1.5, MinRequests: 100}))
+		Expect(opts.LogThresholds).To(Equal(LogThresholds{Patterns: []string{`^\[ERROR\]`}, MaxErrorRatio: 3, MinErrors: 5}))
+		Expect(opts.HealthCheckType).To(Equal("http"))
+		Expect(opts.HealthCheckEndpoint).To(Equal("/health"))
+		Expect(opts.Timeout).To(Equal("120"))
+		Expect(opts.PostDeployTask).To(Equal("rake cache:warm"))
+		Expect(opts.VenerableAppName()).To(Equal("app-old"))
+		Expect(opts.CandidateAppName()).To(Equal("app-new"))
+		Expect(opts.Webhooks).To(Equal([]string{"https://example.com/deploys"}))
+		Expect(opts.SlackWebhooks).To(Equal([]string{"https://hooks.slack.com/services/T/B/X"}))
+	})
+
+	It("reads the config file given with --config", func() {
+		configPath := writeConfig("deploy.yml", "strategy: rename\n")
+
+		opts, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath, "--config", configPath})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.ConfigPath).To(Equal(configPath))
+		Expect(opts.Strategy).To(Equal(StrategyRename))
+	})
+
+	It("errors if the config file given with --config is missing", func() {
+		_, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath, "--config", filepath.Join(dir, "missing.yml")})
+		Expect(err).To(MatchError(ContainSubstring("cannot read config file")))
+	})
+
+	It("prefers environment variables to the config file", func() {
+		writeConfig("autopilot.yml", "strategy: rename\nstartup_timeout: 10m\n")
+		os.Setenv("AUTOPILOT_STRATEGY", "prestage")
+		os.Setenv("AUTOPILOT_WEBHOOKS", "https://a.example.com, https://b.example.com")
+
+		opts, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.Strategy).To(Equal(StrategyPrestage))
+		Expect(opts.StartupTimeout).To(Equal(10 * time.Minute))
+		Expect(opts.Webhooks).To(Equal([]string{"https://a.example.com", "https://b.example.com"}))
+	})
+
+	It("prefers flags to environment variables and the config file", func() {
+		writeConfig("autopilot.yml", "startup_timeout: 10m\nnotifications:\n  webhooks:\n  - https://config.example.com\n")
+		os.Setenv("AUTOPILOT_STARTUP_TIMEOUT", "15m")
+		os.Setenv("AUTOPILOT_STRATEGY", "prestage")
+
+		opts, err := ParseArgs([]string{
+			"zero-downtime-push", "app",
+			"-f", manifestPath,
+			"--startup-timeout", "20m",
+			"--strategy", "rename",
+			"--webhook", "https://flag.example.com",
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.StartupTimeout).To(Equal(20 * time.Minute))
+		Expect(opts.Strategy).To(Equal(StrategyRename))
+		Expect(opts.Webhooks).To(Equal([]string{"https://flag.example.com"}))
+	})
+
+	It("reads deploy targets", func() {
+		writeConfig("autopilot.yml", `
+parallel: true
+targets:
+- space: staging
+- org: other-org
+  space: production
+`)
+
+		opts, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.Parallel).To(BeTrue())
+		Expect(opts.DeployTargets()).To(Equal([]Target{
+			{Space: "staging"},
+			{Org: "other-org", Space: "production"},
+		}))
+	})
+
+	It("prefers spaces given as flags to the targets in the config file", func() {
+		writeConfig("autopilot.yml", "targets:\n- space: staging\n")
+
+		opts, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath, "--space", "production"})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.DeployTargets()).To(Equal([]Target{{Space: "production"}}))
+	})
+
+	It("rejects targets without a space", func() {
+		writeConfig("autopilot.yml", "targets:\n- org: other-org\n")
+
+		_, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath})
+		Expect(err).To(MatchError(ContainSubstring("a space is required")))
+	})
+
+	It("rejects unknown settings", func() {
+		writeConfig("autopilot.yml", "stratgey: rename\n")
+
+		_, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath})
+		Expect(err).To(MatchError(ContainSubstring("invalid config file")))
+	})
+
+	It("rejects invalid durations", func() {
+		writeConfig("autopilot.yml", "startup_timeout: forever\n")
+
+		_, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath})
+		Expect(err).To(MatchError(ContainSubstring("startup_timeout")))
+	})
+
+	It("validates the merged settings", func() {
+		writeConfig("autopilot.yml", "strategy: rename\nhooks:\n  pre_cutover_task: rake db:migrate\n")
+
+		_, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath})
+		Expect(err).To(MatchError(ErrPreCutoverTaskNeedsStage))
+	})
+
+	It("rejects unknown strategies", func() {
+		_, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath, "--strategy", "yolo"})
+		Expect(err).To(MatchError(ContainSubstring("invalid strategy")))
+	})
+
+	It("rejects matching venerable and candidate suffixes", func() {
+		writeConfig("autopilot.yml", "naming:\n  venerable_suffix: -old\n  candidate_suffix: -old\n")
+
+		_, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", manifestPath})
+		Expect(err).To(MatchError(ErrSameNamingSuffix))
+	})
+})
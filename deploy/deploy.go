@@ -0,0 +1,266 @@
+// Package deploy performs zero-downtime deploys of Cloud Foundry
+// applications. It is the engine behind the autopilot cf CLI plugin and can be
+// embedded in other tools.
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/cli/plugin"
+	"github.com/contraband/autopilot/notify"
+	"github.com/contraband/autopilot/rewind"
+)
+
+// Event describes the progress of a deploy.
+type Event = notify.Event
+
+// EventType is the kind of an Event.
+type EventType = notify.EventType
+
+const (
+	Started    = notify.Started
+	Succeeded  = notify.Succeeded
+	Failed     = notify.Failed
+	RolledBack = notify.RolledBack
+)
+
+// Deployer performs zero-downtime deploys through a cf CLI connection, such
+// as the one given to a cf CLI plugin or one returned by
+// NewStandaloneConnection.
+type Deployer struct {
+	conn plugin.CliConnection
+
+	// OnEvent, if set, is called as each deploy starts, succeeds, fails or
+	// is rolled back. It is called from several goroutines at once when
+	// deploying to several spaces in parallel.
+	OnEvent func(Event)
+
+	// OnReport, if set, is called with a report on each successful deploy
+	// to a space. Like OnEvent it may be called from several goroutines.
+	OnReport func(Report)
+
+	mu      sync.Mutex
+	metrics []Metrics
+}
+
+func NewDeployer(conn plugin.CliConnection) *Deployer {
+	return &Deployer{conn: conn}
+}
+
+// Deploy replaces the application described by opts with a new version
+// without any downtime. The application is deployed to the targeted space
+// unless opts lists other spaces or foundations.
+func (d *Deployer) Deploy(opts Options) error {
+	d.mu.Lock()
+	d.metrics = nil
+	d.mu.Unlock()
+
+	err := d.deploy(opts)
+	d.exportMetrics(opts)
+	return err
+}
+
+// Metrics returns the metrics of each deploy to a space made by the last
+// call to Deploy.
+func (d *Deployer) Metrics() []Metrics {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Metrics(nil), d.metrics...)
+}
+
+func (d *Deployer) deploy(opts Options) error {
+	opts, err := d.check(opts)
+	if err != nil {
+		event := Event{App: opts.AppName}
+		event.Org, event.Space = targetNames(d.conn)
+		d.emit(opts.Notifier(), event, Failed, err)
+		return err
+	}
+
+	if len(opts.Foundations) > 0 {
+		return d.deployToFoundations(opts)
+	}
+
+	if targets := opts.DeployTargets(); len(targets) > 0 {
+		return d.deployToTargets(opts, targets)
+	}
+
+	return d.deployTo(d.conn, opts)
+}
+
+// check validates the options before anything is deployed, reading the app
+// name from the manifest if it wasn't given.
+func (d *Deployer) check(opts Options) (Options, error) {
+	err := opts.Preflight()
+	if _, ok := err.(ErrValidation); ok {
+		return opts, err
+	} else if err != nil {
+		return opts, ErrPreflight{Err: err}
+	}
+
+	if opts.AppName == "" {
+		opts.AppName, err = ManifestAppName(opts.ManifestPath, opts.Vars, opts.VarsFiles)
+		if _, ok := err.(ErrValidation); ok {
+			return opts, err
+		} else if err != nil {
+			return opts, ErrValidation{Err: err}
+		}
+	}
+
+	if _, ok := d.conn.(*standaloneConnection); ok && (len(opts.Foundations) > 0 || len(opts.DeployTargets()) > 0) {
+		return opts, ErrValidation{Err: ErrStandaloneNeedsCF}
+	}
+
+	return opts, nil
+}
+
+// deployTo performs a zero-downtime push to the space targeted by conn.
+func (d *Deployer) deployTo(conn plugin.CliConnection, opts Options) error {
+	appRepo := NewApplicationRepo(conn)
+
+	notifier := opts.Notifier()
+	event := Event{App: opts.AppName}
+	event.Org, event.Space = targetNames(conn)
+
+	getActions := getActionsForApp
+	if opts.Change != nil {
+		getActions = getActionsForChange
+	}
+	firstPromotion, err := isFirstPromotion(appRepo, opts)
+	if err != nil {
+		d.emit(notifier, event, Failed, err)
+		return err
+	}
+	if firstPromotion {
+		getActions = getActionsForFirstPromotion
+	}
+
+	// taken before anything is looked at so that concurrent deploys can't
+	// fight over the venerable app
+	lock, err := appRepo.AcquireLock(opts.AppName, opts.LockTTL, opts.ForceUnlock)
+	if err != nil {
+		d.emit(notifier, event, Failed, err)
+		return err
+	}
+
+	started := time.Now()
+	d.emit(notifier, event, Started, nil)
+
+	report := Report{App: opts.AppName, Org: event.Org, Space: event.Space}
+	if targetConn, ok := conn.(*targetConnection); ok {
+		report.Foundation = targetConn.foundation
+	}
+	if standaloneConn, ok := conn.(*standaloneConnection); ok {
+		standaloneConn.startupTimeout = opts.StartupTimeout
+	}
+
+	var rollbackErr error
+
+	actions := rewind.Actions{
+		Actions: getActions(appRepo, opts, &report),
+		OnRewind: func(cause error, reverseError error) {
+			if reverseError != nil {
+				rollbackErr = ErrRollbackFailed{AppName: opts.AppName, Err: cause, RollbackErr: reverseError}
+			}
+		},
+	}
+	timings, err := actions.ExecuteTimed()
+	if rollbackErr != nil {
+		err = rollbackErr
+	}
+
+	if unlockErr := appRepo.ReleaseLock(lock); unlockErr != nil {
+		fmt.Fprintln(os.Stderr, "warning: failed to release the deploy lock:", unlockErr)
+	}
+
+	event.Duration = time.Since(started)
+	metrics := newMetrics(report, timings, event.Duration, err)
+	d.record(metrics)
+	if err != nil {
+		// cleaning up a candidate that never took over leaves the space as
+		// it was, so only restoring the old app counts as rolling back
+		if metrics.Rollbacks > 0 && rollbackErr == nil {
+			d.emit(notifier, event, RolledBack, err)
+		}
+		d.emit(notifier, event, Failed, err)
+		return err
+	}
+	d.emit(notifier, event, Succeeded, nil)
+
+	if d.OnReport != nil {
+		report.Steps = stepsFrom(timings)
+		report.Duration = event.Duration
+		// the deploy has succeeded whether or not its status can be found
+		if statusErr := appRepo.fillStatus(&report); statusErr != nil {
+			fmt.Fprintf(os.Stderr, "warning: failed to get the status of %s: %s\n", opts.AppName, statusErr)
+		}
+		d.OnReport(report)
+	}
+
+	return nil
+}
+
+func (d *Deployer) record(metrics Metrics) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.metrics = append(d.metrics, metrics)
+}
+
+// recordRollback counts a rollback of a foundation after its deploy had
+// succeeded.
+func (d *Deployer) recordRollback(foundation string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range d.metrics {
+		if d.metrics[i].Foundation == foundation {
+			d.metrics[i].Rollbacks++
+		}
+	}
+}
+
+// exportMetrics writes the metrics wherever opts asks for them. Like
+// notifications, a failed export is only worth a warning.
+func (d *Deployer) exportMetrics(opts Options) {
+	metrics := d.Metrics()
+	if len(metrics) == 0 {
+		return
+	}
+
+	if opts.MetricsFile != "" {
+		if err := WritePrometheusFile(opts.MetricsFile, metrics, time.Now()); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: failed to write metrics:", err)
+		}
+	}
+
+	if opts.StatsDAddress != "" {
+		if err := SendStatsD(opts.StatsDAddress, metrics); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: failed to send metrics to StatsD:", err)
+		}
+	}
+}
+
+// emit passes an event to OnEvent and any webhooks. A failed notification is
+// only worth a warning as the deploy itself is unaffected.
+func (d *Deployer) emit(notifier notify.Notifier, event Event, eventType EventType, err error) {
+	event.Type = eventType
+	event.Error = err
+
+	if d.OnEvent != nil {
+		d.OnEvent(event)
+	}
+
+	if notifyErr := notifier.Notify(event); notifyErr != nil {
+		fmt.Fprintln(os.Stderr, "warning:", notifyErr)
+	}
+}
+
+// targetNames returns the names of the targeted org and space, or empty
+// strings if they cannot be found.
+func targetNames(conn plugin.CliConnection) (string, string) {
+	org, _ := conn.GetCurrentOrg()
+	space, _ := conn.GetCurrentSpace()
+	return org.Name, space.Name
+}
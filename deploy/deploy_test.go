@@ -0,0 +1,266 @@
+package deploy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/cli/plugin/pluginfakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/contraband/autopilot/rewind"
+)
+
+var _ = Describe("Deployer", func() {
+	var (
+		dir      string
+		space    *fakeSpace
+		deployer *Deployer
+		opts     Options
+		events   []EventType
+		apps     []string
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "autopilot-deployer")
+		Expect(err).ToNot(HaveOccurred())
+
+		manifestPath := filepath.Join(dir, "manifest.yml")
+		Expect(ioutil.WriteFile(manifestPath, []byte("applications:\n- name: app\n"), 0644)).To(Succeed())
+
+		space = &fakeSpace{apps: map[string]string{"app": "STARTED"}, unhealthy: map[string]bool{}}
+
+		cliConn := &pluginfakes.FakeCliConnection{}
+		cliConn.CliCommandStub = space.cliCommand
+		cliConn.CliCommandWithoutTerminalOutputStub = space.curl
+
+		events, apps = nil, nil
+		deployer = NewDeployer(cliConn)
+		deployer.OnEvent = func(event Event) {
+			events = append(events, event.Type)
+			apps = append(apps, event.App)
+		}
+
+		opts = defaultOptions()
+		opts.ManifestPath = manifestPath
+		opts.AppPath = dir
+		opts.Strategy = StrategyRename
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("reads the app name from the manifest and reports a successful deploy", func() {
+		Expect(deployer.Deploy(opts)).To(Succeed())
+
+		Expect(space.commands).To(ContainElement("rename app app-venerable"))
+		Expect(events).To(Equal([]EventType{Started, Succeeded}))
+		Expect(apps).To(Equal([]string{"app", "app"}))
+	})
+
+	It("reports on the deployed app", func() {
+		var reports []Report
+		deployer.OnReport = func(report Report) {
+			reports = append(reports, report)
+		}
+
+		Expect(deployer.Deploy(opts)).To(Succeed())
+
+		Expect(reports).To(HaveLen(1))
+		report := reports[0]
+		Expect(report.App).To(Equal("app"))
+		Expect(report.GUID).To(Equal("app-guid"))
+		Expect(report.Droplet).To(Equal("droplet-guid"))
+		Expect(report.Stack).To(Equal("cflinuxfs3"))
+		Expect(report.Buildpacks).To(Equal([]string{"ruby_buildpack"}))
+		Expect(report.Instances).To(Equal(2))
+		Expect(report.RunningInstances).To(Equal(2))
+		Expect(report.Routes).To(Equal([]string{"app.example.com"}))
+		Expect(report.MemoryMB).To(Equal(256))
+		Expect(report.DiskMB).To(Equal(1024))
+		Expect(report.Replaced).To(Equal("app-guid"))
+		Expect(report.VenerableKept).To(BeFalse())
+
+		var steps []string
+		for _, step := range report.Steps {
+			steps = append(steps, step.Name)
+		}
+		Expect(steps).To(Equal([]string{
+			"find current app", "find venerable app", "stage candidate", "pre-cutover task",
+			"rename current app", "push", "verify routes", "post-deploy task", "observe new version", "delete old apps",
+		}))
+	})
+
+	It("doesn't report on a failed deploy", func() {
+		deployer.OnReport = func(report Report) {
+			Fail("reported on a failed deploy")
+		}
+		space.failPush = true
+
+		Expect(deployer.Deploy(opts)).ToNot(Succeed())
+	})
+
+	It("reports a deploy that was rolled back", func() {
+		space.failPush = true
+
+		Expect(deployer.Deploy(opts)).To(MatchError("push failed"))
+
+		Expect(events).To(Equal([]EventType{Started, RolledBack, Failed}))
+	})
+
+	It("measures each deploy", func() {
+		Expect(deployer.Deploy(opts)).To(Succeed())
+
+		metrics := deployer.Metrics()
+		Expect(metrics).To(HaveLen(1))
+		Expect(metrics[0].App).To(Equal("app"))
+		Expect(metrics[0].Succeeded).To(BeTrue())
+		Expect(metrics[0].Rollbacks).To(Equal(0))
+		Expect(metrics[0].Duration).To(BeNumerically(">=", metrics[0].TimeToHealthy))
+	})
+
+	It("counts rollbacks", func() {
+		space.failPush = true
+
+		Expect(deployer.Deploy(opts)).ToNot(Succeed())
+
+		metrics := deployer.Metrics()
+		Expect(metrics).To(HaveLen(1))
+		Expect(metrics[0].Succeeded).To(BeFalse())
+		Expect(metrics[0].Rollbacks).To(Equal(1))
+	})
+
+	It("writes the metrics to a Prometheus text file", func() {
+		opts.MetricsFile = filepath.Join(dir, "autopilot.prom")
+
+		Expect(deployer.Deploy(opts)).To(Succeed())
+
+		written, err := ioutil.ReadFile(opts.MetricsFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(written)).To(ContainSubstring(`autopilot_deploy_succeeded{app="app",org="",space=""} 1`))
+	})
+
+	It("asks for manual intervention when the rollback fails", func() {
+		space.failPush = true
+		space.failCommand = "rename app-venerable app"
+
+		err := deployer.Deploy(opts)
+		Expect(err).To(BeAssignableToTypeOf(ErrRollbackFailed{}))
+		Expect(err.(ErrRollbackFailed).Err).To(MatchError("push failed"))
+		Expect(err.(ErrRollbackFailed).RollbackErr).To(MatchError("rename failed"))
+		Expect(ExitCode(err)).To(Equal(ExitRollbackFailed))
+
+		Expect(events).To(Equal([]EventType{Started, Failed}))
+	})
+
+	It("doesn't report a rollback when only the new app was cleaned up", func() {
+		opts.PreCutoverTask = "migrate"
+
+		Expect(deployer.Deploy(opts)).ToNot(Succeed())
+
+		Expect(space.apps).To(HaveKeyWithValue("app", "STARTED"))
+		Expect(events).To(Equal([]EventType{Started, Failed}))
+	})
+
+	It("reports a deploy that couldn't take the lock", func() {
+		space.failLock = true
+
+		Expect(deployer.Deploy(opts)).To(MatchError("lock failed"))
+
+		Expect(events).To(Equal([]EventType{Failed}))
+	})
+
+	It("checks the options before deploying", func() {
+		opts.AppName = "app"
+		opts.ManifestPath = filepath.Join(dir, "missing.yml")
+
+		err := deployer.Deploy(opts)
+		Expect(err).To(BeAssignableToTypeOf(ErrPreflight{}))
+
+		Expect(events).To(Equal([]EventType{Failed}))
+		Expect(apps).To(Equal([]string{"app"}))
+		Expect(space.commands).To(BeEmpty())
+	})
+
+	Describe("exit codes", func() {
+		examples := []struct {
+			description string
+			manifest    string
+			args        []string
+			setup       func()
+			code        int
+		}{
+			{"a successful deploy", "applications:\n- name: app\n", []string{"app"}, nil, 0},
+			{"a variable with no value", "applications:\n- name: app\n  memory: ((memory))\n", []string{"app"}, nil, ExitValidation},
+			{"a variable with no value in a manifest that names the app", "applications:\n- name: app\n  memory: ((memory))\n", nil, nil, ExitValidation},
+			{"a malformed variable", "applications:\n- name: app\n", []string{"--var", "memory"}, nil, ExitValidation},
+			{"a missing app path", "applications:\n- name: app\n", []string{"app", "-p", "missing"}, nil, ExitPreflight},
+			{"a staging failure in cf start", "applications:\n- name: app\n", []string{"app"}, func() { space.failStaging = true }, ExitStaging},
+			{"a start failure", "applications:\n- name: app\n", []string{"app"}, func() { space.failCommand = "start app" }, ExitStart},
+		}
+
+		for _, example := range examples {
+			example := example
+
+			It("exits with "+fmt.Sprint(example.code)+" for "+example.description, func() {
+				Expect(ioutil.WriteFile(opts.ManifestPath, []byte(example.manifest), 0644)).To(Succeed())
+				if example.setup != nil {
+					example.setup()
+				}
+
+				args := append([]string{"zero-downtime-push"}, example.args...)
+				args = append(args, "-f", opts.ManifestPath, "--strategy", StrategyRename)
+
+				// as autopilot itself does, bad arguments are validation errors
+				parsed, err := ParseArgs(args)
+				if err != nil {
+					err = ErrValidation{Err: err}
+				} else {
+					err = deployer.Deploy(parsed)
+				}
+				Expect(ExitCode(err)).To(Equal(example.code))
+			})
+		}
+	})
+
+	It("won't deploy a manifest with variables that have no value", func() {
+		Expect(ioutil.WriteFile(opts.ManifestPath, []byte("applications:\n- name: app\n  memory: ((memory))\n"), 0644)).To(Succeed())
+
+		err := deployer.Deploy(opts)
+		Expect(err).To(BeAssignableToTypeOf(ErrValidation{}))
+		Expect(err).To(MatchError("expected to find variables: memory"))
+
+		Expect(space.commands).To(BeEmpty())
+	})
+})
+
+var _ = Describe("newMetrics", func() {
+	var (
+		stage    = rewind.Timing{Name: "stage candidate", Kind: stagingAction}
+		task     = rewind.Timing{Name: "pre-cutover task"}
+		rename   = rewind.Timing{Name: "rename current app", Kind: cutoverAction}
+		push     = rewind.Timing{Name: "push", Kind: startAction}
+		reversed = func(timing rewind.Timing) rewind.Timing {
+			timing.Reverse = true
+			return timing
+		}
+	)
+
+	It("counts a rollback once the current app has been renamed", func() {
+		steps := []rewind.Timing{stage, rename, push, reversed(push)}
+		Expect(newMetrics(Report{}, steps, 0, nil).Rollbacks).To(Equal(1))
+	})
+
+	It("doesn't count cleaning up the candidate as a rollback", func() {
+		steps := []rewind.Timing{stage, task, reversed(task)}
+		Expect(newMetrics(Report{}, steps, 0, nil).Rollbacks).To(Equal(0))
+
+		steps = []rewind.Timing{stage, rename, reversed(rename)}
+		Expect(newMetrics(Report{}, steps, 0, nil).Rollbacks).To(Equal(0))
+	})
+})
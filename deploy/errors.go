@@ -0,0 +1,145 @@
+package deploy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Exit codes for each kind of failure, so that scripts can tell them apart.
+const (
+	ExitFailure        = 1 // anything not covered below, such as an API error
+	ExitValidation     = 2 // the options, config or manifest are invalid
+	ExitPreflight      = 3 // nothing was changed as the deploy could not go ahead
+	ExitStaging        = 4 // the new code failed to stage
+	ExitStart          = 5 // the new app failed to start
+	ExitVerification   = 6 // the new code failed a task, served its routes worse, logged more errors or lost routes
+	ExitRollbackFailed = 7 // manual intervention required
+)
+
+// ErrValidation wraps errors in the options, config file or manifest.
+type ErrValidation struct {
+	Err error
+}
+
+func (e ErrValidation) Error() string {
+	return e.Err.Error()
+}
+
+// ErrPreflight wraps errors that stop a deploy before anything is changed.
+type ErrPreflight struct {
+	Err error
+}
+
+func (e ErrPreflight) Error() string {
+	return e.Err.Error()
+}
+
+// ErrStaging wraps errors pushing or staging the new code.
+type ErrStaging struct {
+	Err error
+}
+
+func (e ErrStaging) Error() string {
+	return e.Err.Error()
+}
+
+// stagingError wraps err in ErrStaging, unless it already is one, such as
+// a staging timeout.
+func stagingError(err error) error {
+	if _, ok := err.(ErrStaging); ok {
+		return err
+	}
+	return ErrStaging{Err: err}
+}
+
+// ErrStart wraps errors pushing or starting the new app in place of the
+// current one.
+type ErrStart struct {
+	Err error
+}
+
+func (e ErrStart) Error() string {
+	return e.Err.Error()
+}
+
+// ErrVerification wraps failed checks of the new code: tasks, route and error
+// log comparisons with the old version, and routes it lost.
+type ErrVerification struct {
+	Err error
+}
+
+func (e ErrVerification) Error() string {
+	return e.Err.Error()
+}
+
+// ErrRollbackFailed is returned when a deploy failed and putting things back
+// the way they were failed too. The app may be left without a running
+// version, so someone needs to take a look.
+type ErrRollbackFailed struct {
+	AppName     string
+	Err         error
+	RollbackErr error
+}
+
+func (e ErrRollbackFailed) Error() string {
+	return fmt.Sprintf("%s; rolling back also failed: %s\nMANUAL INTERVENTION REQUIRED: check the state of %s and its venerable app", e.Err, e.RollbackErr, e.AppName)
+}
+
+// ErrTargetFailed is returned when deploying to one of several spaces or
+// foundations fails.
+type ErrTargetFailed struct {
+	Target string
+	Err    error
+}
+
+func (e ErrTargetFailed) Error() string {
+	return fmt.Sprintf("deploy to %s failed: %s", e.Target, e.Err)
+}
+
+// ErrTargetsFailed is returned when deploying to several spaces at once fails
+// in some of them.
+type ErrTargetsFailed struct {
+	Failures []ErrTargetFailed
+	Total    int
+}
+
+func (e ErrTargetsFailed) Error() string {
+	var failures []string
+	for _, failure := range e.Failures {
+		failures = append(failures, fmt.Sprintf("%s: %s", failure.Target, failure.Err))
+	}
+	return fmt.Sprintf("deploy failed in %d of %d spaces:\n  %s", len(e.Failures), e.Total, strings.Join(failures, "\n  "))
+}
+
+// ExitCode returns the exit code for the kind of error err is. Several failed
+// deploys give the code of the most serious failure.
+func ExitCode(err error) int {
+	switch err := err.(type) {
+	case nil:
+		return 0
+	case ErrValidation:
+		return ExitValidation
+	case ErrPreflight, ErrLocked, ErrStaleVenerable, ErrUnhealthyCurrent:
+		return ExitPreflight
+	case ErrStaging:
+		return ExitStaging
+	case ErrStart:
+		return ExitStart
+	case ErrVerification:
+		return ExitVerification
+	case ErrRollbackFailed:
+		return ExitRollbackFailed
+	case ErrTargetFailed:
+		return ExitCode(err.Err)
+	case ErrTargetsFailed:
+		code := 0
+		for _, failure := range err.Failures {
+			if failureCode := ExitCode(failure.Err); failureCode > code {
+				code = failureCode
+			}
+		}
+		return code
+	default:
+		return ExitFailure
+	}
+}
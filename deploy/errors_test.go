@@ -0,0 +1,60 @@
+package deploy_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/contraband/autopilot/deploy"
+)
+
+var _ = Describe("ExitCode", func() {
+	cause := errors.New("boom")
+
+	codes := []struct {
+		description string
+		err         error
+		code        int
+	}{
+		{"success", nil, 0},
+		{"an unclassified error", cause, ExitFailure},
+		{"a validation error", ErrValidation{Err: cause}, ExitValidation},
+		{"a preflight error", ErrPreflight{Err: cause}, ExitPreflight},
+		{"a held lock", ErrLocked{AppName: "app"}, ExitPreflight},
+		{"a stale venerable app", ErrStaleVenerable{AppName: "app"}, ExitPreflight},
+		{"an unhealthy current app", ErrUnhealthyCurrent{AppName: "app"}, ExitPreflight},
+		{"a staging error", ErrStaging{Err: cause}, ExitStaging},
+		{"a start error", ErrStart{Err: cause}, ExitStart},
+		{"a verification error", ErrVerification{Err: cause}, ExitVerification},
+		{"a failed rollback", ErrRollbackFailed{AppName: "app", Err: cause, RollbackErr: cause}, ExitRollbackFailed},
+		{"a failure in one of several spaces", ErrTargetFailed{Target: "org/space", Err: ErrStaging{Err: cause}}, ExitStaging},
+		{"failures in several spaces", ErrTargetsFailed{Total: 3, Failures: []ErrTargetFailed{
+			{Target: "org/a", Err: ErrStart{Err: cause}},
+			{Target: "org/b", Err: ErrRollbackFailed{Err: cause, RollbackErr: cause}},
+		}}, ExitRollbackFailed},
+	}
+
+	for _, example := range codes {
+		example := example
+
+		It("gives the exit code for "+example.description, func() {
+			Expect(ExitCode(example.err)).To(Equal(example.code))
+		})
+	}
+
+	It("keeps the message of the wrapped error", func() {
+		Expect(ErrStart{Err: cause}).To(MatchError("boom"))
+	})
+
+	It("asks for manual intervention when a rollback fails", func() {
+		err := ErrRollbackFailed{AppName: "app", Err: errors.New("push failed"), RollbackErr: errors.New("rename failed")}
+		Expect(err).To(MatchError(ContainSubstring("push failed; rolling back also failed: rename failed")))
+		Expect(err).To(MatchError(ContainSubstring("MANUAL INTERVENTION REQUIRED")))
+	})
+
+	It("lists each failed space", func() {
+		err := ErrTargetsFailed{Total: 3, Failures: []ErrTargetFailed{{Target: "org/a", Err: cause}}}
+		Expect(err).To(MatchError("deploy failed in 1 of 3 spaces:\n  org/a: boom"))
+	})
+})
@@ -0,0 +1,276 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"code.cloudfoundry.org/cli/plugin"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FoundationsEnvVar can hold the contents of a foundations file, for CI
+// systems that keep credentials in the environment.
+const FoundationsEnvVar = "AUTOPILOT_FOUNDATIONS"
+
+var (
+	ErrFoundationsWithTargets = errors.New("foundations cannot be used with --space or config targets; give the org and space of each foundation instead")
+)
+
+// Foundation is a Cloud Foundry deployment to deploy to, along with the
+// credentials to log in with and the space to deploy to there.
+type Foundation struct {
+	Name              string `yaml:"name"`
+	API               string `yaml:"api"`
+	SkipSSLValidation bool   `yaml:"skip_ssl_validation"`
+
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+
+	Org   string `yaml:"org"`
+	Space string `yaml:"space"`
+}
+
+// FoundationsFile is the contents of a foundations file. Foundations are
+// deployed to in the order they are listed.
+type FoundationsFile struct {
+	Foundations []Foundation `yaml:"foundations"`
+	RollBack    bool         `yaml:"roll_back"`
+}
+
+// ParseFoundations reads a foundations file, checking that every foundation
+// can be logged in to and deployed to.
+func ParseFoundations(raw []byte) (FoundationsFile, error) {
+	var file FoundationsFile
+
+	err := yaml.UnmarshalStrict(raw, &file)
+	if err != nil {
+		return FoundationsFile{}, err
+	}
+
+	if len(file.Foundations) == 0 {
+		return FoundationsFile{}, errors.New("no foundations listed")
+	}
+
+	names := map[string]bool{}
+	for i, foundation := range file.Foundations {
+		if foundation.Name == "" {
+			return FoundationsFile{}, fmt.Errorf("foundation %d has no name", i+1)
+		}
+		if names[foundation.Name] {
+			return FoundationsFile{}, fmt.Errorf("foundation %s is listed more than once", foundation.Name)
+		}
+		names[foundation.Name] = true
+
+		if foundation.API == "" || foundation.Org == "" || foundation.Space == "" {
+			return FoundationsFile{}, fmt.Errorf("foundation %s needs an api, org and space", foundation.Name)
+		}
+
+		userCredentials := foundation.Username != "" && foundation.Password != ""
+		clientCredentials := foundation.ClientID != "" && foundation.ClientSecret != ""
+		if userCredentials == clientCredentials {
+			return FoundationsFile{}, fmt.Errorf("foundation %s needs either a username and password or a client_id and client_secret", foundation.Name)
+		}
+	}
+
+	return file, nil
+}
+
+// loadFoundations reads the foundations given with --foundations or in the
+// AUTOPILOT_FOUNDATIONS environment variable, if any.
+func loadFoundations(opts *Options, getenv func(string) string) error {
+	var (
+		raw    []byte
+		source string
+		err    error
+	)
+
+	if opts.FoundationsPath != "" {
+		raw, err = ioutil.ReadFile(opts.FoundationsPath)
+		if err != nil {
+			return fmt.Errorf("cannot read foundations file: %s", err)
+		}
+		source = opts.FoundationsPath
+	} else if value := getenv(FoundationsEnvVar); value != "" {
+		raw = []byte(value)
+		source = FoundationsEnvVar
+	} else {
+		return nil
+	}
+
+	file, err := ParseFoundations(raw)
+	if err != nil {
+		return fmt.Errorf("invalid foundations in %s: %s", source, err)
+	}
+
+	opts.Foundations = file.Foundations
+	opts.RollBackFoundations = opts.RollBackFoundations || file.RollBack
+
+	return nil
+}
+
+// newFoundationConnection logs in to a foundation with a cf config of its own
+// and targets the foundation's space.
+func newFoundationConnection(conn plugin.CliConnection, cfPath string, foundation Foundation, out io.Writer) (*targetConnection, error) {
+	target, err := newIsolatedConnection(conn, cfPath, out)
+	if err != nil {
+		return nil, err
+	}
+	target.foundation = foundation.Name
+	target.org.Name = foundation.Org
+	target.space.Name = foundation.Space
+
+	apiArgs := []string{"api", foundation.API}
+	if foundation.SkipSSLValidation {
+		apiArgs = append(apiArgs, "--skip-ssl-validation")
+	}
+
+	// the credentials are passed in the environment, which cf reads them
+	// from since 6.40, so that they don't show up in process lists
+	authArgs := []string{"auth"}
+	authEnv := []string{"CF_USERNAME=" + foundation.Username, "CF_PASSWORD=" + foundation.Password}
+	target.username = foundation.Username
+	if foundation.ClientID != "" {
+		authArgs = append(authArgs, "--client-credentials")
+		authEnv = []string{"CF_USERNAME=" + foundation.ClientID, "CF_PASSWORD=" + foundation.ClientSecret}
+		target.username = foundation.ClientID
+	}
+
+	_, err = target.run(ioutil.Discard, nil, apiArgs...)
+	if err == nil {
+		_, err = target.run(ioutil.Discard, authEnv, authArgs...)
+	}
+	if err == nil {
+		_, err = target.run(ioutil.Discard, nil, "target", "-o", foundation.Org, "-s", foundation.Space)
+	}
+	if err == nil {
+		target.org, target.space, err = ResolveTarget(target, Target{Org: foundation.Org, Space: foundation.Space})
+	}
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+
+	return target, nil
+}
+
+// deployToFoundations deploys to each foundation in turn. The first failure
+// stops the deploy before it reaches any later foundations and, if
+// opts.RollBackFoundations is set, the foundations that were already deployed
+// to are rolled back to their venerable apps.
+func (d *Deployer) deployToFoundations(opts Options) error {
+	// the venerable apps have to outlive the deploy to be rolled back to
+	opts.keepVenerable = opts.RollBackFoundations
+
+	var deployed []*targetConnection
+	defer func() {
+		for _, foundationConn := range deployed {
+			foundationConn.Close()
+		}
+	}()
+
+	for _, foundation := range opts.Foundations {
+		fmt.Printf("Deploying %s to foundation %s (%s/%s)...\n", opts.AppName, foundation.Name, foundation.Org, foundation.Space)
+
+		foundationConn, err := newFoundationConnection(d.conn, cfBinary, foundation, os.Stdout)
+		if err != nil {
+			err = ErrPreflight{Err: err}
+		} else {
+			err = d.deployTo(foundationConn, opts)
+			if err != nil {
+				foundationConn.Close()
+			}
+		}
+
+		if err != nil {
+			err = ErrTargetFailed{Target: "foundation " + foundation.Name, Err: err}
+			if opts.RollBackFoundations {
+				err = d.rollBackFoundations(deployed, opts, err)
+			}
+			return err
+		}
+
+		deployed = append(deployed, foundationConn)
+	}
+
+	if opts.keepVenerable {
+		for _, foundationConn := range deployed {
+			err := NewApplicationRepo(foundationConn).deleteVenerable(opts)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: failed to delete %s in foundation %s: %s\n", opts.VenerableAppName(), foundationConn.foundation, err)
+			}
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("A new version of your application has successfully been pushed to %d foundations!\n", len(deployed))
+	fmt.Println()
+
+	return nil
+}
+
+// rollBackFoundations puts the venerable app back in each of the deployed
+// foundations, most recent first. The cause is returned unless a rollback
+// fails.
+func (d *Deployer) rollBackFoundations(deployed []*targetConnection, opts Options, cause error) error {
+	var failed []string
+
+	for i := len(deployed) - 1; i >= 0; i-- {
+		foundationConn := deployed[i]
+		fmt.Printf("Rolling back foundation %s...\n", foundationConn.foundation)
+
+		err := NewApplicationRepo(foundationConn).restoreVenerable(opts)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%s)", foundationConn.foundation, err))
+			continue
+		}
+		d.recordRollback(foundationConn.foundation)
+	}
+
+	if len(failed) > 0 {
+		return ErrRollbackFailed{
+			AppName:     opts.AppName,
+			Err:         cause,
+			RollbackErr: fmt.Errorf("could not roll back foundations %s", strings.Join(failed, ", ")),
+		}
+	}
+
+	fmt.Printf("Rolled back %d foundations.\n", len(deployed))
+	return cause
+}
+
+// deleteVenerable deletes the venerable app, if there is one, once it is no
+// longer needed to roll back to.
+func (repo *ApplicationRepo) deleteVenerable(opts Options) error {
+	_, err := repo.GetAppMetadata(opts.VenerableAppName())
+	if err == ErrAppNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return repo.DeleteApplication(opts.VenerableAppName())
+}
+
+// restoreVenerable replaces the app with its venerable app. An app that was
+// deployed for the first time has nothing to go back to so is left running.
+func (repo *ApplicationRepo) restoreVenerable(opts Options) error {
+	_, err := repo.GetAppMetadata(opts.VenerableAppName())
+	if err == ErrAppNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	err = repo.DeleteApplication(opts.AppName)
+	if err != nil {
+		return err
+	}
+
+	return repo.RenameApplication(opts.VenerableAppName(), opts.AppName)
+}
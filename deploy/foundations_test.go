@@ -0,0 +1,113 @@
+package deploy_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/contraband/autopilot/deploy"
+)
+
+var _ = Describe("Foundations", func() {
+	const foundations = `
+roll_back: true
+foundations:
+- name: east
+  api: https://api.east.example.com
+  username: deployer
+  password: secret
+  org: my-org
+  space: production
+- name: west
+  api: https://api.west.example.com
+  skip_ssl_validation: true
+  client_id: deployer
+  client_secret: secret
+  org: my-org
+  space: production
+`
+
+	It("parses foundations in order", func() {
+		file, err := ParseFoundations([]byte(foundations))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(file.RollBack).To(BeTrue())
+		Expect(file.Foundations).To(HaveLen(2))
+		Expect(file.Foundations[0].Name).To(Equal("east"))
+		Expect(file.Foundations[0].Username).To(Equal("deployer"))
+		Expect(file.Foundations[1].Name).To(Equal("west"))
+		Expect(file.Foundations[1].SkipSSLValidation).To(BeTrue())
+		Expect(file.Foundations[1].ClientID).To(Equal("deployer"))
+	})
+
+	invalid := []struct {
+		description string
+		foundations string
+		message     string
+	}{
+		{"an empty list", "foundations: []\n", "no foundations listed"},
+		{"a foundation without a name", "foundations:\n- api: https://api.example.com\n", "foundation 1 has no name"},
+		{"a duplicate name", "foundations:\n- name: east\n  api: a\n  org: o\n  space: s\n  username: u\n  password: p\n- name: east\n", "listed more than once"},
+		{"a foundation without a space", "foundations:\n- name: east\n  api: a\n  org: o\n  username: u\n  password: p\n", "needs an api, org and space"},
+		{"a foundation without credentials", "foundations:\n- name: east\n  api: a\n  org: o\n  space: s\n", "needs either a username and password or a client_id and client_secret"},
+		{"a foundation with both kinds of credentials", "foundations:\n- name: east\n  api: a\n  org: o\n  space: s\n  username: u\n  password: p\n  client_id: c\n  client_secret: s\n", "needs either"},
+		{"an unknown setting", "foundations:\n- name: east\n  endpoint: a\n", "endpoint"},
+	}
+
+	for _, example := range invalid {
+		example := example
+
+		It("rejects "+example.description, func() {
+			_, err := ParseFoundations([]byte(example.foundations))
+			Expect(err).To(MatchError(ContainSubstring(example.message)))
+		})
+	}
+
+	Describe("ParseArgs", func() {
+		var dir, foundationsPath string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "autopilot-foundations")
+			Expect(err).ToNot(HaveOccurred())
+
+			foundationsPath = filepath.Join(dir, "foundations.yml")
+			Expect(ioutil.WriteFile(foundationsPath, []byte(foundations), 0600)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+			os.Unsetenv(FoundationsEnvVar)
+		})
+
+		It("reads the foundations file given with --foundations", func() {
+			opts, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", "manifest.yml", "--foundations", foundationsPath})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.Foundations).To(HaveLen(2))
+			Expect(opts.RollBackFoundations).To(BeTrue())
+		})
+
+		It("reads the foundations from the environment", func() {
+			os.Setenv(FoundationsEnvVar, foundations)
+
+			opts, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", "manifest.yml"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.Foundations).To(HaveLen(2))
+		})
+
+		It("errors if the foundations file is missing", func() {
+			_, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", "manifest.yml", "--foundations", filepath.Join(dir, "missing.yml")})
+			Expect(err).To(MatchError(ContainSubstring("cannot read foundations file")))
+		})
+
+		It("rejects foundations with spaces", func() {
+			_, err := ParseArgs([]string{"zero-downtime-push", "app", "-f", "manifest.yml", "--foundations", foundationsPath, "--space", "staging"})
+			Expect(err).To(MatchError(ErrFoundationsWithTargets))
+		})
+	})
+})
@@ -0,0 +1,157 @@
+package deploy
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+)
+
+// defaultLockTTL is how long a deploy lock is honoured for if it is never
+// released, e.g. because the deploy was killed.
+const defaultLockTTL = 30 * time.Minute
+
+// Lock is held while an application is being deployed. It is stored as a
+// user-provided service instance in the space as the Cloud Controller
+// guarantees that service instance names are unique within a space, which
+// makes creating one an atomic test-and-set.
+type Lock struct {
+	GUID    string
+	Name    string
+	Owner   string
+	Expires time.Time
+}
+
+type ErrLocked struct {
+	AppName string
+	Owner   string
+	Expires time.Time
+}
+
+func (e ErrLocked) Error() string {
+	return fmt.Sprintf("%s is already being deployed by %s (lock expires %s); use --force-unlock if that deploy is no longer running", e.AppName, e.Owner, e.Expires.Format(time.RFC3339))
+}
+
+func lockName(appName string) string {
+	return fmt.Sprintf("autopilot-lock-%s", appName)
+}
+
+type lockCredentials struct {
+	Owner   string `json:"owner"`
+	Expires string `json:"expires"`
+}
+
+type lockResource struct {
+	Metadata struct {
+		GUID string `json:"guid"`
+	} `json:"metadata"`
+	Entity struct {
+		Credentials lockCredentials `json:"credentials"`
+	} `json:"entity"`
+}
+
+// AcquireLock takes the deploy lock for appName in the targeted space. An
+// existing lock is replaced if it has expired or if force is set, otherwise
+// ErrLocked is returned.
+func (repo *ApplicationRepo) AcquireLock(appName string, ttl time.Duration, force bool) (*Lock, error) {
+	space, err := repo.conn.GetCurrentSpace()
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl == 0 {
+		ttl = defaultLockTTL
+	}
+
+	name := lockName(appName)
+	owner := repo.lockOwner()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		expires := time.Now().Add(ttl).UTC()
+
+		var created lockResource
+		err = repo.curl("POST", "/v2/user_provided_service_instances", map[string]interface{}{
+			"name":       name,
+			"space_guid": space.Guid,
+			"credentials": lockCredentials{
+				Owner:   owner,
+				Expires: expires.Format(time.RFC3339),
+			},
+		}, &created)
+		if err == nil {
+			return &Lock{GUID: created.Metadata.GUID, Name: name, Owner: owner, Expires: expires}, nil
+		}
+
+		if apiErr, ok := err.(APIError); !ok || apiErr.Code != "CF-ServiceInstanceNameTaken" {
+			return nil, err
+		}
+
+		existing, err := repo.findLock(name, space.Guid)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			// released between our create and lookup; try again
+			continue
+		}
+
+		if !force && time.Now().Before(existing.Expires) {
+			return nil, ErrLocked{AppName: appName, Owner: existing.Owner, Expires: existing.Expires}
+		}
+
+		err = repo.ReleaseLock(existing)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("could not acquire the deploy lock for %s", appName)
+}
+
+// ReleaseLock removes a lock so that the application can be deployed again.
+func (repo *ApplicationRepo) ReleaseLock(lock *Lock) error {
+	return repo.curl("DELETE", "/v2/user_provided_service_instances/"+lock.GUID, nil, nil)
+}
+
+func (repo *ApplicationRepo) findLock(name, spaceGUID string) (*Lock, error) {
+	path := fmt.Sprintf("/v2/user_provided_service_instances?q=name:%s&q=space_guid:%s", url.QueryEscape(name), spaceGUID)
+
+	output := struct {
+		Resources []lockResource `json:"resources"`
+	}{}
+	err := repo.curl("GET", path, nil, &output)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(output.Resources) == 0 {
+		return nil, nil
+	}
+
+	resource := output.Resources[0]
+	lock := &Lock{
+		GUID:  resource.Metadata.GUID,
+		Name:  name,
+		Owner: resource.Entity.Credentials.Owner,
+	}
+
+	// a lock that can't be read is treated as expired rather than blocking
+	// deploys forever
+	lock.Expires, _ = time.Parse(time.RFC3339, resource.Entity.Credentials.Expires)
+
+	return lock, nil
+}
+
+func (repo *ApplicationRepo) lockOwner() string {
+	user, err := repo.conn.Username()
+	if err != nil || user == "" {
+		user = "unknown"
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return fmt.Sprintf("%s on %s (pid %d)", user, host, os.Getpid())
+}
@@ -0,0 +1,99 @@
+package deploy_test
+
+import (
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/cli/plugin/pluginfakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/contraband/autopilot/deploy"
+
+	plugin_models "code.cloudfoundry.org/cli/plugin/models"
+)
+
+var _ = Describe("Deploy locking", func() {
+	const (
+		createLock = "POST /v2/user_provided_service_instances"
+		findLock   = "GET /v2/user_provided_service_instances?q=name:autopilot-lock-app&q=space_guid:space-guid"
+		deleteLock = "DELETE /v2/user_provided_service_instances/existing-lock-guid"
+		nameTaken  = `{"code":60002,"description":"The service instance name is taken: autopilot-lock-app","error_code":"CF-ServiceInstanceNameTaken"}`
+		created    = `{"metadata":{"guid":"lock-guid"},"entity":{}}`
+	)
+
+	var (
+		cliConn *pluginfakes.FakeCliConnection
+		repo    *ApplicationRepo
+		cc      *fakeCloudController
+	)
+
+	existingLock := func(expires time.Time) string {
+		return fmt.Sprintf(`{"resources":[{"metadata":{"guid":"existing-lock-guid"},"entity":{"credentials":{"owner":"someone else","expires":"%s"}}}]}`, expires.Format(time.RFC3339))
+	}
+
+	BeforeEach(func() {
+		cliConn = &pluginfakes.FakeCliConnection{}
+		cliConn.GetCurrentSpaceReturns(plugin_models.Space{SpaceFields: plugin_models.SpaceFields{Guid: "space-guid"}}, nil)
+		cliConn.UsernameReturns("deployer", nil)
+		repo = NewApplicationRepo(cliConn)
+		cc = &fakeCloudController{responses: map[string]string{}}
+		cliConn.CliCommandWithoutTerminalOutputStub = cc.curl
+	})
+
+	It("creates a lock in the space with an owner and expiry", func() {
+		cc.responses[createLock] = created
+
+		lock, err := repo.AcquireLock("app", time.Hour, false)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(lock.GUID).To(Equal("lock-guid"))
+		Expect(lock.Name).To(Equal("autopilot-lock-app"))
+		Expect(lock.Owner).To(HavePrefix("deployer on "))
+		Expect(lock.Expires).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+
+		Expect(cc.requests).To(HaveLen(1))
+		Expect(cc.requests[0]).To(ContainSubstring(`"name":"autopilot-lock-app"`))
+		Expect(cc.requests[0]).To(ContainSubstring(`"space_guid":"space-guid"`))
+	})
+
+	It("refuses to deploy while another deploy holds the lock", func() {
+		cc.responses[createLock] = nameTaken
+		cc.responses[findLock] = existingLock(time.Now().Add(10 * time.Minute))
+
+		_, err := repo.AcquireLock("app", time.Hour, false)
+		Expect(err).To(BeAssignableToTypeOf(ErrLocked{}))
+		Expect(err.(ErrLocked).Owner).To(Equal("someone else"))
+		Expect(err).To(MatchError(ContainSubstring("--force-unlock")))
+	})
+
+	It("replaces an expired lock", func() {
+		cc.queue(createLock, nameTaken, created)
+		cc.responses[findLock] = existingLock(time.Now().Add(-time.Minute))
+		cc.responses[deleteLock] = ""
+
+		lock, err := repo.AcquireLock("app", time.Hour, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(lock.GUID).To(Equal("lock-guid"))
+		Expect(cc.requests).To(ContainElement("curl /v2/user_provided_service_instances/existing-lock-guid -X DELETE"))
+	})
+
+	It("replaces a held lock when forced", func() {
+		cc.queue(createLock, nameTaken, created)
+		cc.responses[findLock] = existingLock(time.Now().Add(10 * time.Minute))
+		cc.responses[deleteLock] = ""
+
+		lock, err := repo.AcquireLock("app", time.Hour, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(lock.GUID).To(Equal("lock-guid"))
+	})
+
+	It("releases the lock", func() {
+		cc.responses["DELETE /v2/user_provided_service_instances/lock-guid"] = ""
+
+		err := repo.ReleaseLock(&Lock{GUID: "lock-guid"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cc.requests).To(Equal([]string{"curl /v2/user_provided_service_instances/lock-guid -X DELETE"}))
+	})
+})
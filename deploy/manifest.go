@@ -0,0 +1,249 @@
+package deploy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	ErrMultipleAppsInManifest = errors.New("the manifest contains multiple applications so an app name must be specified")
+)
+
+var manifestVarPattern = regexp.MustCompile(`\(\(([-/\.\w\pL]+)\)\)`)
+
+// ManifestAppName returns the name of the single application described by
+// the manifest at manifestPath once any variables have been interpolated.
+func ManifestAppName(manifestPath string, vars []string, varsFiles []string) (string, error) {
+	interpolated, err := readManifest(manifestPath, vars, varsFiles)
+	if err != nil {
+		return "", err
+	}
+
+	manifest := struct {
+		Applications []struct {
+			Name string `yaml:"name"`
+		} `yaml:"applications"`
+	}{}
+	err = yaml.Unmarshal(interpolated, &manifest)
+	if err != nil {
+		return "", err
+	}
+
+	switch len(manifest.Applications) {
+	case 0:
+		return "", ErrNoArgs
+	case 1:
+		if manifest.Applications[0].Name == "" {
+			return "", ErrNoArgs
+		}
+		return manifest.Applications[0].Name, nil
+	default:
+		return "", ErrMultipleAppsInManifest
+	}
+}
+
+// writeAppManifest writes the application called appName in the manifest at
+// manifestPath to a manifest of its own, renamed to newName, and returns the
+// path of the new manifest. cf push only pushes an application under a name
+// that is not in the manifest if the manifest has just one application.
+// Relative paths still point at the same files.
+func writeAppManifest(manifestPath string, vars []string, varsFiles []string, appName, newName string) (string, error) {
+	interpolated, err := readManifest(manifestPath, vars, varsFiles)
+	if err != nil {
+		return "", err
+	}
+
+	var manifest yaml.MapSlice
+	err = yaml.Unmarshal(interpolated, &manifest)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(manifestPath))
+	if err != nil {
+		return "", err
+	}
+
+	found := false
+	for i, item := range manifest {
+		if item.Key != "applications" {
+			continue
+		}
+		apps, _ := item.Value.([]interface{})
+		for _, a := range apps {
+			app, _ := a.(yaml.MapSlice)
+			if manifestValue(app, "name") != appName {
+				continue
+			}
+			for j, attribute := range app {
+				switch attribute.Key {
+				case "name":
+					app[j].Value = newName
+				case "path":
+					if path, ok := attribute.Value.(string); ok && !filepath.IsAbs(path) {
+						app[j].Value = filepath.Join(dir, path)
+					}
+				}
+			}
+			manifest[i].Value = []interface{}{app}
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("the manifest has no application called %s", appName)
+	}
+
+	raw, err := yaml.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile("", "autopilot-manifest")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = f.Write(raw)
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func manifestValue(attributes yaml.MapSlice, key string) interface{} {
+	for _, attribute := range attributes {
+		if attribute.Key == key {
+			return attribute.Value
+		}
+	}
+	return nil
+}
+
+// manifestAppCount returns how many applications the manifest at
+// manifestPath describes.
+func manifestAppCount(manifestPath string) (int, error) {
+	raw, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return 0, err
+	}
+
+	manifest := struct {
+		Applications []interface{} `yaml:"applications"`
+	}{}
+	err = yaml.Unmarshal(raw, &manifest)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(manifest.Applications), nil
+}
+
+// readManifest reads the manifest at manifestPath and interpolates any
+// variables in it. As with cf push, it is an error for a variable to be left
+// without a value, unless it is only in a comment. Problems with the
+// variables are returned as ErrValidation.
+func readManifest(manifestPath string, vars []string, varsFiles []string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := manifestVars(vars, varsFiles)
+	if err != nil {
+		return nil, ErrValidation{Err: err}
+	}
+
+	var missing []string
+	for _, match := range manifestVarPattern.FindAllSubmatch(withoutComments(raw), -1) {
+		name := string(match[1])
+		if _, ok := values[name]; !ok && !containsString(missing, name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, ErrValidation{Err: fmt.Errorf("expected to find variables: %s", strings.Join(missing, ", "))}
+	}
+
+	interpolated := manifestVarPattern.ReplaceAllFunc(raw, func(match []byte) []byte {
+		if value, ok := values[string(manifestVarPattern.FindSubmatch(match)[1])]; ok {
+			return []byte(value)
+		}
+		return match
+	})
+
+	return interpolated, nil
+}
+
+// withoutComments cuts the YAML comments out of a manifest. A # only starts
+// a comment at the start of a line or after whitespace, and not inside a
+// quoted string.
+func withoutComments(manifest []byte) []byte {
+	lines := bytes.Split(manifest, []byte("\n"))
+	for i, line := range lines {
+		var quote byte
+	scan:
+		for j := 0; j < len(line); j++ {
+			c := line[j]
+			startOfValue := j == 0 || strings.IndexByte(" \t[{,", line[j-1]) >= 0
+			switch {
+			case quote == '"' && c == '\\':
+				j++
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+			case (c == '"' || c == '\'') && startOfValue:
+				quote = c
+			case c == '#' && (j == 0 || line[j-1] == ' ' || line[j-1] == '\t'):
+				lines[i] = line[:j]
+				break scan
+			}
+		}
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// manifestVars collects the variables available for interpolation. As with
+// cf push, values given with --var take precedence over vars files.
+func manifestVars(vars []string, varsFiles []string) (map[string]string, error) {
+	values := map[string]string{}
+
+	for _, varsFile := range varsFiles {
+		raw, err := ioutil.ReadFile(varsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		fileValues := map[string]interface{}{}
+		err = yaml.Unmarshal(raw, &fileValues)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, value := range fileValues {
+			values[name] = fmt.Sprint(value)
+		}
+	}
+
+	for _, varPair := range vars {
+		parts := strings.SplitN(varPair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid variable %q: expected name=value", varPair)
+		}
+		values[parts[0]] = parts[1]
+	}
+
+	return values, nil
+}
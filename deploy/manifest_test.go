@@ -0,0 +1,88 @@
+package deploy_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/contraband/autopilot/deploy"
+)
+
+var _ = Describe("ManifestAppName", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "autopilot-manifest")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeFile := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+		return path
+	}
+
+	It("returns the name of the only application", func() {
+		manifestPath := writeFile("manifest.yml", "applications:\n- name: my-app\n")
+
+		appName, err := ManifestAppName(manifestPath, nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(appName).To(Equal("my-app"))
+	})
+
+	It("interpolates variables and vars files into the name", func() {
+		manifestPath := writeFile("manifest.yml", "applications:\n- name: ((prefix))-app-((env))\n")
+		varsFile := writeFile("vars.yml", "prefix: my\nenv: staging\n")
+
+		appName, err := ManifestAppName(manifestPath, []string{"env=prod"}, []string{varsFile})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(appName).To(Equal("my-app-prod"))
+	})
+
+	It("errors if the manifest contains multiple applications", func() {
+		manifestPath := writeFile("manifest.yml", "applications:\n- name: one\n- name: two\n")
+
+		_, err := ManifestAppName(manifestPath, nil, nil)
+		Expect(err).To(MatchError(ErrMultipleAppsInManifest))
+	})
+
+	It("errors if the manifest does not name an application", func() {
+		manifestPath := writeFile("manifest.yml", "applications:\n- memory: 1G\n")
+
+		_, err := ManifestAppName(manifestPath, nil, nil)
+		Expect(err).To(MatchError(ErrNoArgs))
+	})
+
+	It("errors if a variable has no value", func() {
+		manifestPath := writeFile("manifest.yml", "applications:\n- name: ((prefix))-app-((env))\n  memory: ((memory))\n")
+
+		_, err := ManifestAppName(manifestPath, []string{"prefix=my"}, nil)
+		Expect(err).To(MatchError("expected to find variables: env, memory"))
+	})
+
+	It("ignores variables that are only in comments", func() {
+		manifestPath := writeFile("manifest.yml", "applications:\n# - name: ((old-name))\n- name: my-app # was ((old-name))\n  env:\n    GREETING: \"hi # ((greeting))\"\n")
+
+		_, err := ManifestAppName(manifestPath, nil, nil)
+		Expect(err).To(MatchError("expected to find variables: greeting"))
+
+		appName, err := ManifestAppName(manifestPath, []string{"greeting=hello"}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(appName).To(Equal("my-app"))
+	})
+
+	It("errors if a variable is malformed", func() {
+		manifestPath := writeFile("manifest.yml", "applications:\n- name: my-app\n")
+
+		_, err := ManifestAppName(manifestPath, []string{"nope"}, nil)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,227 @@
+package deploy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/contraband/autopilot/rewind"
+)
+
+// Metrics measures a deploy to a single space.
+type Metrics struct {
+	App        string
+	Foundation string
+	Org        string
+	Space      string
+
+	Succeeded bool
+	Duration  time.Duration
+
+	// Staging is how long the candidate app took to stage. Deploys with
+	// the rename strategy stage as part of starting the new app instead.
+	Staging time.Duration
+
+	// TimeToHealthy is how long the new app took to go from being pushed
+	// to having all of its instances running.
+	TimeToHealthy time.Duration
+
+	// Rollbacks counts the times the space was rolled back to the
+	// venerable app.
+	Rollbacks int
+}
+
+// Target describes where the app was deployed to.
+func (metrics Metrics) Target() string {
+	return Report{Foundation: metrics.Foundation, Org: metrics.Org, Space: metrics.Space}.Target()
+}
+
+// The kinds of action that newMetrics measures.
+const (
+	stagingAction = "staging"
+	startAction   = "start"
+	cutoverAction = "cutover"
+)
+
+// newMetrics measures a deploy from the timings of its actions.
+func newMetrics(report Report, timings []rewind.Timing, duration time.Duration, err error) Metrics {
+	metrics := Metrics{
+		App:        report.App,
+		Foundation: report.Foundation,
+		Org:        report.Org,
+		Space:      report.Space,
+		Succeeded:  err == nil,
+		Duration:   duration,
+	}
+
+	// undoing the steps before the current app is renamed only cleans up the
+	// candidate, so it isn't counted as a rollback
+	renamed := false
+	for _, timing := range timings {
+		switch {
+		case timing.Reverse:
+			if renamed && timing.Kind != cutoverAction {
+				metrics.Rollbacks++
+			}
+		case timing.Kind == cutoverAction:
+			renamed = true
+		case timing.Kind == stagingAction:
+			metrics.Staging = timing.Duration()
+		case timing.Kind == startAction:
+			metrics.TimeToHealthy = timing.Duration()
+		}
+	}
+
+	return metrics
+}
+
+// stepsFrom returns how long each action that was run forward took.
+func stepsFrom(timings []rewind.Timing) []Step {
+	var steps []Step
+	for _, timing := range timings {
+		if !timing.Reverse {
+			steps = append(steps, Step{Name: timing.Name, Duration: timing.Duration()})
+		}
+	}
+	return steps
+}
+
+// WriteMetrics writes a table of the metrics of each deploy to w.
+func WriteMetrics(w io.Writer, metrics []Metrics) error {
+	table := tabwriter.NewWriter(w, 0, 4, 3, ' ', 0)
+	fmt.Fprintln(table, "space\tresult\ttotal\tstaging\ttime to healthy\trollbacks")
+	for _, m := range metrics {
+		result := "succeeded"
+		if !m.Succeeded {
+			result = "failed"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%d\n", m.Target(), result, roundDuration(m.Duration), roundDuration(m.Staging), roundDuration(m.TimeToHealthy), m.Rollbacks)
+	}
+	return table.Flush()
+}
+
+// prometheusMetrics are the gauges written to a Prometheus text file.
+var prometheusMetrics = []struct {
+	name  string
+	help  string
+	value func(Metrics) float64
+}{
+	{"autopilot_deploy_duration_seconds", "How long the last deploy took.", func(m Metrics) float64 { return m.Duration.Seconds() }},
+	{"autopilot_deploy_staging_seconds", "How long the new code took to stage.", func(m Metrics) float64 { return m.Staging.Seconds() }},
+	{"autopilot_deploy_time_to_healthy_seconds", "How long the new app took to have all of its instances running.", func(m Metrics) float64 { return m.TimeToHealthy.Seconds() }},
+	{"autopilot_deploy_rollbacks", "How many times the last deploy was rolled back.", func(m Metrics) float64 { return float64(m.Rollbacks) }},
+	{"autopilot_deploy_succeeded", "Whether the last deploy succeeded.", func(m Metrics) float64 {
+		if m.Succeeded {
+			return 1
+		}
+		return 0
+	}},
+}
+
+// WritePrometheusFile writes the metrics to path in the Prometheus text
+// format, e.g. for the node exporter's textfile collector. The file is
+// replaced in one go so that it is never read half written.
+func WritePrometheusFile(path string, metrics []Metrics, now time.Time) error {
+	var out strings.Builder
+	for _, gauge := range prometheusMetrics {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+		for _, m := range metrics {
+			fmt.Fprintf(&out, "%s{%s} %g\n", gauge.name, prometheusLabels(m), gauge.value(m))
+		}
+	}
+	fmt.Fprintf(&out, "# HELP autopilot_deploy_timestamp_seconds When the last deploy finished.\n# TYPE autopilot_deploy_timestamp_seconds gauge\n")
+	for _, m := range metrics {
+		fmt.Fprintf(&out, "autopilot_deploy_timestamp_seconds{%s} %d\n", prometheusLabels(m), now.Unix())
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(out.String())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func prometheusLabels(m Metrics) string {
+	labels := []string{
+		prometheusLabel("app", m.App),
+		prometheusLabel("org", m.Org),
+		prometheusLabel("space", m.Space),
+	}
+	if m.Foundation != "" {
+		labels = append(labels, prometheusLabel("foundation", m.Foundation))
+	}
+	return strings.Join(labels, ",")
+}
+
+// prometheusEscaper escapes label values as the text format expects, which
+// unlike Go quoting leaves everything but these three characters alone.
+var prometheusEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func prometheusLabel(name, value string) string {
+	return fmt.Sprintf(`%s="%s"`, name, prometheusEscaper.Replace(value))
+}
+
+var statsdUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// SendStatsD sends the metrics to the StatsD server at address over UDP,
+// as timers and counters named autopilot.<org>.<space>.<app>.*.
+func SendStatsD(address string, metrics []Metrics) error {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, m := range metrics {
+		prefix := "autopilot."
+		if m.Foundation != "" {
+			prefix += statsdUnsafe.ReplaceAllString(m.Foundation, "_") + "."
+		}
+		for _, part := range []string{m.Org, m.Space, m.App} {
+			prefix += statsdUnsafe.ReplaceAllString(part, "_") + "."
+		}
+
+		result := "succeeded"
+		if !m.Succeeded {
+			result = "failed"
+		}
+
+		lines := []string{
+			fmt.Sprintf("%sduration:%d|ms", prefix, m.Duration.Milliseconds()),
+			fmt.Sprintf("%sstaging:%d|ms", prefix, m.Staging.Milliseconds()),
+			fmt.Sprintf("%stime_to_healthy:%d|ms", prefix, m.TimeToHealthy.Milliseconds()),
+			fmt.Sprintf("%srollbacks:%d|c", prefix, m.Rollbacks),
+			fmt.Sprintf("%s%s:1|c", prefix, result),
+		}
+
+		// one packet per deploy keeps each well under the usual MTU
+		_, err = conn.Write([]byte(strings.Join(lines, "\n")))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package deploy_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/contraband/autopilot/deploy"
+)
+
+var _ = Describe("Metrics", func() {
+	metrics := []Metrics{
+		{
+			App:           "app",
+			Org:           "org",
+			Space:         "space",
+			Succeeded:     true,
+			Duration:      62 * time.Second,
+			Staging:       40 * time.Second,
+			TimeToHealthy: 15 * time.Second,
+		},
+		{
+			App:        "app",
+			Foundation: "eu",
+			Org:        "org",
+			Space:      "space",
+			Duration:   1500 * time.Millisecond,
+			Rollbacks:  1,
+		},
+	}
+
+	It("writes a table", func() {
+		var out bytes.Buffer
+		Expect(WriteMetrics(&out, metrics)).To(Succeed())
+
+		Expect(out.String()).To(Equal(`space            result      total   staging   time to healthy   rollbacks
+org/space        succeeded   1m2s    40s       15s               0
+eu (org/space)   failed      1.5s    0s        0s                1
+`))
+	})
+
+	It("writes a Prometheus text file", func() {
+		dir, err := ioutil.TempDir("", "autopilot-metrics")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "autopilot.prom")
+		Expect(WritePrometheusFile(path, metrics, time.Unix(1500000000, 0))).To(Succeed())
+
+		written, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(written)).To(ContainSubstring("# TYPE autopilot_deploy_duration_seconds gauge\n"))
+		Expect(string(written)).To(ContainSubstring(`autopilot_deploy_duration_seconds{app="app",org="org",space="space"} 62` + "\n"))
+		Expect(string(written)).To(ContainSubstring(`autopilot_deploy_staging_seconds{app="app",org="org",space="space"} 40` + "\n"))
+		Expect(string(written)).To(ContainSubstring(`autopilot_deploy_time_to_healthy_seconds{app="app",org="org",space="space"} 15` + "\n"))
+		Expect(string(written)).To(ContainSubstring(`autopilot_deploy_rollbacks{app="app",org="org",space="space",foundation="eu"} 1` + "\n"))
+		Expect(string(written)).To(ContainSubstring(`autopilot_deploy_succeeded{app="app",org="org",space="space",foundation="eu"} 0` + "\n"))
+		Expect(string(written)).To(ContainSubstring(`autopilot_deploy_timestamp_seconds{app="app",org="org",space="space"} 1500000000` + "\n"))
+
+		files, err := ioutil.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+	})
+
+	It("escapes label values the way Prometheus expects", func() {
+		dir, err := ioutil.TempDir("", "autopilot-metrics")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "autopilot.prom")
+		odd := []Metrics{{App: "app", Org: `a\b "c"`, Space: "ünï\ncode"}}
+		Expect(WritePrometheusFile(path, odd, time.Unix(1500000000, 0))).To(Succeed())
+
+		written, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(written)).To(ContainSubstring(`autopilot_deploy_succeeded{app="app",org="a\\b \"c\"",space="ünï\ncode"} 0` + "\n"))
+	})
+
+	It("sends metrics to StatsD", func() {
+		server, err := net.ListenPacket("udp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer server.Close()
+
+		Expect(SendStatsD(server.LocalAddr().String(), metrics[:1])).To(Succeed())
+
+		buf := make([]byte, 1024)
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := server.ReadFrom(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.Split(string(buf[:n]), "\n")).To(Equal([]string{
+			"autopilot.org.space.app.duration:62000|ms",
+			"autopilot.org.space.app.staging:40000|ms",
+			"autopilot.org.space.app.time_to_healthy:15000|ms",
+			"autopilot.org.space.app.rollbacks:0|c",
+			"autopilot.org.space.app.succeeded:1|c",
+		}))
+	})
+})
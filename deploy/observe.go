@@ -0,0 +1,327 @@
+package deploy
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/noaa/consumer"
+	"github.com/cloudfoundry/sonde-go/events"
+)
+
+// ErrRouteRegression is returned when the new version of an app serves its
+// routes worse than the old one did over the same observation window.
+type ErrRouteRegression struct {
+	AppName   string
+	Reason    string
+	Baseline  RouteStats
+	Candidate RouteStats
+}
+
+func (e ErrRouteRegression) Error() string {
+	return fmt.Sprintf("the new version of %s %s (%d requests against %d to the old version)", e.AppName, e.Reason, e.Candidate.Requests, e.Baseline.Requests)
+}
+
+// ErrLogRegression is returned when the new version of an app logs
+// significantly more errors than the old one did over the same observation
+// window.
+type ErrLogRegression struct {
+	AppName   string
+	Baseline  LogStats
+	Candidate LogStats
+}
+
+func (e ErrLogRegression) Error() string {
+	return fmt.Sprintf("the new version of %s logged %d errors in %d lines against %d in %d from the old version", e.AppName, e.Candidate.Errors, e.Candidate.Lines, e.Baseline.Errors, e.Baseline.Lines)
+}
+
+// LogStats counts the lines an app logged and how many of them were errors.
+type LogStats struct {
+	Lines  int
+	Errors int
+}
+
+// ErrorRate returns the fraction of lines that were errors.
+func (stats LogStats) ErrorRate() float64 {
+	if stats.Lines == 0 {
+		return 0
+	}
+	return float64(stats.Errors) / float64(stats.Lines)
+}
+
+// LogThresholds are how many more errors than the old version the new version
+// of an app may log before it is rolled back.
+type LogThresholds struct {
+	// Patterns are the regular expressions that pick out errors from the
+	// app's logs.
+	Patterns []string
+	// MaxErrorRatio is how many times the old version's fraction of error
+	// lines the new version's may be.
+	MaxErrorRatio float64
+	// MinErrors is how many errors the new version must log before it can
+	// be judged to be logging too many.
+	MinErrors int
+}
+
+// Compare checks candidate against baseline.
+func (thresholds LogThresholds) Compare(appName string, baseline, candidate LogStats) error {
+	if candidate.Errors < thresholds.MinErrors {
+		return nil
+	}
+
+	if candidate.ErrorRate() > baseline.ErrorRate()*thresholds.MaxErrorRatio {
+		return ErrLogRegression{AppName: appName, Baseline: baseline, Candidate: candidate}
+	}
+
+	return nil
+}
+
+// compile returns the error patterns as a single regular expression.
+func (thresholds LogThresholds) compile() (*regexp.Regexp, error) {
+	if len(thresholds.Patterns) == 0 {
+		return nil, nil
+	}
+	return regexp.Compile("(?:" + strings.Join(thresholds.Patterns, ")|(?:") + ")")
+}
+
+// RouteStats summarises the requests served by an app according to the
+// router's access logs.
+type RouteStats struct {
+	Requests     int
+	ServerErrors int
+
+	latencies []time.Duration
+}
+
+// ErrorRate returns the fraction of requests that got a 5xx response.
+func (stats RouteStats) ErrorRate() float64 {
+	if stats.Requests == 0 {
+		return 0
+	}
+	return float64(stats.ServerErrors) / float64(stats.Requests)
+}
+
+// Latency returns the 95th percentile response time.
+func (stats RouteStats) Latency() time.Duration {
+	if len(stats.latencies) == 0 {
+		return 0
+	}
+	latencies := append([]time.Duration(nil), stats.latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[(len(latencies)*95-1)/100]
+}
+
+func (stats *RouteStats) add(status int, latency time.Duration) {
+	stats.Requests++
+	if status >= 500 {
+		stats.ServerErrors++
+	}
+	if latency > 0 {
+		stats.latencies = append(stats.latencies, latency)
+	}
+}
+
+// RouteThresholds are how much worse than the old version the new version of
+// an app may serve its routes before it is rolled back.
+type RouteThresholds struct {
+	// MaxErrorRateIncrease is how far the fraction of 5xx responses may
+	// rise, e.g. 0.01 for one percentage point.
+	MaxErrorRateIncrease float64
+	// MaxLatencyRatio is how many times the old 95th percentile response
+	// time the new one may be.
+	MaxLatencyRatio float64
+	// MinRequests is how many requests each version must serve for them
+	// to be compared at all.
+	MinRequests int
+}
+
+// Compare checks candidate against baseline. Too few requests to go on is not
+// a regression.
+func (thresholds RouteThresholds) Compare(appName string, baseline, candidate RouteStats) error {
+	if baseline.Requests < thresholds.MinRequests || candidate.Requests < thresholds.MinRequests {
+		return nil
+	}
+
+	if candidate.ErrorRate() > baseline.ErrorRate()+thresholds.MaxErrorRateIncrease {
+		return ErrRouteRegression{
+			AppName:   appName,
+			Reason:    fmt.Sprintf("served %.1f%% 5xx responses against %.1f%% from the old version", candidate.ErrorRate()*100, baseline.ErrorRate()*100),
+			Baseline:  baseline,
+			Candidate: candidate,
+		}
+	}
+
+	if baseline.Latency() > 0 && float64(candidate.Latency()) > float64(baseline.Latency())*thresholds.MaxLatencyRatio {
+		return ErrRouteRegression{
+			AppName:   appName,
+			Reason:    fmt.Sprintf("had a 95th percentile response time of %s against %s for the old version", roundDuration(candidate.Latency()), roundDuration(baseline.Latency())),
+			Baseline:  baseline,
+			Candidate: candidate,
+		}
+	}
+
+	return nil
+}
+
+var (
+	rtrStatusPattern  = regexp.MustCompile(`^\S+ - \[[^\]]*\] "[^"]*" (\d{3}) `)
+	rtrLatencyPattern = regexp.MustCompile(`\bresponse_time:([0-9.]+)`)
+)
+
+// parseAccessLog reads the response status and time from a router access log
+// line.
+func parseAccessLog(line string) (int, time.Duration, bool) {
+	match := rtrStatusPattern.FindStringSubmatch(line)
+	if match == nil {
+		return 0, 0, false
+	}
+	status, _ := strconv.Atoi(match[1])
+
+	var latency time.Duration
+	if match := rtrLatencyPattern.FindStringSubmatch(line); match != nil {
+		seconds, err := strconv.ParseFloat(match[1], 64)
+		if err == nil {
+			latency = time.Duration(seconds * float64(time.Second))
+		}
+	}
+
+	return status, latency, true
+}
+
+// observation is what was seen of one version of an app.
+type observation struct {
+	routes RouteStats
+	logs   LogStats
+}
+
+// observe adds up the access logs and the app's own logs among messages until
+// done or messages is closed. Lines of the app's logs that match errorPattern are
+// counted as errors.
+func observe(messages <-chan *events.LogMessage, errorPattern *regexp.Regexp, done <-chan struct{}) observation {
+	var seen observation
+	for {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				return seen
+			}
+			switch {
+			case m.GetSourceType() == "RTR":
+				if status, latency, ok := parseAccessLog(string(m.GetMessage())); ok {
+					seen.routes.add(status, latency)
+				}
+			case strings.HasPrefix(m.GetSourceType(), "APP"):
+				seen.logs.Lines++
+				if errorPattern != nil && errorPattern.Match(m.GetMessage()) {
+					seen.logs.Errors++
+				}
+			}
+		case <-done:
+			return seen
+		}
+	}
+}
+
+// appLogs tails the logs of an app. It is a variable so that tests can
+// replace it.
+var appLogs = func(repo *ApplicationRepo, appGUID string) (<-chan *events.LogMessage, func(), error) {
+	dopplerEndpoint, err := repo.conn.DopplerEndpoint()
+	if err != nil {
+		return nil, nil, err
+	}
+	token, err := repo.conn.AccessToken()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cons := consumer.New(dopplerEndpoint, nil, nil)
+	messages, errors := cons.TailingLogs(appGUID, token)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case e, ok := <-errors:
+				if !ok {
+					return
+				}
+				log.Println("error reading logs:", e)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return messages, func() {
+		close(done)
+		cons.Close()
+	}, nil
+}
+
+// Observe compares the old and new versions of an app while both of them are
+// receiving traffic: how they serve their routes and how many errors they
+// log. The observation ends after window, or earlier if the logs of both
+// versions stop.
+func (repo *ApplicationRepo) Observe(appName, oldGUID, newGUID string, window time.Duration, routeThresholds RouteThresholds, logThresholds LogThresholds) error {
+	errorPattern, err := logThresholds.compile()
+	if err != nil {
+		return err
+	}
+
+	guids := []string{oldGUID, newGUID}
+	seen := make([]observation, len(guids))
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i, guid := range guids {
+		messages, stop, err := appLogs(repo, guid)
+		if err != nil {
+			close(done)
+			wg.Wait()
+			return err
+		}
+		defer stop()
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			seen[i] = observe(messages, errorPattern, done)
+		}(i)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	out := repo.output()
+	fmt.Fprintf(out, "Watching the old and new versions of %s for %s...\n", appName, window)
+	timer := time.NewTimer(window)
+	select {
+	case <-timer.C:
+	case <-finished:
+		timer.Stop()
+	}
+	close(done)
+	<-finished
+
+	baseline, candidate := seen[0], seen[1]
+	fmt.Fprintf(out, "%s served %d requests (%.1f%% 5xx) and logged %d errors; the old version served %d (%.1f%% 5xx) and logged %d errors\n",
+		appName, candidate.routes.Requests, candidate.routes.ErrorRate()*100, candidate.logs.Errors, baseline.routes.Requests, baseline.routes.ErrorRate()*100, baseline.logs.Errors)
+	if baseline.routes.Requests < routeThresholds.MinRequests || candidate.routes.Requests < routeThresholds.MinRequests {
+		fmt.Fprintf(out, "Too few requests to compare how the versions of %s serve their routes\n", appName)
+	}
+
+	err = routeThresholds.Compare(appName, baseline.routes, candidate.routes)
+	if err != nil {
+		return err
+	}
+
+	return logThresholds.Compare(appName, baseline.logs, candidate.logs)
+}
@@ -0,0 +1,201 @@
+package deploy
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"code.cloudfoundry.org/cli/plugin/pluginfakes"
+	"github.com/cloudfoundry/sonde-go/events"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func accessLog(status int, responseTime float64) *events.LogMessage {
+	line := fmt.Sprintf(`app.example.com - [2019-01-01T00:00:00.000+0000] "GET / HTTP/1.1" %d 0 13 "-" "curl/7.54.0" "10.0.0.1:1234" "10.0.0.2:61000" x_forwarded_for:"-" x_forwarded_proto:"https" vcap_request_id:"abc" response_time:%g app_id:"guid" app_index:"0"`, status, responseTime)
+	sourceType := "RTR"
+	return &events.LogMessage{Message: []byte(line), SourceType: &sourceType}
+}
+
+func appLog(line string) *events.LogMessage {
+	sourceType := "APP/PROC/WEB"
+	return &events.LogMessage{Message: []byte(line), SourceType: &sourceType}
+}
+
+func routeStats(requests, serverErrors int, latency time.Duration) RouteStats {
+	var stats RouteStats
+	for i := 0; i < requests; i++ {
+		status := 200
+		if i < serverErrors {
+			status = 503
+		}
+		stats.add(status, latency)
+	}
+	return stats
+}
+
+var _ = Describe("observing routes", func() {
+	It("reads the status and response time from access logs", func() {
+		status, latency, ok := parseAccessLog(string(accessLog(502, 0.25).GetMessage()))
+		Expect(ok).To(BeTrue())
+		Expect(status).To(Equal(502))
+		Expect(latency).To(Equal(250 * time.Millisecond))
+
+		_, _, ok = parseAccessLog("not an access log")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("adds up the access logs and errors in the app's logs", func() {
+		messages := make(chan *events.LogMessage, 6)
+		messages <- accessLog(200, 0.1)
+		messages <- appLog(`"GET / HTTP/1.1" 500 `)
+		messages <- accessLog(500, 0.3)
+		messages <- accessLog(404, 0.2)
+		messages <- appLog("ERROR: could not connect to the database")
+		messages <- appLog("connected to the database")
+		close(messages)
+
+		seen := observe(messages, regexp.MustCompile(`ERROR`), make(chan struct{}))
+		Expect(seen.routes.Requests).To(Equal(3))
+		Expect(seen.routes.ServerErrors).To(Equal(1))
+		Expect(seen.routes.ErrorRate()).To(BeNumerically("~", 1.0/3))
+		Expect(seen.routes.Latency()).To(Equal(300 * time.Millisecond))
+		Expect(seen.logs).To(Equal(LogStats{Lines: 3, Errors: 1}))
+	})
+
+	Describe("comparing versions", func() {
+		thresholds := RouteThresholds{MaxErrorRateIncrease: 0.01, MaxLatencyRatio: 1.5, MinRequests: 20}
+
+		It("accepts a version that does as well as the old one", func() {
+			Expect(thresholds.Compare("app", routeStats(100, 1, 100*time.Millisecond), routeStats(100, 2, 140*time.Millisecond))).To(Succeed())
+		})
+
+		It("rejects a rise in 5xx responses", func() {
+			err := thresholds.Compare("app", routeStats(100, 1, 100*time.Millisecond), routeStats(100, 10, 100*time.Millisecond))
+			Expect(err).To(MatchError("the new version of app served 10.0% 5xx responses against 1.0% from the old version (100 requests against 100 to the old version)"))
+		})
+
+		It("rejects slower responses", func() {
+			err := thresholds.Compare("app", routeStats(100, 0, 100*time.Millisecond), routeStats(100, 0, 200*time.Millisecond))
+			Expect(err).To(BeAssignableToTypeOf(ErrRouteRegression{}))
+			Expect(err).To(MatchError(ContainSubstring("95th percentile response time of 200ms against 100ms")))
+		})
+
+		It("doesn't judge on too few requests", func() {
+			Expect(thresholds.Compare("app", routeStats(100, 0, 100*time.Millisecond), routeStats(10, 10, time.Second))).To(Succeed())
+		})
+	})
+
+	Describe("comparing error logs", func() {
+		thresholds := LogThresholds{MaxErrorRatio: 2, MinErrors: 5}
+
+		It("accepts a version that logs about as many errors as the old one", func() {
+			Expect(thresholds.Compare("app", LogStats{Lines: 100, Errors: 5}, LogStats{Lines: 100, Errors: 8})).To(Succeed())
+		})
+
+		It("rejects a spike in errors", func() {
+			err := thresholds.Compare("app", LogStats{Lines: 100, Errors: 5}, LogStats{Lines: 100, Errors: 20})
+			Expect(err).To(MatchError("the new version of app logged 20 errors in 100 lines against 5 in 100 from the old version"))
+		})
+
+		It("rejects errors from a version whose predecessor logged none", func() {
+			Expect(thresholds.Compare("app", LogStats{Lines: 100}, LogStats{Lines: 100, Errors: 5})).To(BeAssignableToTypeOf(ErrLogRegression{}))
+		})
+
+		It("ignores a handful of errors", func() {
+			Expect(thresholds.Compare("app", LogStats{Lines: 100}, LogStats{Lines: 100, Errors: 4})).To(Succeed())
+		})
+
+		It("combines the patterns", func() {
+			pattern, err := LogThresholds{Patterns: []string{"^ERROR", "panic:"}}.compile()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pattern.MatchString("ERROR: oops")).To(BeTrue())
+			Expect(pattern.MatchString("goroutine 1 panic: oops")).To(BeTrue())
+			Expect(pattern.MatchString("no ERROR here")).To(BeFalse())
+		})
+	})
+
+	Describe("during a deploy", func() {
+		var (
+			space        *fakeSpace
+			repo         *ApplicationRepo
+			opts         Options
+			originalLogs func(*ApplicationRepo, string) (<-chan *events.LogMessage, func(), error)
+			newAppStatus int
+			newAppErrors int
+		)
+
+		BeforeEach(func() {
+			space = &fakeSpace{apps: map[string]string{"app": "STARTED"}, unhealthy: map[string]bool{}}
+
+			cliConn := &pluginfakes.FakeCliConnection{}
+			cliConn.CliCommandStub = space.cliCommand
+			cliConn.CliCommandWithoutTerminalOutputStub = space.curl
+			repo = NewApplicationRepo(cliConn)
+
+			opts = defaultOptions()
+			opts.AppName = "app"
+			opts.ManifestPath = "manifest.yml"
+			opts.Strategy = StrategyRename
+			// the fake logs end, which ends the observation long before this
+			opts.ObserveWindow = time.Hour
+
+			newAppStatus = 200
+			newAppErrors = 0
+			tailed := 0
+			originalLogs = appLogs
+			appLogs = func(repo *ApplicationRepo, appGUID string) (<-chan *events.LogMessage, func(), error) {
+				// the old version is tailed first
+				tailed++
+				status, errors := 200, 0
+				if tailed == 2 {
+					status, errors = newAppStatus, newAppErrors
+				}
+				messages := make(chan *events.LogMessage, 100)
+				for i := 0; i < 50; i++ {
+					messages <- accessLog(status, 0.1)
+					if i < errors {
+						messages <- appLog("Error: something went wrong")
+					} else {
+						messages <- appLog("all good")
+					}
+				}
+				close(messages)
+				return messages, func() {}, nil
+			}
+		})
+
+		AfterEach(func() {
+			appLogs = originalLogs
+		})
+
+		It("keeps a new version that serves its routes as well as the old one", func() {
+			Expect(runActions(repo, opts)).To(Succeed())
+
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+			Expect(space.commands).To(ContainElement("delete app-venerable -f"))
+		})
+
+		It("rolls back a new version that serves more errors", func() {
+			newAppStatus = 500
+
+			err := runActions(repo, opts)
+			Expect(err).To(BeAssignableToTypeOf(ErrVerification{}))
+			Expect(err).To(MatchError(ContainSubstring("served 100.0% 5xx responses")))
+
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+			Expect(space.commands).To(ContainElement("rename app-venerable app"))
+		})
+
+		It("rolls back a new version that logs more errors", func() {
+			newAppErrors = 10
+
+			err := runActions(repo, opts)
+			Expect(err).To(BeAssignableToTypeOf(ErrVerification{}))
+			Expect(err).To(MatchError(ContainSubstring("logged 10 errors in 50 lines against 0 in 50")))
+
+			Expect(space.apps).To(Equal(map[string]string{"app": "STARTED"}))
+		})
+	})
+})
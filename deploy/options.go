@@ -0,0 +1,824 @@
+package deploy
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/contraband/autopilot/notify"
+)
+
+// Options describes a single zero-downtime push. The fields up to and
+// including VarsFiles (other than the app name and DockerPassword) map onto cf
+// push flags of the same meaning; the rest control autopilot itself.
+type Options struct {
+	AppName      string
+	ManifestPath string
+	AppPath      string
+	StackName    string
+
+	Buildpacks          []string
+	Command             string
+	Domain              string
+	DockerImage         string
+	DockerUsername      string
+	DockerPassword      string
+	HealthCheckType     string
+	HealthCheckEndpoint string
+	Hostname            string
+	NoHostname          bool
+	Instances           string
+	Memory              string
+	DiskQuota           string
+	Timeout             string
+	NoRoute             bool
+	RandomRoute         bool
+	RoutePath           string
+
+	Vars      []string
+	VarsFiles []string
+
+	ConfigPath       string
+	Strategy         string
+	StartupTimeout   time.Duration
+	TaskTimeout      time.Duration
+	VenerableSuffix  string
+	CandidateSuffix  string
+	LockTTL          time.Duration
+	ForceUnlock      bool
+	StaleVenerable   string
+	UnhealthyCurrent string
+	LostRoutes       string
+
+	// Droplet is the GUID of an already staged droplet, or the path of a
+	// droplet tarball, to run instead of staging the app's source.
+	Droplet string
+
+	ShowLogs bool
+	Report   string
+
+	MetricsFile   string
+	StatsDAddress string
+
+	ObserveWindow   time.Duration
+	RouteThresholds RouteThresholds
+	LogThresholds   LogThresholds
+
+	PreCutoverTask string
+	PostDeployTask string
+
+	Webhooks      []string
+	SlackWebhooks []string
+
+	Org      string
+	Spaces   []string
+	Targets  []Target
+	Parallel bool
+
+	// FromOrg and FromSpace are where autopilot-promote promotes the app
+	// from.
+	FromOrg   string
+	FromSpace string
+	CopyEnv   bool
+
+	FoundationsPath     string
+	Foundations         []Foundation
+	RollBackFoundations bool
+
+	// Change, if set, replaces the app with a changed copy of the running
+	// app rather than pushing it from a manifest and source.
+	Change *Change
+
+	// keepVenerable leaves the venerable app running after a successful
+	// deploy so that it can still be rolled back to.
+	keepVenerable bool
+}
+
+type StringSlice []string
+
+func (s *StringSlice) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *StringSlice) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// overridingSlice is a repeatable flag whose values replace, rather than add
+// to, any values that came from the config file or environment.
+type overridingSlice struct {
+	values     *[]string
+	overridden bool
+}
+
+func (s *overridingSlice) String() string {
+	if s.values == nil {
+		return fmt.Sprint([]string{})
+	}
+	return fmt.Sprint(*s.values)
+}
+
+func (s *overridingSlice) Set(value string) error {
+	if !s.overridden {
+		*s.values = nil
+		s.overridden = true
+	}
+	*s.values = append(*s.values, value)
+	return nil
+}
+
+func defaultOptions() Options {
+	return Options{
+		Strategy:         StrategyPrestage,
+		StartupTimeout:   defaultStartupTimeout,
+		TaskTimeout:      defaultTaskTimeout,
+		VenerableSuffix:  defaultVenerableSuffix,
+		CandidateSuffix:  defaultCandidateSuffix,
+		LockTTL:          defaultLockTTL,
+		StaleVenerable:   StaleVenerableDelete,
+		UnhealthyCurrent: UnhealthyCurrentKeep,
+		LostRoutes:       LostRoutesFail,
+		Report:           ReportTable,
+		RouteThresholds:  defaultRouteThresholds,
+		LogThresholds:    defaultLogThresholds,
+	}
+}
+
+// ParseArgs builds the options for a push. Settings come from, in order of
+// precedence, the command line flags, AUTOPILOT_* environment variables and
+// the config file.
+func ParseArgs(args []string) (Options, error) {
+	// the app name is optional as it can be read from the manifest instead
+	appName := ""
+	flagArgs := args[1:]
+	if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		appName = args[1]
+		flagArgs = args[2:]
+	}
+
+	// commands that change a running app take a fixed number of arguments
+	var change *Change
+	if count, ok := changeCommands[args[0]]; ok {
+		// only the app name is checked for a flag, as values such as
+		// JAVA_OPTS can start with a dash
+		positional := args[1:]
+		if len(positional) < count || strings.HasPrefix(positional[0], "-") {
+			return Options{}, fmt.Errorf("%s needs %d arguments", args[0], count)
+		}
+		change = newChange(args[0], positional[:count])
+		appName = positional[0]
+		flagArgs = positional[count:]
+	}
+
+	// the flags are parsed once to find the config file and then again on
+	// top of the config file so that they take precedence over it
+	var flagsOnly Options
+	err := parseFlags(flagArgs, &flagsOnly, true)
+	if err != nil {
+		return Options{}, err
+	}
+
+	opts := defaultOptions()
+
+	configPath, err := findConfig(flagsOnly.ConfigPath, flagsOnly.ManifestPath)
+	if err != nil {
+		return Options{}, err
+	}
+	if configPath != "" {
+		config, err := LoadConfig(configPath)
+		if err != nil {
+			return Options{}, err
+		}
+		config.apply(&opts)
+	}
+
+	err = applyEnvironment(&opts, os.Getenv)
+	if err != nil {
+		return Options{}, err
+	}
+
+	err = parseFlags(flagArgs, &opts, false)
+	if err != nil {
+		return Options{}, err
+	}
+
+	opts.AppName = appName
+	opts.ConfigPath = configPath
+	opts.Change = change
+
+	switch args[0] {
+	case "zero-downtime-scale":
+		err = change.scaleFrom(&opts)
+	case "autopilot-promote":
+		err = change.promoteFrom(&opts)
+	}
+	if err != nil {
+		return Options{}, err
+	}
+
+	err = loadFoundations(&opts, os.Getenv)
+	if err != nil {
+		return Options{}, err
+	}
+
+	// like cf push, the registry password is only ever read from the
+	// environment so that it doesn't end up in shell history or process lists
+	opts.DockerPassword = os.Getenv(DockerPasswordEnvVar)
+
+	err = opts.Validate()
+	if err != nil {
+		return Options{}, err
+	}
+
+	return opts, nil
+}
+
+// parseFlags parses the command line flags into opts. The current values in
+// opts are kept for any flags that are not given.
+func parseFlags(flagArgs []string, opts *Options, reportErrors bool) error {
+	flags := flag.NewFlagSet("zero-downtime-push", flag.ContinueOnError)
+	if !reportErrors {
+		flags.SetOutput(ioutil.Discard)
+	}
+
+	flags.StringVar(&opts.ManifestPath, "f", opts.ManifestPath, "path to an application manifest")
+	flags.StringVar(&opts.AppPath, "p", opts.AppPath, "path to application files")
+	flags.StringVar(&opts.StackName, "s", opts.StackName, "name of the stack to use")
+	flags.Var((*StringSlice)(&opts.Buildpacks), "b", "custom buildpack by name or Git URL; can specify multiple times")
+	flags.StringVar(&opts.Command, "c", opts.Command, "startup command")
+	flags.StringVar(&opts.Domain, "d", opts.Domain, "domain for the application route")
+	flags.StringVar(&opts.DockerImage, "docker-image", opts.DockerImage, "docker image to use")
+	flags.StringVar(&opts.DockerImage, "o", opts.DockerImage, "docker image to use (alias of --docker-image)")
+	flags.StringVar(&opts.DockerUsername, "docker-username", opts.DockerUsername, "repository username for the docker image")
+	flags.StringVar(&opts.HealthCheckType, "health-check-type", opts.HealthCheckType, "application health check type (port, process, http or none)")
+	flags.StringVar(&opts.HealthCheckType, "u", opts.HealthCheckType, "application health check type (alias of --health-check-type)")
+	flags.StringVar(&opts.HealthCheckEndpoint, "endpoint", opts.HealthCheckEndpoint, "path on the app for the http health check (e.g. /health)")
+	flags.StringVar(&opts.Hostname, "hostname", opts.Hostname, "hostname for the application route")
+	flags.StringVar(&opts.Hostname, "n", opts.Hostname, "hostname for the application route (alias of --hostname)")
+	flags.BoolVar(&opts.NoHostname, "no-hostname", opts.NoHostname, "map the root domain to the application")
+	flags.StringVar(&opts.Instances, "i", opts.Instances, "number of instances")
+	flags.StringVar(&opts.Memory, "m", opts.Memory, "memory limit (e.g. 256M, 1024M, 1G)")
+	flags.StringVar(&opts.DiskQuota, "k", opts.DiskQuota, "disk limit (e.g. 256M, 1024M, 1G)")
+	flags.StringVar(&opts.Timeout, "t", opts.Timeout, "time (in seconds) allowed to elapse between starting up an app and the first healthy response from the app")
+	flags.BoolVar(&opts.NoRoute, "no-route", opts.NoRoute, "do not map a route to the application")
+	flags.BoolVar(&opts.RandomRoute, "random-route", opts.RandomRoute, "create a random route for the application")
+	flags.StringVar(&opts.RoutePath, "route-path", opts.RoutePath, "path for the route")
+	flags.Var((*StringSlice)(&opts.Vars), "var", "Variable key value pair for variable substitution, (e.g., name=app1); can specify multiple times")
+	flags.Var((*StringSlice)(&opts.VarsFiles), "vars-file", "Path to a variable substitution file for manifest; can specify multiple times")
+	flags.StringVar(&opts.Droplet, "droplet", opts.Droplet, "GUID of a staged droplet or path to a droplet tarball to deploy instead of staging")
+
+	flags.StringVar(&opts.ConfigPath, "config", opts.ConfigPath, "path to an autopilot config file (defaults to autopilot.yml next to the manifest)")
+	flags.StringVar(&opts.Strategy, "strategy", opts.Strategy, "deploy strategy: prestage (stage before renaming the current app) or rename (rename then push)")
+	flags.DurationVar(&opts.StartupTimeout, "startup-timeout", opts.StartupTimeout, "how long to wait for the new application to stage and start")
+	flags.DurationVar(&opts.TaskTimeout, "task-timeout", opts.TaskTimeout, "how long to wait for the pre-cutover and post-deploy tasks to finish")
+	flags.DurationVar(&opts.LockTTL, "lock-ttl", opts.LockTTL, "how long the deploy lock is honoured for if it is never released")
+	flags.BoolVar(&opts.ForceUnlock, "force-unlock", opts.ForceUnlock, "take over the deploy lock even if another deploy holds it")
+	flags.StringVar(&opts.StaleVenerable, "stale-venerable", opts.StaleVenerable, "what to do with a venerable app left by an earlier deploy when the app itself is missing: delete, promote or abort")
+	flags.StringVar(&opts.UnhealthyCurrent, "unhealthy-current", opts.UnhealthyCurrent, "what to do with a current app that is started but has no running instances: keep, delete or abort")
+	flags.StringVar(&opts.LostRoutes, "lost-routes", opts.LostRoutes, "what to do when the new app is not mapped to all of the current app's routes: fail, warn or ignore")
+	flags.BoolVar(&opts.ShowLogs, "show-app-log", opts.ShowLogs, "tail and show application log during application start")
+	flags.StringVar(&opts.Report, "report", opts.Report, "format of the report on the deployed application: table or json")
+	flags.DurationVar(&opts.ObserveWindow, "observe", opts.ObserveWindow, "how long to compare the error rate and response time of the new and old versions once both are serving traffic (e.g. 5m)")
+	flags.Float64Var(&opts.RouteThresholds.MaxErrorRateIncrease, "max-5xx-increase", opts.RouteThresholds.MaxErrorRateIncrease, "how far the fraction of 5xx responses may rise while observing before rolling back (e.g. 0.01)")
+	flags.Float64Var(&opts.RouteThresholds.MaxLatencyRatio, "max-latency-ratio", opts.RouteThresholds.MaxLatencyRatio, "how many times the old 95th percentile response time the new one may be while observing before rolling back")
+	flags.IntVar(&opts.RouteThresholds.MinRequests, "min-requests", opts.RouteThresholds.MinRequests, "how many requests each version must serve while observing to be compared")
+	flags.Var(&overridingSlice{values: &opts.LogThresholds.Patterns}, "error-pattern", "regular expression that picks out errors in the application's logs while observing; can specify multiple times")
+	flags.Float64Var(&opts.LogThresholds.MaxErrorRatio, "max-error-log-ratio", opts.LogThresholds.MaxErrorRatio, "how many times the old fraction of error log lines the new one may be while observing before rolling back")
+	flags.StringVar(&opts.MetricsFile, "metrics-file", opts.MetricsFile, "path to write deploy metrics to in the Prometheus text format")
+	flags.StringVar(&opts.StatsDAddress, "statsd", opts.StatsDAddress, "host:port of a StatsD server to send deploy metrics to")
+	flags.StringVar(&opts.PreCutoverTask, "pre-cutover-task", opts.PreCutoverTask, "command to run as a task with the new droplet before it receives traffic")
+	flags.StringVar(&opts.PostDeployTask, "post-deploy-task", opts.PostDeployTask, "command to run as a task on the new application once it is running")
+	flags.Var(&overridingSlice{values: &opts.Webhooks}, "webhook", "URL to POST a JSON notification to as the deploy progresses; can specify multiple times")
+	flags.Var(&overridingSlice{values: &opts.SlackWebhooks}, "slack-webhook", "Slack-compatible incoming webhook URL to notify as the deploy progresses; can specify multiple times")
+	flags.StringVar(&opts.Org, "org", opts.Org, "org of the spaces given with --space (defaults to the targeted org)")
+	flags.Var((*StringSlice)(&opts.Spaces), "space", "space to deploy to instead of the targeted space; can specify multiple times")
+	flags.Var((*StringSlice)(&opts.Spaces), "to-space", "space to promote the application to (alias of --space)")
+	flags.StringVar(&opts.FromOrg, "from-org", opts.FromOrg, "org of the space given with --from-space (defaults to the org being deployed to)")
+	flags.StringVar(&opts.FromSpace, "from-space", opts.FromSpace, "space to promote the application from")
+	flags.BoolVar(&opts.CopyEnv, "copy-env", opts.CopyEnv, "give the promoted application the environment variables of the one in --from-space rather than keeping its own")
+	flags.BoolVar(&opts.Parallel, "parallel", opts.Parallel, "deploy to all spaces at once rather than one after another")
+	flags.StringVar(&opts.FoundationsPath, "foundations", opts.FoundationsPath, "path to a file listing the foundations to deploy to")
+	flags.BoolVar(&opts.RollBackFoundations, "roll-back-foundations", opts.RollBackFoundations, "roll back the foundations already deployed to if a later one fails")
+
+	return flags.Parse(flagArgs)
+}
+
+var (
+	ErrNoArgs     = errors.New("app name must be specified")
+	ErrNoManifest = errors.New("a manifest is required to push this application")
+
+	ErrDockerImageWithAppPath   = errors.New("--docker-image cannot be used with -p")
+	ErrDockerImageWithBuildpack = errors.New("--docker-image cannot be used with -b")
+	ErrDockerUsernameNoImage    = errors.New("--docker-username requires --docker-image")
+	ErrDockerPasswordNotSet     = errors.New("the " + DockerPasswordEnvVar + " environment variable must be set when using --docker-username")
+	ErrNoRouteWithRouteOptions  = errors.New("--no-route cannot be used with -d, --hostname, --no-hostname, --random-route or --route-path")
+	ErrRandomRouteWithHostname  = errors.New("--random-route cannot be used with --hostname or --no-hostname")
+	ErrHostnameWithNoHostname   = errors.New("--hostname cannot be used with --no-hostname")
+	ErrEndpointWithoutHTTP      = errors.New("--endpoint can only be used with the http health check type")
+	ErrPreCutoverTaskNeedsStage = errors.New("a pre-cutover task can only be run with the prestage strategy")
+	ErrSameNamingSuffix         = errors.New("the venerable and candidate suffixes must be different")
+
+	ErrDropletWithDockerImage    = errors.New("--droplet cannot be used with --docker-image")
+	ErrDropletWithBuildpack      = errors.New("--droplet cannot be used with -b")
+	ErrDropletWithAppPath        = errors.New("--droplet cannot be used with -p")
+	ErrPreCutoverTaskWithDroplet = errors.New("a pre-cutover task cannot be used with --droplet as nothing is staged")
+	ErrFromSpaceWithoutPromote   = errors.New("--from-org, --from-space and --copy-env can only be used with autopilot-promote")
+)
+
+// DockerPasswordEnvVar is the environment variable that cf reads the docker
+// registry password from.
+const DockerPasswordEnvVar = "CF_DOCKER_PASSWORD"
+
+// guidPattern matches the GUIDs that the Cloud Controller gives its resources.
+var guidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// dropletGUID returns the droplet to copy, if Droplet is a GUID.
+func (opts Options) dropletGUID() string {
+	if guidPattern.MatchString(opts.Droplet) {
+		return opts.Droplet
+	}
+	return ""
+}
+
+// dropletPath returns the droplet tarball to upload, if Droplet is a path.
+func (opts Options) dropletPath() string {
+	if guidPattern.MatchString(opts.Droplet) {
+		return ""
+	}
+	return opts.Droplet
+}
+
+// dockerImagePattern is a simplified form of the docker image reference
+// grammar: an optional registry host, a repository path, an optional tag and
+// an optional digest.
+var dockerImagePattern = regexp.MustCompile(`^(?:[a-zA-Z0-9][a-zA-Z0-9.-]*(?::[0-9]+)?/)?[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*(?::[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?(?:@sha256:[a-f0-9]{64})?$`)
+
+var healthCheckTypes = []string{"port", "process", "http", "none"}
+
+const (
+	// StrategyPrestage stages the new code in a candidate app before the
+	// current app is renamed.
+	StrategyPrestage = "prestage"
+	// StrategyRename renames the current app and then pushes over the top
+	// of it, staging as part of the push.
+	StrategyRename = "rename"
+)
+
+var strategies = []string{StrategyPrestage, StrategyRename}
+
+const (
+	// StaleVenerableDelete pushes the new app alongside a venerable app
+	// that has no current app and deletes it once the push succeeds.
+	StaleVenerableDelete = "delete"
+	// StaleVenerablePromote renames the venerable app back so that it is
+	// treated as the current app for the rest of the deploy.
+	StaleVenerablePromote = "promote"
+	// StaleVenerableAbort stops the deploy so that someone can take a look.
+	StaleVenerableAbort = "abort"
+)
+
+var staleVenerablePolicies = []string{StaleVenerableDelete, StaleVenerablePromote, StaleVenerableAbort}
+
+const (
+	// UnhealthyCurrentKeep renames a started app with no running instances
+	// to venerable like any other, keeping it to roll back to.
+	UnhealthyCurrentKeep = "keep"
+	// UnhealthyCurrentDelete treats it as if it were stopped and deletes it.
+	UnhealthyCurrentDelete = "delete"
+	// UnhealthyCurrentAbort stops the deploy so that someone can take a look.
+	UnhealthyCurrentAbort = "abort"
+)
+
+var unhealthyCurrentPolicies = []string{UnhealthyCurrentKeep, UnhealthyCurrentDelete, UnhealthyCurrentAbort}
+
+const (
+	// LostRoutesFail rolls back a deploy whose new app is missing some of
+	// the current app's routes, as they would go unserved once the current
+	// app is deleted.
+	LostRoutesFail = "fail"
+	// LostRoutesWarn carries on with the deploy after listing the routes.
+	LostRoutesWarn = "warn"
+	// LostRoutesIgnore doesn't compare the routes at all.
+	LostRoutesIgnore = "ignore"
+)
+
+var lostRoutesPolicies = []string{LostRoutesFail, LostRoutesWarn, LostRoutesIgnore}
+
+var defaultRouteThresholds = RouteThresholds{
+	MaxErrorRateIncrease: 0.01,
+	MaxLatencyRatio:      1.5,
+	MinRequests:          20,
+}
+
+var defaultLogThresholds = LogThresholds{
+	Patterns:      []string{`(?i)\b(error|fatal|panic|exception)\b`},
+	MaxErrorRatio: 2,
+	MinErrors:     5,
+}
+
+const (
+	defaultStartupTimeout  = 5 * time.Minute
+	defaultTaskTimeout     = 30 * time.Minute
+	defaultVenerableSuffix = "-venerable"
+	defaultCandidateSuffix = "-candidate"
+)
+
+// Validate checks that the options form a push that cf would accept.
+func (opts Options) Validate() error {
+	if opts.Change != nil {
+		return opts.validateChange()
+	}
+
+	if opts.ManifestPath == "" {
+		return ErrNoManifest
+	}
+
+	return opts.validateSettings()
+}
+
+// validateChange checks the options of a change to a running app, which
+// has no manifest or source to push. The health check and hooks can come from
+// the config file, so they are ignored rather than rejected.
+func (opts Options) validateChange() error {
+	if opts.AppName == "" {
+		return ErrNoArgs
+	}
+
+	pushOnly := []struct {
+		flag string
+		set  bool
+	}{
+		{"-f", opts.ManifestPath != ""},
+		{"-p", opts.AppPath != ""},
+		{"-s", opts.StackName != ""},
+		{"-b", len(opts.Buildpacks) > 0},
+		{"-c", opts.Command != ""},
+		{"-d", opts.Domain != ""},
+		{"--docker-image", opts.DockerImage != ""},
+		{"--docker-username", opts.DockerUsername != ""},
+		{"--hostname", opts.Hostname != ""},
+		{"--no-hostname", opts.NoHostname},
+		{"-i", opts.Instances != ""},
+		{"-m", opts.Memory != ""},
+		{"-k", opts.DiskQuota != ""},
+		{"--no-route", opts.NoRoute},
+		{"--random-route", opts.RandomRoute},
+		{"--route-path", opts.RoutePath != ""},
+		{"--var", len(opts.Vars) > 0},
+		{"--vars-file", len(opts.VarsFiles) > 0},
+		{"--droplet", opts.Droplet != ""},
+	}
+	for _, option := range pushOnly {
+		if option.set {
+			return fmt.Errorf("%s can only be used with zero-downtime-push", option.flag)
+		}
+	}
+
+	return opts.validateSettings()
+}
+
+// validateSettings checks the options that control autopilot itself.
+func (opts Options) validateSettings() error {
+	if opts.FromOrg != "" || opts.FromSpace != "" || opts.CopyEnv {
+		return ErrFromSpaceWithoutPromote
+	}
+
+	if opts.IsDocker() {
+		if !dockerImagePattern.MatchString(opts.DockerImage) {
+			return fmt.Errorf("invalid docker image reference %q", opts.DockerImage)
+		}
+		if opts.DockerUsername != "" && opts.DockerPassword == "" {
+			return ErrDockerPasswordNotSet
+		}
+		if opts.AppPath != "" {
+			return ErrDockerImageWithAppPath
+		}
+		if len(opts.Buildpacks) > 0 {
+			return ErrDockerImageWithBuildpack
+		}
+	} else if opts.DockerUsername != "" {
+		return ErrDockerUsernameNoImage
+	}
+
+	if opts.NoRoute && (opts.Domain != "" || opts.Hostname != "" || opts.NoHostname || opts.RandomRoute || opts.RoutePath != "") {
+		return ErrNoRouteWithRouteOptions
+	}
+
+	if opts.RandomRoute && (opts.Hostname != "" || opts.NoHostname) {
+		return ErrRandomRouteWithHostname
+	}
+
+	if opts.Hostname != "" && opts.NoHostname {
+		return ErrHostnameWithNoHostname
+	}
+
+	if opts.HealthCheckType != "" && !containsString(healthCheckTypes, opts.HealthCheckType) {
+		return fmt.Errorf("invalid health check type %q: must be one of %s", opts.HealthCheckType, strings.Join(healthCheckTypes, ", "))
+	}
+
+	if opts.HealthCheckEndpoint != "" && opts.HealthCheckType != "" && opts.HealthCheckType != "http" {
+		return ErrEndpointWithoutHTTP
+	}
+
+	if opts.Instances != "" {
+		instances, err := strconv.Atoi(opts.Instances)
+		if err != nil || instances < 0 {
+			return fmt.Errorf("invalid number of instances %q: must be a non-negative integer", opts.Instances)
+		}
+	}
+
+	if opts.Timeout != "" {
+		timeout, err := strconv.Atoi(opts.Timeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid timeout %q: must be a positive number of seconds", opts.Timeout)
+		}
+	}
+
+	if opts.Memory != "" {
+		if _, err := bytefmt.ToMegabytes(opts.Memory); err != nil {
+			return fmt.Errorf("invalid memory limit %q: %s", opts.Memory, err)
+		}
+	}
+
+	if opts.DiskQuota != "" {
+		if _, err := bytefmt.ToMegabytes(opts.DiskQuota); err != nil {
+			return fmt.Errorf("invalid disk limit %q: %s", opts.DiskQuota, err)
+		}
+	}
+
+	if opts.Strategy != "" && !containsString(strategies, opts.Strategy) {
+		return fmt.Errorf("invalid strategy %q: must be one of %s", opts.Strategy, strings.Join(strategies, ", "))
+	}
+
+	if opts.PreCutoverTask != "" && opts.Strategy == StrategyRename {
+		return ErrPreCutoverTaskNeedsStage
+	}
+
+	if opts.Droplet != "" {
+		if opts.PreCutoverTask != "" {
+			return ErrPreCutoverTaskWithDroplet
+		}
+		if opts.IsDocker() {
+			return ErrDropletWithDockerImage
+		}
+		if len(opts.Buildpacks) > 0 {
+			return ErrDropletWithBuildpack
+		}
+		if opts.AppPath != "" {
+			return ErrDropletWithAppPath
+		}
+	}
+
+	if opts.StartupTimeout < 0 {
+		return fmt.Errorf("invalid startup timeout %s: must not be negative", opts.StartupTimeout)
+	}
+
+	if opts.TaskTimeout < 0 {
+		return fmt.Errorf("invalid task timeout %s: must not be negative", opts.TaskTimeout)
+	}
+
+	if opts.StaleVenerable != "" && !containsString(staleVenerablePolicies, opts.StaleVenerable) {
+		return fmt.Errorf("invalid stale venerable policy %q: must be one of %s", opts.StaleVenerable, strings.Join(staleVenerablePolicies, ", "))
+	}
+
+	if opts.UnhealthyCurrent != "" && !containsString(unhealthyCurrentPolicies, opts.UnhealthyCurrent) {
+		return fmt.Errorf("invalid unhealthy current app policy %q: must be one of %s", opts.UnhealthyCurrent, strings.Join(unhealthyCurrentPolicies, ", "))
+	}
+
+	if opts.LostRoutes != "" && !containsString(lostRoutesPolicies, opts.LostRoutes) {
+		return fmt.Errorf("invalid lost routes policy %q: must be one of %s", opts.LostRoutes, strings.Join(lostRoutesPolicies, ", "))
+	}
+
+	if opts.Report != "" && !containsString(reportFormats, opts.Report) {
+		return fmt.Errorf("invalid report format %q: must be one of %s", opts.Report, strings.Join(reportFormats, ", "))
+	}
+
+	if opts.ObserveWindow < 0 {
+		return fmt.Errorf("invalid observation window %s: must not be negative", opts.ObserveWindow)
+	}
+
+	if opts.RouteThresholds.MaxErrorRateIncrease < 0 || opts.RouteThresholds.MaxErrorRateIncrease > 1 {
+		return fmt.Errorf("invalid 5xx increase %g: must be between 0 and 1", opts.RouteThresholds.MaxErrorRateIncrease)
+	}
+
+	if opts.RouteThresholds.MaxLatencyRatio < 1 {
+		return fmt.Errorf("invalid latency ratio %g: must be at least 1", opts.RouteThresholds.MaxLatencyRatio)
+	}
+
+	if opts.RouteThresholds.MinRequests < 0 {
+		return fmt.Errorf("invalid minimum requests %d: must not be negative", opts.RouteThresholds.MinRequests)
+	}
+
+	for _, pattern := range opts.LogThresholds.Patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid error pattern %q: %s", pattern, err)
+		}
+	}
+
+	if opts.LogThresholds.MaxErrorRatio < 1 {
+		return fmt.Errorf("invalid error log ratio %g: must be at least 1", opts.LogThresholds.MaxErrorRatio)
+	}
+
+	if opts.StatsDAddress != "" {
+		if _, _, err := net.SplitHostPort(opts.StatsDAddress); err != nil {
+			return fmt.Errorf("invalid StatsD address %q: must be host:port", opts.StatsDAddress)
+		}
+	}
+
+	if opts.LockTTL < 0 {
+		return fmt.Errorf("invalid lock TTL %s: must not be negative", opts.LockTTL)
+	}
+
+	if opts.VenerableAppName() == opts.CandidateAppName() {
+		return ErrSameNamingSuffix
+	}
+
+	if opts.Org != "" && len(opts.Spaces) == 0 {
+		return ErrOrgWithoutSpace
+	}
+
+	for _, target := range opts.Targets {
+		if target.Space == "" {
+			return fmt.Errorf("invalid target %q: a space is required", target.Org)
+		}
+	}
+
+	if len(opts.Foundations) > 0 && len(opts.DeployTargets()) > 0 {
+		return ErrFoundationsWithTargets
+	}
+
+	for _, webhook := range append(append([]string{}, opts.Webhooks...), opts.SlackWebhooks...) {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook URL %q: must be an http or https URL", webhook)
+		}
+	}
+
+	return nil
+}
+
+// VenerableAppName returns the name the current application is renamed to
+// while the new one is pushed.
+func (opts Options) VenerableAppName() string {
+	suffix := opts.VenerableSuffix
+	if suffix == "" {
+		suffix = defaultVenerableSuffix
+	}
+	return opts.AppName + suffix
+}
+
+// CandidateAppName returns the name of the application that the new code is
+// staged in before the current application is touched.
+func (opts Options) CandidateAppName() string {
+	suffix := opts.CandidateSuffix
+	if suffix == "" {
+		suffix = defaultCandidateSuffix
+	}
+	return opts.AppName + suffix
+}
+
+// DeployTargets returns the spaces to deploy to. Spaces given on the command
+// line replace any targets from the config file. No targets means the
+// targeted space.
+func (opts Options) DeployTargets() []Target {
+	if len(opts.Spaces) == 0 {
+		return opts.Targets
+	}
+
+	var targets []Target
+	for _, space := range opts.Spaces {
+		targets = append(targets, Target{Org: opts.Org, Space: space})
+	}
+	return targets
+}
+
+// Notifier returns a notifier for the configured webhooks.
+func (opts Options) Notifier() notify.Notifier {
+	var webhooks []notify.Webhook
+	for _, webhook := range opts.Webhooks {
+		webhooks = append(webhooks, notify.Webhook{URL: webhook, Format: notify.Generic})
+	}
+	for _, webhook := range opts.SlackWebhooks {
+		webhooks = append(webhooks, notify.Webhook{URL: webhook, Format: notify.Slack})
+	}
+	return notify.Notifier{Webhooks: webhooks}
+}
+
+// IsDocker returns true if the application is deployed from a docker image
+// rather than from source.
+func (opts Options) IsDocker() bool {
+	return opts.DockerImage != ""
+}
+
+// Preflight checks that the files the push relies on exist, and that every
+// variable in the manifest has a value, before anything is changed in the
+// space. Docker and droplet deployments have no application bits so the app
+// path is not checked for them. Problems with the variables are returned as
+// ErrValidation.
+func (opts Options) Preflight() error {
+	if opts.Change != nil {
+		return nil
+	}
+
+	if _, err := readManifest(opts.ManifestPath, opts.Vars, opts.VarsFiles); err != nil {
+		if _, ok := err.(ErrValidation); ok {
+			return err
+		}
+		return fmt.Errorf("cannot read manifest: %s", err)
+	}
+
+	if path := opts.dropletPath(); path != "" {
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("cannot read droplet: %s", err)
+		}
+	}
+
+	if opts.IsDocker() || opts.Droplet != "" || opts.AppPath == "" {
+		return nil
+	}
+
+	if _, err := os.Stat(opts.AppPath); err != nil {
+		return fmt.Errorf("cannot read application path: %s", err)
+	}
+
+	return nil
+}
+
+// PushArgs returns the arguments to give cf to push the application without
+// starting it. cf v6 push can't set the endpoint of the http health check, so
+// that is left to ApplicationRepo.
+func (opts Options) PushArgs() []string {
+	args := []string{"push", opts.AppName, "-f", opts.ManifestPath, "--no-start"}
+
+	stringFlags := []struct {
+		flag  string
+		value string
+	}{
+		{"-p", opts.AppPath},
+		{"-s", opts.StackName},
+		{"-c", opts.Command},
+		{"-d", opts.Domain},
+		{"--docker-image", opts.DockerImage},
+		{"--docker-username", opts.DockerUsername},
+		{"--health-check-type", opts.HealthCheckType},
+		{"--hostname", opts.Hostname},
+		{"-i", opts.Instances},
+		{"-m", opts.Memory},
+		{"-k", opts.DiskQuota},
+		{"-t", opts.Timeout},
+		{"--route-path", opts.RoutePath},
+		{"--droplet", opts.dropletPath()},
+	}
+	for _, f := range stringFlags {
+		if f.value != "" {
+			args = append(args, f.flag, f.value)
+		}
+	}
+
+	boolFlags := []struct {
+		flag  string
+		value bool
+	}{
+		{"--no-hostname", opts.NoHostname},
+		{"--no-route", opts.NoRoute},
+		{"--random-route", opts.RandomRoute},
+	}
+	for _, f := range boolFlags {
+		if f.value {
+			args = append(args, f.flag)
+		}
+	}
+
+	for _, buildpack := range opts.Buildpacks {
+		args = append(args, "-b", buildpack)
+	}
+
+	for _, varPair := range opts.Vars {
+		args = append(args, "--var", varPair)
+	}
+
+	for _, varsFile := range opts.VarsFiles {
+		args = append(args, "--vars-file", varsFile)
+	}
+
+	return args
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
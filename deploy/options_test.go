@@ -0,0 +1,453 @@
+package deploy_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/contraband/autopilot/deploy"
+	"github.com/contraband/autopilot/notify"
+)
+
+var _ = Describe("Flag Parsing", func() {
+	It("parses a complete set of args", func() {
+		opts, err := ParseArgs(
+			[]string{
+				"zero-downtime-push",
+				"appname",
+				"-f", "manifest-path",
+				"-p", "app-path",
+				"-s", "stack-name",
+				"-var", "foo=bar",
+				"-var", "baz=bob",
+				"-vars-file", "vars.yml",
+			},
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.AppName).To(Equal("appname"))
+		Expect(opts.ManifestPath).To(Equal("manifest-path"))
+		Expect(opts.AppPath).To(Equal("app-path"))
+		Expect(opts.StackName).To(Equal("stack-name"))
+		Expect(opts.Vars).To(Equal([]string{"foo=bar", "baz=bob"}))
+		Expect(opts.VarsFiles).To(Equal([]string{"vars.yml"}))
+		Expect(opts.ShowLogs).To(Equal(false))
+	})
+
+	It("parses lifecycle tasks without passing them to cf push", func() {
+		opts, err := ParseArgs(
+			[]string{
+				"zero-downtime-push",
+				"appname",
+				"-f", "manifest-path",
+				"--pre-cutover-task", "rake db:migrate",
+				"--post-deploy-task", "rake cache:warm",
+			},
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.PreCutoverTask).To(Equal("rake db:migrate"))
+		Expect(opts.PostDeployTask).To(Equal("rake cache:warm"))
+		Expect(opts.PushArgs()).To(Equal([]string{"push", "appname", "-f", "manifest-path", "--no-start"}))
+	})
+
+	It("parses the health check endpoint without passing it to cf push", func() {
+		opts, err := ParseArgs([]string{"zero-downtime-push", "appname", "-f", "manifest-path", "--endpoint", "/health"})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.HealthCheckEndpoint).To(Equal("/health"))
+		Expect(opts.PushArgs()).To(Equal([]string{"push", "appname", "-f", "manifest-path", "--no-start"}))
+	})
+
+	It("parses webhooks into a notifier", func() {
+		opts, err := ParseArgs(
+			[]string{
+				"zero-downtime-push",
+				"appname",
+				"-f", "manifest-path",
+				"--webhook", "https://example.com/deploys",
+				"--slack-webhook", "https://hooks.slack.com/services/T/B/X",
+			},
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.Notifier().Webhooks).To(Equal([]notify.Webhook{
+			{URL: "https://example.com/deploys", Format: notify.Generic},
+			{URL: "https://hooks.slack.com/services/T/B/X", Format: notify.Slack},
+		}))
+		Expect(opts.PushArgs()).To(Equal([]string{"push", "appname", "-f", "manifest-path", "--no-start"}))
+	})
+
+	It("parses deploy targets", func() {
+		opts, err := ParseArgs([]string{"zero-downtime-push", "appname", "-f", "manifest-path", "--org", "other-org", "--space", "staging", "--space", "production", "--parallel"})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.DeployTargets()).To(Equal([]Target{
+			{Org: "other-org", Space: "staging"},
+			{Org: "other-org", Space: "production"},
+		}))
+		Expect(opts.Parallel).To(BeTrue())
+		Expect(opts.PushArgs()).ToNot(ContainElement("staging"))
+	})
+
+	It("deploys to the targeted space when no spaces are given", func() {
+		opts, err := ParseArgs([]string{"zero-downtime-push", "appname", "-f", "manifest-path"})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.DeployTargets()).To(BeEmpty())
+	})
+
+	It("allows the app name to be omitted", func() {
+		opts, err := ParseArgs(
+			[]string{
+				"zero-downtime-push",
+				"-f", "manifest-path",
+			},
+		)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(opts.AppName).To(BeEmpty())
+		Expect(opts.ManifestPath).To(Equal("manifest-path"))
+	})
+
+	It("requires a manifest", func() {
+		_, err := ParseArgs(
+			[]string{
+				"zero-downtime-push",
+				"appname",
+				"-p", "app-path",
+			},
+		)
+		Expect(err).To(MatchError(ErrNoManifest))
+	})
+
+	Describe("changing a running app", func() {
+		It("parses a restage without a manifest", func() {
+			opts, err := ParseArgs([]string{"zero-downtime-restage", "appname", "--space", "staging"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.AppName).To(Equal("appname"))
+			Expect(opts.Change).To(Equal(&Change{Restage: true}))
+			Expect(opts.Spaces).To(Equal([]string{"staging"}))
+			Expect(opts.Preflight()).To(Succeed())
+		})
+
+		It("parses the variable to set", func() {
+			opts, err := ParseArgs([]string{"zero-downtime-set-env", "appname", "LOG_LEVEL", "debug"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.AppName).To(Equal("appname"))
+			Expect(opts.Change).To(Equal(&Change{Env: map[string]string{"LOG_LEVEL": "debug"}}))
+		})
+
+		It("parses a value that starts with a dash", func() {
+			opts, err := ParseArgs([]string{"zero-downtime-set-env", "appname", "JAVA_OPTS", "-Xmx512m", "--space", "staging"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.Change).To(Equal(&Change{Env: map[string]string{"JAVA_OPTS": "-Xmx512m"}}))
+			Expect(opts.Spaces).To(Equal([]string{"staging"}))
+		})
+
+		It("requires an app name rather than a flag", func() {
+			_, err := ParseArgs([]string{"zero-downtime-set-env", "--space", "staging", "LOG_LEVEL"})
+			Expect(err).To(MatchError("zero-downtime-set-env needs 3 arguments"))
+		})
+
+		It("parses the new scale of the app", func() {
+			opts, err := ParseArgs([]string{"zero-downtime-scale", "appname", "-m", "2G", "-k", "512M"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.Change).To(Equal(&Change{MemoryMB: 2048, DiskMB: 512}))
+			Expect(opts.Memory).To(BeEmpty())
+			Expect(opts.PushArgs()).ToNot(ContainElement("-m"))
+		})
+
+		It("parses the stack to move to", func() {
+			opts, err := ParseArgs([]string{"zero-downtime-change-stack", "appname", "cflinuxfs4"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.AppName).To(Equal("appname"))
+			Expect(opts.Change).To(Equal(&Change{Restage: true, Stack: "cflinuxfs4"}))
+		})
+
+		It("parses where to promote the app from and to", func() {
+			opts, err := ParseArgs([]string{"autopilot-promote", "appname", "--from-space", "staging", "--to-space", "production"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.Change).To(Equal(&Change{From: &Target{Space: "staging"}}))
+			Expect(opts.DeployTargets()).To(Equal([]Target{{Space: "production"}}))
+		})
+
+		It("parses whether to copy the environment when promoting", func() {
+			opts, err := ParseArgs([]string{"autopilot-promote", "appname", "--from-space", "staging", "--copy-env"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.Change).To(Equal(&Change{From: &Target{Space: "staging"}, CopyEnv: true}))
+			Expect(opts.CopyEnv).To(BeFalse())
+		})
+
+		It("requires a space to promote from", func() {
+			_, err := ParseArgs([]string{"autopilot-promote", "appname", "--to-space", "production"})
+			Expect(err).To(MatchError(ErrNoSourceSpace))
+		})
+
+		It("only takes a space to promote from when promoting", func() {
+			_, err := ParseArgs([]string{"zero-downtime-push", "appname", "-f", "manifest-path", "--from-space", "staging"})
+			Expect(err).To(MatchError(ErrFromSpaceWithoutPromote))
+
+			_, err = ParseArgs([]string{"zero-downtime-restage", "appname", "--copy-env"})
+			Expect(err).To(MatchError(ErrFromSpaceWithoutPromote))
+		})
+
+		It("requires a scale to change to", func() {
+			_, err := ParseArgs([]string{"zero-downtime-scale", "appname"})
+			Expect(err).To(MatchError(ErrNoScale))
+		})
+
+		It("rejects scaling to no instances", func() {
+			_, err := ParseArgs([]string{"zero-downtime-scale", "appname", "-i", "0"})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("requires every argument", func() {
+			_, err := ParseArgs([]string{"zero-downtime-set-env", "appname", "LOG_LEVEL"})
+			Expect(err).To(MatchError("zero-downtime-set-env needs 3 arguments"))
+		})
+
+		It("rejects the flags that only make sense for a push", func() {
+			_, err := ParseArgs([]string{"zero-downtime-restage", "appname", "-f", "manifest-path"})
+			Expect(err).To(MatchError("-f can only be used with zero-downtime-push"))
+		})
+	})
+
+	Describe("cf push flag passthrough", func() {
+		mappings := []struct {
+			args     []string
+			pushArgs []string
+		}{
+			{[]string{"-b", "go_buildpack"}, []string{"-b", "go_buildpack"}},
+			{[]string{"-b", "nodejs_buildpack", "-b", "go_buildpack"}, []string{"-b", "nodejs_buildpack", "-b", "go_buildpack"}},
+			{[]string{"-c", "./start"}, []string{"-c", "./start"}},
+			{[]string{"-d", "example.com"}, []string{"-d", "example.com"}},
+			{[]string{"--docker-image", "org/image:tag"}, []string{"--docker-image", "org/image:tag"}},
+			{[]string{"-o", "org/image:tag"}, []string{"--docker-image", "org/image:tag"}},
+			{[]string{"--health-check-type", "http"}, []string{"--health-check-type", "http"}},
+			{[]string{"-u", "process"}, []string{"--health-check-type", "process"}},
+			{[]string{"--hostname", "www"}, []string{"--hostname", "www"}},
+			{[]string{"-n", "www"}, []string{"--hostname", "www"}},
+			{[]string{"--no-hostname"}, []string{"--no-hostname"}},
+			{[]string{"-i", "3"}, []string{"-i", "3"}},
+			{[]string{"-m", "1G"}, []string{"-m", "1G"}},
+			{[]string{"-k", "512M"}, []string{"-k", "512M"}},
+			{[]string{"-t", "180"}, []string{"-t", "180"}},
+			{[]string{"--no-route"}, []string{"--no-route"}},
+			{[]string{"--random-route"}, []string{"--random-route"}},
+			{[]string{"--route-path", "/api"}, []string{"--route-path", "/api"}},
+			{[]string{"-s", "cflinuxfs3"}, []string{"-s", "cflinuxfs3"}},
+			{[]string{"-p", "app-path"}, []string{"-p", "app-path"}},
+			{[]string{"--var", "a=b"}, []string{"--var", "a=b"}},
+			{[]string{"--vars-file", "vars.yml"}, []string{"--vars-file", "vars.yml"}},
+		}
+
+		for _, mapping := range mappings {
+			mapping := mapping
+
+			It("forwards "+mapping.args[0]+" to cf push", func() {
+				args := append([]string{"zero-downtime-push", "appname", "-f", "manifest-path"}, mapping.args...)
+
+				opts, err := ParseArgs(args)
+				Expect(err).ToNot(HaveOccurred())
+
+				expected := append([]string{"push", "appname", "-f", "manifest-path", "--no-start"}, mapping.pushArgs...)
+				Expect(opts.PushArgs()).To(Equal(expected))
+			})
+		}
+	})
+
+	Describe("deploying a droplet", func() {
+		It("passes a droplet tarball to cf push", func() {
+			opts, err := ParseArgs([]string{"zero-downtime-push", "appname", "-f", "manifest-path", "--droplet", "droplet.tgz"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.PushArgs()).To(Equal([]string{"push", "appname", "-f", "manifest-path", "--no-start", "--droplet", "droplet.tgz"}))
+		})
+
+		It("copies a droplet given by GUID rather than passing it to cf push", func() {
+			opts, err := ParseArgs([]string{"zero-downtime-push", "appname", "-f", "manifest-path", "--droplet", "8a9b6c2e-1f3d-4e5a-9b7c-0d1e2f3a4b5c"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.Droplet).To(Equal("8a9b6c2e-1f3d-4e5a-9b7c-0d1e2f3a4b5c"))
+			Expect(opts.PushArgs()).To(Equal([]string{"push", "appname", "-f", "manifest-path", "--no-start"}))
+		})
+
+		It("rejects a droplet with an app path", func() {
+			_, err := ParseArgs([]string{"zero-downtime-push", "appname", "-f", "manifest-path", "--droplet", "droplet.tgz", "-p", "app-path"})
+			Expect(err).To(MatchError(ErrDropletWithAppPath))
+
+			_, err = ParseArgs([]string{"zero-downtime-push", "appname", "-f", "manifest-path", "--droplet", "8a9b6c2e-1f3d-4e5a-9b7c-0d1e2f3a4b5c", "-p", "app-path"})
+			Expect(err).To(MatchError(ErrDropletWithAppPath))
+		})
+
+		It("rejects a droplet with a pre-cutover task", func() {
+			_, err := ParseArgs([]string{"zero-downtime-push", "appname", "-f", "manifest-path", "--droplet", "droplet.tgz", "--pre-cutover-task", "rake db:migrate"})
+			Expect(err).To(MatchError(ErrPreCutoverTaskWithDroplet))
+		})
+	})
+
+	Describe("docker deployments", func() {
+		var oldPassword string
+
+		BeforeEach(func() {
+			oldPassword = os.Getenv("CF_DOCKER_PASSWORD")
+			os.Unsetenv("CF_DOCKER_PASSWORD")
+		})
+
+		AfterEach(func() {
+			os.Setenv("CF_DOCKER_PASSWORD", oldPassword)
+		})
+
+		It("reads the registry password from the environment", func() {
+			os.Setenv("CF_DOCKER_PASSWORD", "hunter2")
+
+			opts, err := ParseArgs([]string{
+				"zero-downtime-push", "appname",
+				"-f", "manifest-path",
+				"--docker-image", "registry.example.com:5000/org/image:1.2",
+				"--docker-username", "user",
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(opts.IsDocker()).To(BeTrue())
+			Expect(opts.DockerPassword).To(Equal("hunter2"))
+			Expect(opts.PushArgs()).To(Equal([]string{
+				"push", "appname",
+				"-f", "manifest-path",
+				"--no-start",
+				"--docker-image", "registry.example.com:5000/org/image:1.2",
+				"--docker-username", "user",
+			}))
+		})
+
+		It("requires a registry password when a username is given", func() {
+			_, err := ParseArgs([]string{
+				"zero-downtime-push", "appname",
+				"-f", "manifest-path",
+				"--docker-image", "org/image",
+				"--docker-username", "user",
+			})
+			Expect(err).To(MatchError(ErrDockerPasswordNotSet))
+		})
+
+		It("does not require a registry password for public images", func() {
+			_, err := ParseArgs([]string{
+				"zero-downtime-push", "appname",
+				"-f", "manifest-path",
+				"--docker-image", "org/image@sha256:" + strings.Repeat("a", 64),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("rejects malformed image references", func() {
+			for _, image := range []string{"Org/Image", "image:", "org//image", "image:tag with spaces"} {
+				_, err := ParseArgs([]string{
+					"zero-downtime-push", "appname",
+					"-f", "manifest-path",
+					"--docker-image", image,
+				})
+				Expect(err).To(HaveOccurred(), image)
+			}
+		})
+	})
+
+	Describe("validation", func() {
+		invalid := []struct {
+			description string
+			args        []string
+		}{
+			{"a docker image with an app path", []string{"--docker-image", "image", "-p", "path"}},
+			{"a docker image with a buildpack", []string{"--docker-image", "image", "-b", "buildpack"}},
+			{"a docker username without an image", []string{"--docker-username", "user"}},
+			{"no route with a hostname", []string{"--no-route", "--hostname", "www"}},
+			{"no route with a random route", []string{"--no-route", "--random-route"}},
+			{"a random route with a hostname", []string{"--random-route", "--hostname", "www"}},
+			{"a hostname with no hostname", []string{"--hostname", "www", "--no-hostname"}},
+			{"an unknown health check type", []string{"--health-check-type", "tcp"}},
+			{"an endpoint with a port health check", []string{"--health-check-type", "port", "--endpoint", "/health"}},
+			{"a non-numeric instance count", []string{"-i", "many"}},
+			{"a negative instance count", []string{"-i", "-1"}},
+			{"a zero timeout", []string{"-t", "0"}},
+			{"an invalid memory limit", []string{"-m", "lots"}},
+			{"an invalid disk limit", []string{"-k", "12"}},
+			{"a webhook that isn't a URL", []string{"--webhook", "example.com"}},
+			{"a slack webhook with an unsupported scheme", []string{"--slack-webhook", "ftp://example.com"}},
+			{"an org without a space", []string{"--org", "other-org"}},
+			{"an unknown report format", []string{"--report", "xml"}},
+			{"a StatsD address without a port", []string{"--statsd", "statsd.example.com"}},
+			{"a negative observation window", []string{"--observe", "-5m"}},
+			{"a 5xx increase over 1", []string{"--max-5xx-increase", "5"}},
+			{"a latency ratio under 1", []string{"--max-latency-ratio", "0.5"}},
+			{"an invalid error pattern", []string{"--error-pattern", "(unclosed"}},
+			{"an unknown lost routes policy", []string{"--lost-routes", "sometimes"}},
+			{"a droplet with a docker image", []string{"--droplet", "droplet.tgz", "--docker-image", "image"}},
+			{"a droplet with a buildpack", []string{"--droplet", "droplet.tgz", "-b", "buildpack"}},
+			{"an unknown flag", []string{"--no-such-flag"}},
+		}
+
+		for _, example := range invalid {
+			example := example
+
+			It("rejects "+example.description, func() {
+				args := append([]string{"zero-downtime-push", "appname", "-f", "manifest-path"}, example.args...)
+
+				_, err := ParseArgs(args)
+				Expect(err).To(HaveOccurred())
+			})
+		}
+	})
+
+	Describe("Preflight", func() {
+		var dir, manifestPath string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "autopilot-preflight")
+			Expect(err).ToNot(HaveOccurred())
+
+			manifestPath = filepath.Join(dir, "manifest.yml")
+			Expect(ioutil.WriteFile(manifestPath, []byte("applications: []"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("succeeds when the manifest and app path exist", func() {
+			opts := Options{ManifestPath: manifestPath, AppPath: dir}
+			Expect(opts.Preflight()).To(Succeed())
+		})
+
+		It("fails when the manifest is missing", func() {
+			opts := Options{ManifestPath: filepath.Join(dir, "missing.yml")}
+			Expect(opts.Preflight()).ToNot(Succeed())
+		})
+
+		It("fails when the app path is missing", func() {
+			opts := Options{ManifestPath: manifestPath, AppPath: filepath.Join(dir, "missing")}
+			Expect(opts.Preflight()).ToNot(Succeed())
+		})
+
+		It("fails when the droplet tarball is missing", func() {
+			opts := Options{ManifestPath: manifestPath, Droplet: filepath.Join(dir, "droplet.tgz")}
+			Expect(opts.Preflight()).To(MatchError(HavePrefix("cannot read droplet")))
+		})
+
+		It("skips the app path for docker deployments", func() {
+			opts := Options{ManifestPath: manifestPath, AppPath: filepath.Join(dir, "missing"), DockerImage: "org/image"}
+			Expect(opts.Preflight()).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,232 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/cli/cf/api/logs"
+	"code.cloudfoundry.org/cli/plugin"
+	"github.com/cloudfoundry/noaa/consumer"
+)
+
+type ApplicationRepo struct {
+	conn plugin.CliConnection
+}
+
+func NewApplicationRepo(conn plugin.CliConnection) *ApplicationRepo {
+	return &ApplicationRepo{
+		conn: conn,
+	}
+}
+
+// output is where progress that is not the output of a cf command is written:
+// the writer of the space being deployed to, or stderr so that it is kept out
+// of reports written to stdout.
+func (repo *ApplicationRepo) output() io.Writer {
+	if conn, ok := repo.conn.(*targetConnection); ok {
+		return conn.out
+	}
+	return os.Stderr
+}
+
+func (repo *ApplicationRepo) RenameApplication(oldName, newName string) error {
+	_, err := repo.conn.CliCommand("rename", oldName, newName)
+	return err
+}
+
+func (repo *ApplicationRepo) PushApplication(opts Options) error {
+	appName := opts.AppName
+
+	err := repo.push(opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.ShowLogs {
+		app, err := repo.GetAppMetadata(appName)
+		if err != nil {
+			return err
+		}
+
+		// skip STG messages as the cf tool already prints them
+		stop, err := repo.tailLogs(app.GUID, false)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	_, err = repo.conn.CliCommand("start", appName)
+	if err != nil {
+		// cf start stages the app too, so look at how far it got
+		if failed, _ := repo.latestBuildFailed(appName); failed {
+			return stagingError(err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// push pushes the application without starting it. Any endpoint for the http
+// health check is then set on the web process, as cf set-health-check does.
+func (repo *ApplicationRepo) push(opts Options) error {
+	_, err := repo.conn.CliCommand(opts.PushArgs()...)
+	if err != nil || opts.HealthCheckEndpoint == "" {
+		return err
+	}
+
+	app, err := repo.GetAppMetadata(opts.AppName)
+	if err != nil {
+		return err
+	}
+
+	process := struct {
+		GUID string `json:"guid"`
+	}{}
+	err = repo.curl("GET", fmt.Sprintf("/v3/apps/%s/processes/web", app.GUID), nil, &process)
+	if err != nil {
+		return err
+	}
+
+	return repo.curl("PATCH", "/v3/processes/"+process.GUID, map[string]interface{}{
+		"health_check": map[string]interface{}{
+			"type": "http",
+			"data": map[string]string{"endpoint": opts.HealthCheckEndpoint},
+		},
+	}, nil)
+}
+
+// latestBuildFailed returns whether the most recent attempt to stage the
+// app failed.
+func (repo *ApplicationRepo) latestBuildFailed(appName string) (bool, error) {
+	app, err := repo.GetAppMetadata(appName)
+	if err != nil {
+		return false, err
+	}
+
+	builds := struct {
+		Resources []v3Build `json:"resources"`
+	}{}
+	err = repo.curl("GET", fmt.Sprintf("/v3/builds?app_guids=%s&order_by=-created_at&per_page=1", app.GUID), nil, &builds)
+	if err != nil {
+		return false, err
+	}
+
+	return len(builds.Resources) > 0 && builds.Resources[0].State == "FAILED", nil
+}
+
+// tailLogs prints the logs of the application with appGUID to stderr until
+// the returned function is called.
+func (repo *ApplicationRepo) tailLogs(appGUID string, includeStaging bool) (func(), error) {
+	dopplerEndpoint, err := repo.conn.DopplerEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	token, err := repo.conn.AccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	cons := consumer.New(dopplerEndpoint, nil, nil)
+
+	messages, errors := cons.TailingLogs(appGUID, token)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		for {
+			select {
+			case m := <-messages:
+				if includeStaging || m.GetSourceType() != "STG" {
+					os.Stderr.WriteString(logs.NewNoaaLogMessage(m).ToLog(time.Local) + "\n")
+				}
+			case e := <-errors:
+				log.Println("error reading logs:", e)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		cons.Close()
+	}, nil
+}
+
+func (repo *ApplicationRepo) DeleteApplication(appName string) error {
+	_, err := repo.conn.CliCommand("delete", appName, "-f")
+	return err
+}
+
+func (repo *ApplicationRepo) ListApplications() error {
+	_, err := repo.conn.CliCommand("apps")
+	return err
+}
+
+type AppEntity struct {
+	GUID      string `json:"-"`
+	State     string `json:"state"`
+	Instances int    `json:"instances"`
+
+	// RunningInstances is only known once GetInstanceStats has been called.
+	RunningInstances int `json:"-"`
+}
+
+// Healthy returns true if the app is started and has at least one instance
+// running, so is worth keeping around to roll back to.
+func (app AppEntity) Healthy() bool {
+	return app.State == "STARTED" && app.RunningInstances > 0
+}
+
+var (
+	ErrAppNotFound = errors.New("application not found")
+)
+
+// GetAppMetadata returns metadata about an app with appName
+func (repo *ApplicationRepo) GetAppMetadata(appName string) (*AppEntity, error) {
+	space, err := repo.conn.GetCurrentSpace()
+	if err != nil {
+		return nil, err
+	}
+
+	path := fmt.Sprintf(`v2/apps?q=name:%s&q=space_guid:%s`, url.QueryEscape(appName), space.Guid)
+	result, err := repo.conn.CliCommandWithoutTerminalOutput("curl", path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	jsonResp := strings.Join(result, "")
+
+	output := struct {
+		Resources []struct {
+			Metadata struct {
+				GUID string `json:"guid"`
+			} `json:"metadata"`
+			Entity AppEntity `json:"entity"`
+		} `json:"resources"`
+	}{}
+	err = json.Unmarshal([]byte(jsonResp), &output)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(output.Resources) == 0 {
+		return nil, ErrAppNotFound
+	}
+
+	app := output.Resources[0].Entity
+	app.GUID = output.Resources[0].Metadata.GUID
+
+	return &app, nil
+}
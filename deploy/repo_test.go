@@ -1,61 +1,18 @@
-package main_test
+package deploy_test
 
 import (
 	"errors"
-	"testing"
 
 	"code.cloudfoundry.org/cli/plugin/pluginfakes"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
-	. "github.com/contraband/autopilot"
+	. "github.com/contraband/autopilot/deploy"
 
 	plugin_models "code.cloudfoundry.org/cli/plugin/models"
 )
 
-func TestAutopilot(t *testing.T) {
-	RegisterFailHandler(Fail)
-	RunSpecs(t, "Autopilot Suite")
-}
-
-var _ = Describe("Flag Parsing", func() {
-	It("parses a complete set of args", func() {
-		appName, manifestPath, appPath, stackName, vars, varsFiles, showLogs, err := ParseArgs(
-			[]string{
-				"zero-downtime-push",
-				"appname",
-				"-f", "manifest-path",
-				"-p", "app-path",
-				"-s", "stack-name",
-				"-var", "foo=bar",
-				"-var", "baz=bob",
-				"-vars-file", "vars.yml",
-			},
-		)
-		Expect(err).ToNot(HaveOccurred())
-
-		Expect(appName).To(Equal("appname"))
-		Expect(manifestPath).To(Equal("manifest-path"))
-		Expect(appPath).To(Equal("app-path"))
-		Expect(stackName).To(Equal("stack-name"))
-		Expect(vars).To(Equal([]string{"foo=bar", "baz=bob"}))
-		Expect(varsFiles).To(Equal([]string{"vars.yml"}))
-		Expect(showLogs).To(Equal(false))
-	})
-
-	It("requires a manifest", func() {
-		_, _, _, _, _, _, _, err := ParseArgs(
-			[]string{
-				"zero-downtime-push",
-				"appname",
-				"-p", "app-path",
-			},
-		)
-		Expect(err).To(MatchError(ErrNoManifest))
-	})
-})
-
 var _ = Describe("ApplicationRepo", func() {
 	var (
 		cliConn *pluginfakes.FakeCliConnection
@@ -107,7 +64,7 @@ var _ = Describe("ApplicationRepo", func() {
 
 		It("returns app data if the app exists", func() {
 			response := []string{
-				`{"resources":[{"entity":{"state":"STARTED"}}]}`,
+				`{"resources":[{"metadata":{"guid":"app-guid"},"entity":{"state":"STARTED","instances":3}}]}`,
 			}
 			spaceGUID := "4"
 
@@ -129,6 +86,9 @@ var _ = Describe("ApplicationRepo", func() {
 
 			Expect(err).ToNot(HaveOccurred())
 			Expect(result).ToNot(BeNil())
+			Expect(result.GUID).To(Equal("app-guid"))
+			Expect(result.State).To(Equal("STARTED"))
+			Expect(result.Instances).To(Equal(3))
 		})
 
 		It("URL encodes the application name", func() {
@@ -173,7 +133,11 @@ var _ = Describe("ApplicationRepo", func() {
 
 	Describe("PushApplication", func() {
 		It("pushes an application with both a manifest and a path", func() {
-			err := repo.PushApplication("appName", "/path/to/a/manifest.yml", "/path/to/the/app", "", []string{}, []string{}, false)
+			err := repo.PushApplication(Options{
+				AppName:      "appName",
+				ManifestPath: "/path/to/a/manifest.yml",
+				AppPath:      "/path/to/the/app",
+			})
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(cliConn.CliCommandCallCount()).To(Equal(2))
@@ -188,7 +152,10 @@ var _ = Describe("ApplicationRepo", func() {
 		})
 
 		It("pushes an application with only a manifest", func() {
-			err := repo.PushApplication("appName", "/path/to/a/manifest.yml", "", "", []string{}, []string{}, false)
+			err := repo.PushApplication(Options{
+				AppName:      "appName",
+				ManifestPath: "/path/to/a/manifest.yml",
+			})
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(cliConn.CliCommandCallCount()).To(Equal(2))
@@ -202,7 +169,12 @@ var _ = Describe("ApplicationRepo", func() {
 		})
 
 		It("pushes an application with a stack", func() {
-			err := repo.PushApplication("appName", "/path/to/a/manifest.yml", "/path/to/the/app", "stackName", []string{}, []string{}, false)
+			err := repo.PushApplication(Options{
+				AppName:      "appName",
+				ManifestPath: "/path/to/a/manifest.yml",
+				AppPath:      "/path/to/the/app",
+				StackName:    "stackName",
+			})
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(cliConn.CliCommandCallCount()).To(Equal(2))
@@ -218,7 +190,12 @@ var _ = Describe("ApplicationRepo", func() {
 		})
 
 		It("pushes an application with variables", func() {
-			err := repo.PushApplication("appName", "/path/to/a/manifest.yml", "", "", []string{"foo=bar", "baz=bob"}, []string{"vars.yml"}, false)
+			err := repo.PushApplication(Options{
+				AppName:      "appName",
+				ManifestPath: "/path/to/a/manifest.yml",
+				Vars:         []string{"foo=bar", "baz=bob"},
+				VarsFiles:    []string{"vars.yml"},
+			})
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(cliConn.CliCommandCallCount()).To(Equal(2))
@@ -237,7 +214,11 @@ var _ = Describe("ApplicationRepo", func() {
 		It("returns errors from the push", func() {
 			cliConn.CliCommandReturns([]string{}, errors.New("bad app"))
 
-			err := repo.PushApplication("appName", "/path/to/a/manifest.yml", "/path/to/the/app", "", []string{}, []string{}, false)
+			err := repo.PushApplication(Options{
+				AppName:      "appName",
+				ManifestPath: "/path/to/a/manifest.yml",
+				AppPath:      "/path/to/the/app",
+			})
 			Expect(err).To(MatchError("bad app"))
 		})
 	})
@@ -0,0 +1,196 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+)
+
+const (
+	// ReportTable reports on a deploy as a human readable table.
+	ReportTable = "table"
+	// ReportJSON reports on a deploy as a single line of JSON.
+	ReportJSON = "json"
+)
+
+var reportFormats = []string{ReportTable, ReportJSON}
+
+// Report summarises a successful deploy to a space: what is now running and
+// how long each step took to get there.
+type Report struct {
+	App        string `json:"app"`
+	Foundation string `json:"foundation,omitempty"`
+	Org        string `json:"org"`
+	Space      string `json:"space"`
+
+	GUID       string   `json:"guid"`
+	Droplet    string   `json:"droplet"`
+	Stack      string   `json:"stack"`
+	Buildpacks []string `json:"buildpacks"`
+
+	Instances        int      `json:"instances"`
+	RunningInstances int      `json:"running_instances"`
+	Routes           []string `json:"routes"`
+	MemoryMB         int      `json:"memory_mb"`
+	DiskMB           int      `json:"disk_mb"`
+
+	// Replaced is the GUID of the app that was rolled over to the new
+	// version, if there was one. VenerableKept is set if it was left
+	// around rather than deleted.
+	Replaced      string `json:"replaced,omitempty"`
+	VenerableKept bool   `json:"venerable_kept,omitempty"`
+
+	Steps    []Step        `json:"steps"`
+	Duration time.Duration `json:"-"`
+}
+
+// Step is how long one step of a deploy took.
+type Step struct {
+	Name     string
+	Duration time.Duration
+}
+
+func (step Step) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name    string  `json:"name"`
+		Seconds float64 `json:"seconds"`
+	}{step.Name, step.Duration.Seconds()})
+}
+
+func (report Report) MarshalJSON() ([]byte, error) {
+	// the conversion drops this method so that the fields are marshalled
+	// as normal
+	type fields Report
+	return json.Marshal(struct {
+		fields
+		Seconds float64 `json:"seconds"`
+	}{fields(report), report.Duration.Seconds()})
+}
+
+// Target describes where the app was deployed to.
+func (report Report) Target() string {
+	if report.Foundation != "" {
+		return fmt.Sprintf("%s (%s/%s)", report.Foundation, report.Org, report.Space)
+	}
+	return fmt.Sprintf("%s/%s", report.Org, report.Space)
+}
+
+// Write writes the report to w in the given format.
+func (report Report) Write(w io.Writer, format string) error {
+	if format == ReportJSON {
+		return json.NewEncoder(w).Encode(report)
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 3, ' ', 0)
+	fmt.Fprintf(table, "app:\t%s\n", report.App)
+	fmt.Fprintf(table, "space:\t%s\n", report.Target())
+	fmt.Fprintf(table, "droplet:\t%s\n", report.Droplet)
+	fmt.Fprintf(table, "stack:\t%s\n", report.Stack)
+	fmt.Fprintf(table, "buildpacks:\t%s\n", strings.Join(report.Buildpacks, ", "))
+	fmt.Fprintf(table, "instances:\t%d/%d running\n", report.RunningInstances, report.Instances)
+	fmt.Fprintf(table, "routes:\t%s\n", strings.Join(report.Routes, ", "))
+	fmt.Fprintf(table, "memory:\t%s\n", bytefmt.ByteSize(uint64(report.MemoryMB)*bytefmt.MEGABYTE))
+	fmt.Fprintf(table, "disk:\t%s\n", bytefmt.ByteSize(uint64(report.DiskMB)*bytefmt.MEGABYTE))
+	switch {
+	case report.Replaced == "":
+		fmt.Fprintf(table, "replaced:\tnothing\n")
+	case report.VenerableKept:
+		fmt.Fprintf(table, "replaced:\t%s (kept)\n", report.Replaced)
+	default:
+		fmt.Fprintf(table, "replaced:\t%s (deleted)\n", report.Replaced)
+	}
+	fmt.Fprintln(table)
+
+	fmt.Fprintln(table, "step\tduration")
+	for _, step := range report.Steps {
+		fmt.Fprintf(table, "%s\t%s\n", step.Name, roundDuration(step.Duration))
+	}
+	fmt.Fprintf(table, "total\t%s\n", roundDuration(report.Duration))
+
+	return table.Flush()
+}
+
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(100 * time.Millisecond)
+}
+
+// fillStatus fills in the report with the state of the deployed app.
+func (repo *ApplicationRepo) fillStatus(report *Report) error {
+	app, err := repo.GetAppMetadata(report.App)
+	if err != nil {
+		return err
+	}
+	report.GUID = app.GUID
+
+	droplet := struct {
+		GUID       string `json:"guid"`
+		Stack      string `json:"stack"`
+		Buildpacks []struct {
+			Name string `json:"name"`
+		} `json:"buildpacks"`
+	}{}
+	err = repo.curl("GET", fmt.Sprintf("/v3/apps/%s/droplets/current", app.GUID), nil, &droplet)
+	if err != nil {
+		return err
+	}
+	report.Droplet = droplet.GUID
+	report.Stack = droplet.Stack
+	report.Buildpacks = nil
+	for _, buildpack := range droplet.Buildpacks {
+		report.Buildpacks = append(report.Buildpacks, buildpack.Name)
+	}
+
+	process := struct {
+		Instances int `json:"instances"`
+		MemoryMB  int `json:"memory_in_mb"`
+		DiskMB    int `json:"disk_in_mb"`
+	}{}
+	err = repo.curl("GET", fmt.Sprintf("/v3/apps/%s/processes/web", app.GUID), nil, &process)
+	if err != nil {
+		return err
+	}
+	report.Instances = process.Instances
+	report.MemoryMB = process.MemoryMB
+	report.DiskMB = process.DiskMB
+
+	states, err := repo.instanceStates(app.GUID)
+	if err != nil {
+		return err
+	}
+	report.RunningInstances = 0
+	for _, state := range states {
+		if state == "RUNNING" {
+			report.RunningInstances++
+		}
+	}
+
+	report.Routes, err = repo.appRoutes(app.GUID)
+	return err
+}
+
+// appRoutes returns the URLs of the routes mapped to the app.
+func (repo *ApplicationRepo) appRoutes(appGUID string) ([]string, error) {
+	routes := struct {
+		Resources []struct {
+			URL string `json:"url"`
+		} `json:"resources"`
+	}{}
+	err := repo.curl("GET", fmt.Sprintf("/v3/apps/%s/routes", appGUID), nil, &routes)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []string
+	for _, route := range routes.Resources {
+		urls = append(urls, route.URL)
+	}
+	return urls, nil
+}
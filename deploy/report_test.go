@@ -0,0 +1,83 @@
+package deploy_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/contraband/autopilot/deploy"
+)
+
+var _ = Describe("Report", func() {
+	var report Report
+
+	BeforeEach(func() {
+		report = Report{
+			App:              "app",
+			Org:              "org",
+			Space:            "space",
+			GUID:             "app-guid",
+			Droplet:          "droplet-guid",
+			Stack:            "cflinuxfs3",
+			Buildpacks:       []string{"ruby_buildpack"},
+			Instances:        2,
+			RunningInstances: 2,
+			Routes:           []string{"app.example.com", "www.example.com"},
+			MemoryMB:         256,
+			DiskMB:           1024,
+			Replaced:         "old-guid",
+			Steps: []Step{
+				{Name: "stage candidate", Duration: 1500 * time.Millisecond},
+				{Name: "push", Duration: 250 * time.Millisecond},
+			},
+			Duration: 2 * time.Second,
+		}
+	})
+
+	It("writes a table", func() {
+		var out bytes.Buffer
+		Expect(report.Write(&out, ReportTable)).To(Succeed())
+
+		Expect(out.String()).To(Equal(`app:          app
+space:        org/space
+droplet:      droplet-guid
+stack:        cflinuxfs3
+buildpacks:   ruby_buildpack
+instances:    2/2 running
+routes:       app.example.com, www.example.com
+memory:       256M
+disk:         1G
+replaced:     old-guid (deleted)
+
+step              duration
+stage candidate   1.5s
+push              250ms
+total             2s
+`))
+	})
+
+	It("writes JSON", func() {
+		var out bytes.Buffer
+		Expect(report.Write(&out, ReportJSON)).To(Succeed())
+
+		var written map[string]interface{}
+		Expect(json.Unmarshal(out.Bytes(), &written)).To(Succeed())
+		Expect(written).To(HaveKeyWithValue("app", "app"))
+		Expect(written).To(HaveKeyWithValue("droplet", "droplet-guid"))
+		Expect(written).To(HaveKeyWithValue("running_instances", 2.0))
+		Expect(written).To(HaveKeyWithValue("replaced", "old-guid"))
+		Expect(written).To(HaveKeyWithValue("seconds", 2.0))
+		Expect(written["steps"]).To(Equal([]interface{}{
+			map[string]interface{}{"name": "stage candidate", "seconds": 1.5},
+			map[string]interface{}{"name": "push", "seconds": 0.25},
+		}))
+	})
+
+	It("names the foundation deployed to", func() {
+		report.Foundation = "eu"
+		Expect(report.Target()).To(Equal("eu (org/space)"))
+	})
+})
@@ -0,0 +1,604 @@
+package deploy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"code.cloudfoundry.org/cli/plugin"
+	plugin_models "code.cloudfoundry.org/cli/plugin/models"
+)
+
+var (
+	ErrStandaloneNoAPI         = errors.New("CF_API must be set to run autopilot on its own")
+	ErrStandaloneNoTarget      = errors.New("CF_ORG and CF_SPACE must be set to run autopilot on its own")
+	ErrStandaloneNoCredentials = errors.New("either CF_CLIENT_ID and CF_CLIENT_SECRET or CF_REFRESH_TOKEN must be set to run autopilot on its own")
+	ErrStandaloneNeedsCF       = errors.New("deploying to other spaces or foundations needs the cf CLI, so cannot be done when running autopilot on its own")
+	ErrStandaloneUnsupported   = errors.New("not supported in standalone mode")
+)
+
+// StandaloneConfig describes how to reach and log in to the Cloud Controller
+// when autopilot is run on its own rather than as a cf CLI plugin.
+type StandaloneConfig struct {
+	API               string
+	SkipSSLValidation bool
+
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+
+	Org   string
+	Space string
+}
+
+// StandaloneConfigFromEnv reads the standalone config from CF_* environment
+// variables.
+func StandaloneConfigFromEnv(getenv func(string) string) (StandaloneConfig, error) {
+	config := StandaloneConfig{
+		API:               strings.TrimSuffix(getenv("CF_API"), "/"),
+		SkipSSLValidation: getenv("CF_SKIP_SSL_VALIDATION") == "true",
+		ClientID:          getenv("CF_CLIENT_ID"),
+		ClientSecret:      getenv("CF_CLIENT_SECRET"),
+		RefreshToken:      getenv("CF_REFRESH_TOKEN"),
+		Org:               getenv("CF_ORG"),
+		Space:             getenv("CF_SPACE"),
+	}
+
+	if config.API == "" {
+		return StandaloneConfig{}, ErrStandaloneNoAPI
+	}
+	if !strings.HasPrefix(config.API, "http://") && !strings.HasPrefix(config.API, "https://") {
+		config.API = "https://" + config.API
+	}
+
+	if config.Org == "" || config.Space == "" {
+		return StandaloneConfig{}, ErrStandaloneNoTarget
+	}
+
+	if config.RefreshToken == "" && (config.ClientID == "" || config.ClientSecret == "") {
+		return StandaloneConfig{}, ErrStandaloneNoCredentials
+	}
+
+	return config, nil
+}
+
+// standaloneConnection talks to the Cloud Controller directly. It answers the
+// cf commands used during a deploy (curl, push, start, rename, delete and
+// apps) itself so that the deploy works the same as it does in the plugin.
+//
+// Only the calls made during a deploy are implemented; anything else returns
+// ErrStandaloneUnsupported.
+type standaloneConnection struct {
+	config StandaloneConfig
+	client *http.Client
+	out    io.Writer
+
+	tokenEndpoint   string
+	dopplerEndpoint string
+
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+	expires      time.Time
+
+	org   plugin_models.Organization
+	space plugin_models.Space
+
+	// startupTimeout is how long cf start waits for the app to run.
+	startupTimeout time.Duration
+}
+
+// NewStandaloneConnection returns a connection that talks to the Cloud
+// Controller directly, for use without the cf CLI. It logs in and looks up
+// the org and space to deploy to straight away.
+func NewStandaloneConnection(config StandaloneConfig, out io.Writer) (plugin.CliConnection, error) {
+	return newStandaloneConnection(config, out)
+}
+
+func newStandaloneConnection(config StandaloneConfig, out io.Writer) (*standaloneConnection, error) {
+	conn := &standaloneConnection{
+		config:       config,
+		client:       &http.Client{Timeout: 5 * time.Minute},
+		out:          out,
+		refreshToken: config.RefreshToken,
+	}
+
+	if config.SkipSSLValidation {
+		conn.client.Transport = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+
+	root := struct {
+		Links map[string]struct {
+			Href string `json:"href"`
+		} `json:"links"`
+	}{}
+	err := conn.getJSON(config.API+"/", &root)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach the Cloud Controller at %s: %s", config.API, err)
+	}
+
+	conn.tokenEndpoint = root.Links["uaa"].Href
+	if conn.tokenEndpoint == "" {
+		conn.tokenEndpoint = root.Links["login"].Href
+	}
+	if conn.tokenEndpoint == "" {
+		return nil, fmt.Errorf("the Cloud Controller at %s did not say where to log in", config.API)
+	}
+	conn.dopplerEndpoint = root.Links["logging"].Href
+
+	_, err = conn.AccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	conn.org, conn.space, err = ResolveTarget(conn, Target{Org: config.Org, Space: config.Space})
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (conn *standaloneConnection) getJSON(url string, result interface{}) error {
+	resp, err := conn.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// AccessToken returns a bearer token, fetching a new one from the UAA when
+// the current one is about to expire.
+func (conn *standaloneConnection) AccessToken() (string, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.accessToken != "" && time.Now().Before(conn.expires) {
+		return "bearer " + conn.accessToken, nil
+	}
+
+	form := url.Values{}
+	clientID, clientSecret := conn.config.ClientID, conn.config.ClientSecret
+	if conn.refreshToken != "" {
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", conn.refreshToken)
+		if clientID == "" {
+			// the client the cf CLI logs in with
+			clientID = "cf"
+		}
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+
+	req, err := http.NewRequest("POST", conn.tokenEndpoint+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(clientID, clientSecret)
+
+	resp, err := conn.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot log in: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("cannot log in: the UAA returned %s", resp.Status)
+	}
+
+	token := struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", fmt.Errorf("cannot log in: %s", err)
+	}
+
+	conn.accessToken = token.AccessToken
+	if token.RefreshToken != "" && conn.refreshToken != "" {
+		conn.refreshToken = token.RefreshToken
+	}
+	// refresh a little early so that a token doesn't expire mid-request
+	conn.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - 30*time.Second)
+
+	return "bearer " + conn.accessToken, nil
+}
+
+func (conn *standaloneConnection) expireToken() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.expires = time.Time{}
+}
+
+// request makes an authenticated Cloud Controller request. The path may be
+// relative to the API or, as with job links, absolute. A rejected token is
+// refreshed and the request tried again.
+func (conn *standaloneConnection) request(method, path, contentType string, body []byte) (*http.Response, []byte, error) {
+	return conn.streamRequest(method, path, contentType, func() io.Reader {
+		return bytes.NewReader(body)
+	})
+}
+
+// streamRequest makes a request with the body returned by newBody, which is
+// called again if the request has to be retried with a new token.
+func (conn *standaloneConnection) streamRequest(method, path, contentType string, newBody func() io.Reader) (*http.Response, []byte, error) {
+	target := path
+	if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+		target = conn.config.API + "/" + strings.TrimPrefix(path, "/")
+	}
+
+	for attempt := 0; ; attempt++ {
+		token, err := conn.AccessToken()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		req, err := http.NewRequest(method, target, newBody())
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Authorization", token)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+
+		resp, err := conn.client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			conn.expireToken()
+			continue
+		}
+
+		return resp, respBody, nil
+	}
+}
+
+// pollTimeout is how long to wait for work the Cloud Controller does in the
+// background, which is bounded by the startup timeout.
+func (conn *standaloneConnection) pollTimeout() time.Duration {
+	if conn.startupTimeout == 0 {
+		return defaultStartupTimeout
+	}
+	return conn.startupTimeout
+}
+
+// waitForJob polls an asynchronous Cloud Controller job until it finishes.
+// A job that takes longer than the startup timeout fails.
+func (conn *standaloneConnection) waitForJob(location string) error {
+	timeout := conn.pollTimeout()
+	deadline := time.Now().Add(timeout)
+
+	for {
+		_, body, err := conn.request("GET", location, "", nil)
+		if err != nil {
+			return err
+		}
+
+		job := struct {
+			State  string `json:"state"`
+			Errors []struct {
+				Detail string `json:"detail"`
+			} `json:"errors"`
+		}{}
+		err = json.Unmarshal(body, &job)
+		if err != nil {
+			return err
+		}
+
+		switch job.State {
+		case "COMPLETE":
+			return nil
+		case "FAILED":
+			if len(job.Errors) > 0 {
+				return fmt.Errorf("job failed: %s", job.Errors[0].Detail)
+			}
+			return errors.New("job failed")
+		}
+
+		if time.Now().After(deadline) {
+			return ErrStart{Err: fmt.Errorf("the Cloud Controller job did not finish within %s", timeout)}
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// asyncRequest makes a request that the Cloud Controller completes in the
+// background and waits for it to finish.
+func (conn *standaloneConnection) asyncRequest(method, path, contentType string, body []byte) error {
+	resp, respBody, err := conn.request(method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return conn.responseError(method, path, resp, respBody)
+	}
+
+	if location := resp.Header.Get("Location"); location != "" && resp.StatusCode == http.StatusAccepted {
+		return conn.waitForJob(location)
+	}
+
+	return nil
+}
+
+func (conn *standaloneConnection) responseError(method, path string, resp *http.Response, body []byte) error {
+	var apiErrors ccErrors
+	if json.Unmarshal(body, &apiErrors) == nil && len(apiErrors.Errors) > 0 {
+		return APIError{Method: method, Path: path, Code: apiErrors.Errors[0].Title, Detail: apiErrors.Errors[0].Detail}
+	}
+	return APIError{Method: method, Path: path, Detail: resp.Status}
+}
+
+func (conn *standaloneConnection) CliCommand(args ...string) ([]string, error) {
+	switch args[0] {
+	case "curl":
+		return conn.curl(args[1:])
+	case "push":
+		return nil, conn.push(args[1:])
+	case "start":
+		return nil, conn.start(args[1])
+	case "rename":
+		return nil, conn.rename(args[1], args[2])
+	case "delete":
+		return nil, conn.delete(args[1])
+	case "apps":
+		return nil, conn.apps()
+	}
+
+	return nil, fmt.Errorf("cf %s is not supported when running autopilot on its own", args[0])
+}
+
+func (conn *standaloneConnection) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	return conn.CliCommand(args...)
+}
+
+// curl answers cf curl, returning the response body whatever the status.
+func (conn *standaloneConnection) curl(args []string) ([]string, error) {
+	path := args[0]
+	method := "GET"
+	var body []byte
+
+	for i := 1; i+1 < len(args); i += 2 {
+		switch args[i] {
+		case "-X":
+			method = args[i+1]
+		case "-d":
+			body = []byte(args[i+1])
+		default:
+			return nil, fmt.Errorf("unsupported cf curl option %s", args[i])
+		}
+	}
+
+	contentType := ""
+	if body != nil {
+		contentType = "application/json"
+	}
+
+	_, respBody, err := conn.request(method, path, contentType, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{string(respBody)}, nil
+}
+
+func (conn *standaloneConnection) start(appName string) error {
+	repo := NewApplicationRepo(conn)
+
+	app, err := repo.GetAppMetadata(appName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(conn.out, "Starting app %s...\n", appName)
+
+	// apps pushed with a droplet have no package to stage
+	_, err = repo.stageLatestPackage(app, false, conn.startupTimeout)
+	if err != nil && err != ErrNoPackage {
+		return err
+	}
+
+	err = repo.curl("POST", fmt.Sprintf("/v3/apps/%s/actions/start", app.GUID), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return repo.waitForRunning(app.GUID, conn.startupTimeout)
+}
+
+func (conn *standaloneConnection) rename(oldName, newName string) error {
+	repo := NewApplicationRepo(conn)
+
+	app, err := repo.GetAppMetadata(oldName)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(conn.out, "Renaming app %s to %s...\n", oldName, newName)
+
+	return repo.curl("PATCH", "/v3/apps/"+app.GUID, map[string]string{"name": newName}, nil)
+}
+
+// delete deletes an app, waiting for it to be gone so that its name can be
+// used again straight away. Like cf delete -f, a missing app is not an error.
+func (conn *standaloneConnection) delete(appName string) error {
+	repo := NewApplicationRepo(conn)
+
+	app, err := repo.GetAppMetadata(appName)
+	if err == ErrAppNotFound {
+		fmt.Fprintf(conn.out, "App %s does not exist.\n", appName)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(conn.out, "Deleting app %s...\n", appName)
+
+	return conn.asyncRequest("DELETE", "/v3/apps/"+app.GUID, "", nil)
+}
+
+func (conn *standaloneConnection) apps() error {
+	repo := NewApplicationRepo(conn)
+
+	apps := struct {
+		Resources []struct {
+			Name  string `json:"name"`
+			State string `json:"state"`
+		} `json:"resources"`
+	}{}
+	err := repo.curl("GET", fmt.Sprintf("/v3/apps?space_guids=%s&order_by=name&per_page=5000", conn.space.Guid), nil, &apps)
+	if err != nil {
+		return err
+	}
+
+	table := tabwriter.NewWriter(conn.out, 0, 4, 3, ' ', 0)
+	fmt.Fprintln(table, "name\tstate")
+	for _, app := range apps.Resources {
+		fmt.Fprintf(table, "%s\t%s\n", app.Name, strings.ToLower(app.State))
+	}
+	return table.Flush()
+}
+
+func (conn *standaloneConnection) DopplerEndpoint() (string, error) {
+	return conn.dopplerEndpoint, nil
+}
+
+func (conn *standaloneConnection) GetCurrentOrg() (plugin_models.Organization, error) {
+	return conn.org, nil
+}
+
+func (conn *standaloneConnection) GetCurrentSpace() (plugin_models.Space, error) {
+	return conn.space, nil
+}
+
+func (conn *standaloneConnection) HasOrganization() (bool, error) {
+	return true, nil
+}
+
+func (conn *standaloneConnection) HasSpace() (bool, error) {
+	return true, nil
+}
+
+func (conn *standaloneConnection) ApiEndpoint() (string, error) {
+	return conn.config.API, nil
+}
+
+// Username returns the user the refresh token belongs to, or the client ID.
+func (conn *standaloneConnection) Username() (string, error) {
+	conn.mu.Lock()
+	token := conn.accessToken
+	conn.mu.Unlock()
+
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		claims := struct {
+			UserName string `json:"user_name"`
+		}{}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err == nil && json.Unmarshal(payload, &claims) == nil && claims.UserName != "" {
+			return claims.UserName, nil
+		}
+	}
+
+	return conn.config.ClientID, nil
+}
+
+func (conn *standaloneConnection) IsLoggedIn() (bool, error) {
+	return true, nil
+}
+
+func (conn *standaloneConnection) IsSSLDisabled() (bool, error) {
+	return conn.config.SkipSSLValidation, nil
+}
+
+func (conn *standaloneConnection) HasAPIEndpoint() (bool, error) {
+	return true, nil
+}
+
+func (conn *standaloneConnection) UserGuid() (string, error) {
+	return "", ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) UserEmail() (string, error) {
+	return "", ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) ApiVersion() (string, error) {
+	return "", ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) LoggregatorEndpoint() (string, error) {
+	return "", ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) GetApp(string) (plugin_models.GetAppModel, error) {
+	return plugin_models.GetAppModel{}, ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) GetApps() ([]plugin_models.GetAppsModel, error) {
+	return nil, ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) GetOrgs() ([]plugin_models.GetOrgs_Model, error) {
+	return nil, ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) GetSpaces() ([]plugin_models.GetSpaces_Model, error) {
+	return nil, ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) GetOrgUsers(string, ...string) ([]plugin_models.GetOrgUsers_Model, error) {
+	return nil, ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) GetSpaceUsers(string, string) ([]plugin_models.GetSpaceUsers_Model, error) {
+	return nil, ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) GetServices() ([]plugin_models.GetServices_Model, error) {
+	return nil, ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) GetService(string) (plugin_models.GetService_Model, error) {
+	return plugin_models.GetService_Model{}, ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) GetOrg(string) (plugin_models.GetOrg_Model, error) {
+	return plugin_models.GetOrg_Model{}, ErrStandaloneUnsupported
+}
+
+func (conn *standaloneConnection) GetSpace(string) (plugin_models.GetSpace_Model, error) {
+	return plugin_models.GetSpace_Model{}, ErrStandaloneUnsupported
+}
@@ -0,0 +1,592 @@
+package deploy
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// push answers the cf push commands built by Options.PushArgs: it applies
+// the manifest (with any flags on top) to the app and uploads a new package
+// without staging or starting it.
+func (conn *standaloneConnection) push(args []string) error {
+	opts := Options{AppName: args[0]}
+
+	var flagArgs []string
+	for _, arg := range args[1:] {
+		// always set by PushArgs; standalone pushes never start the app
+		if arg != "--no-start" {
+			flagArgs = append(flagArgs, arg)
+		}
+	}
+	err := parseFlags(flagArgs, &opts, true)
+	if err != nil {
+		return err
+	}
+	opts.DockerPassword = os.Getenv(DockerPasswordEnvVar)
+
+	fmt.Fprintf(conn.out, "Pushing app %s to %s/%s...\n", opts.AppName, conn.org.Name, conn.space.Name)
+
+	raw, err := readManifest(opts.ManifestPath, opts.Vars, opts.VarsFiles)
+	if err != nil {
+		return err
+	}
+
+	domain := ""
+	if !opts.NoRoute && !opts.RandomRoute && (opts.Hostname != "" || opts.NoHostname || opts.RoutePath != "") && opts.Domain == "" {
+		domain, err = conn.defaultDomain()
+		if err != nil {
+			return err
+		}
+	}
+
+	app, appPath, err := pushManifest(raw, opts, domain)
+	if err != nil {
+		return err
+	}
+	switch {
+	case opts.AppPath != "":
+		appPath = opts.AppPath
+	case appPath == "":
+		// cf push uploads the current directory when no path is given
+		appPath = "."
+	case !filepath.IsAbs(appPath):
+		appPath = filepath.Join(filepath.Dir(opts.ManifestPath), appPath)
+	}
+
+	repo := NewApplicationRepo(conn)
+
+	existing, err := repo.GetAppMetadata(opts.AppName)
+	if err == ErrAppNotFound {
+		existing, err = conn.createApp(opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	manifest, err := yaml.Marshal(map[string]interface{}{
+		"applications": []interface{}{app},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = conn.asyncRequest("POST", fmt.Sprintf("/v3/spaces/%s/actions/apply_manifest", conn.space.Guid), "application/x-yaml", manifest)
+	if err != nil {
+		return err
+	}
+
+	if opts.IsDocker() {
+		return conn.createDockerPackage(existing.GUID, opts)
+	}
+	if path := opts.dropletPath(); path != "" {
+		return conn.uploadDroplet(existing.GUID, path)
+	}
+	return conn.uploadPackage(existing.GUID, appPath)
+}
+
+// pushManifest returns the manifest entry for the app being pushed, with the
+// name and any flags applied to it, along with the path of its files.
+func pushManifest(raw []byte, opts Options, domain string) (map[interface{}]interface{}, string, error) {
+	manifest := struct {
+		Applications []map[interface{}]interface{} `yaml:"applications"`
+	}{}
+	err := yaml.Unmarshal(raw, &manifest)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var app map[interface{}]interface{}
+	switch len(manifest.Applications) {
+	case 0:
+		return nil, "", ErrNoArgs
+	case 1:
+		app = manifest.Applications[0]
+	default:
+		for _, candidate := range manifest.Applications {
+			if candidate["name"] == opts.AppName {
+				app = candidate
+			}
+		}
+		if app == nil {
+			return nil, "", ErrMultipleAppsInManifest
+		}
+	}
+
+	app["name"] = opts.AppName
+
+	// the files are uploaded separately rather than through the manifest
+	appPath, _ := app["path"].(string)
+	delete(app, "path")
+
+	setString := func(key, value string) {
+		if value != "" {
+			app[key] = value
+		}
+	}
+	setString("stack", opts.StackName)
+	setString("command", opts.Command)
+	setString("health-check-type", opts.HealthCheckType)
+
+	if len(opts.Buildpacks) > 0 {
+		delete(app, "buildpack")
+		app["buildpacks"] = opts.Buildpacks
+	}
+
+	if opts.Instances != "" {
+		app["instances"], _ = strconv.Atoi(opts.Instances)
+	}
+	if opts.Timeout != "" {
+		app["timeout"], _ = strconv.Atoi(opts.Timeout)
+	}
+
+	for key, value := range map[string]string{"memory": opts.Memory, "disk_quota": opts.DiskQuota} {
+		if value != "" {
+			megabytes, err := bytefmt.ToMegabytes(value)
+			if err != nil {
+				return nil, "", err
+			}
+			app[key] = fmt.Sprintf("%dM", megabytes)
+		}
+	}
+
+	if opts.IsDocker() {
+		docker := map[string]string{"image": opts.DockerImage}
+		if opts.DockerUsername != "" {
+			docker["username"] = opts.DockerUsername
+		}
+		app["docker"] = docker
+	}
+
+	switch {
+	case opts.NoRoute:
+		delete(app, "routes")
+		delete(app, "random-route")
+		app["no-route"] = true
+	case opts.RandomRoute:
+		delete(app, "routes")
+		app["random-route"] = true
+	case opts.Hostname != "" || opts.NoHostname || opts.Domain != "" || opts.RoutePath != "":
+		route := opts.Domain
+		if route == "" {
+			route = domain
+		}
+		if !opts.NoHostname {
+			hostname := opts.Hostname
+			if hostname == "" {
+				hostname = opts.AppName
+			}
+			route = hostname + "." + route
+		}
+		route += opts.RoutePath
+		app["routes"] = []map[string]string{{"route": route}}
+	}
+
+	return app, appPath, nil
+}
+
+func (conn *standaloneConnection) defaultDomain() (string, error) {
+	domain := struct {
+		Name string `json:"name"`
+	}{}
+	err := NewApplicationRepo(conn).curl("GET", fmt.Sprintf("/v3/organizations/%s/domains/default", conn.org.Guid), nil, &domain)
+	return domain.Name, err
+}
+
+func (conn *standaloneConnection) createApp(opts Options) (*AppEntity, error) {
+	body := map[string]interface{}{
+		"name": opts.AppName,
+		"relationships": map[string]interface{}{
+			"space": map[string]interface{}{
+				"data": map[string]string{"guid": conn.space.Guid},
+			},
+		},
+	}
+	if opts.IsDocker() {
+		body["lifecycle"] = map[string]interface{}{
+			"type": "docker",
+			"data": map[string]string{},
+		}
+	}
+
+	created := struct {
+		GUID  string `json:"guid"`
+		State string `json:"state"`
+	}{}
+	err := NewApplicationRepo(conn).curl("POST", "/v3/apps", body, &created)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AppEntity{GUID: created.GUID, State: created.State}, nil
+}
+
+func (conn *standaloneConnection) createDockerPackage(appGUID string, opts Options) error {
+	data := map[string]string{"image": opts.DockerImage}
+	if opts.DockerUsername != "" {
+		data["username"] = opts.DockerUsername
+		data["password"] = opts.DockerPassword
+	}
+
+	return NewApplicationRepo(conn).curl("POST", "/v3/packages", map[string]interface{}{
+		"type": "docker",
+		"data": data,
+		"relationships": map[string]interface{}{
+			"app": map[string]interface{}{
+				"data": map[string]string{"guid": appGUID},
+			},
+		},
+	}, nil)
+}
+
+// uploadPackage zips up the files at appPath as a new package for the app
+// and waits for the Cloud Controller to process it, for at most the startup
+// timeout.
+func (conn *standaloneConnection) uploadPackage(appGUID, appPath string) error {
+	repo := NewApplicationRepo(conn)
+	timeout := conn.pollTimeout()
+	deadline := time.Now().Add(timeout)
+
+	pkg := struct {
+		GUID  string `json:"guid"`
+		State string `json:"state"`
+	}{}
+	err := repo.curl("POST", "/v3/packages", map[string]interface{}{
+		"type": "bits",
+		"relationships": map[string]interface{}{
+			"app": map[string]interface{}{
+				"data": map[string]string{"guid": appGUID},
+			},
+		},
+	}, &pkg)
+	if err != nil {
+		return err
+	}
+
+	err = conn.upload(fmt.Sprintf("/v3/packages/%s/upload", pkg.GUID), "application.zip", map[string]string{"resources": "[]"}, func(bits io.Writer) error {
+		return zipApp(appPath, bits)
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		err = repo.curl("GET", "/v3/packages/"+pkg.GUID, nil, &pkg)
+		if err != nil {
+			return err
+		}
+
+		switch pkg.State {
+		case "READY":
+			return nil
+		case "FAILED", "EXPIRED":
+			return fmt.Errorf("uploading the application failed: package is %s", pkg.State)
+		}
+
+		if time.Now().After(deadline) {
+			return stagingTimeout("processing the package", timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// uploadDroplet uploads a droplet tarball to the app and makes it the app's
+// current droplet, as cf push --droplet does. Processing the droplet may take
+// at most the startup timeout.
+func (conn *standaloneConnection) uploadDroplet(appGUID, dropletPath string) error {
+	repo := NewApplicationRepo(conn)
+	timeout := conn.pollTimeout()
+	deadline := time.Now().Add(timeout)
+
+	tarball, err := os.Open(dropletPath)
+	if err != nil {
+		return err
+	}
+	defer tarball.Close()
+
+	var droplet v3Droplet
+	err = repo.curl("POST", "/v3/droplets", map[string]interface{}{
+		"relationships": map[string]interface{}{
+			"app": map[string]interface{}{
+				"data": map[string]string{"guid": appGUID},
+			},
+		},
+	}, &droplet)
+	if err != nil {
+		return err
+	}
+
+	err = conn.upload(fmt.Sprintf("/v3/droplets/%s/upload", droplet.GUID), filepath.Base(dropletPath), nil, func(bits io.Writer) error {
+		_, err := tarball.Seek(0, io.SeekStart)
+		if err == nil {
+			_, err = io.Copy(bits, tarball)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for droplet.State != "STAGED" {
+		if droplet.State == "FAILED" || droplet.State == "EXPIRED" {
+			return fmt.Errorf("uploading the droplet failed: %s", droplet.Error)
+		}
+
+		if time.Now().After(deadline) {
+			return stagingTimeout("processing the droplet", timeout)
+		}
+		time.Sleep(pollInterval)
+
+		err = repo.curl("GET", "/v3/droplets/"+droplet.GUID, nil, &droplet)
+		if err != nil {
+			return err
+		}
+	}
+
+	return repo.setCurrentDroplet(appGUID, droplet.GUID)
+}
+
+// upload streams a multipart form to path with the file written by write as
+// its bits, along with any other fields.
+func (conn *standaloneConnection) upload(path, fileName string, fields map[string]string, write func(io.Writer) error) error {
+	boundary := multipart.NewWriter(nil).Boundary()
+
+	newBody := func() io.Reader {
+		body, pipe := io.Pipe()
+		go func() {
+			form := multipart.NewWriter(pipe)
+			err := form.SetBoundary(boundary)
+			if err == nil {
+				err = writeForm(form, fileName, fields, write)
+			}
+			pipe.CloseWithError(err)
+		}()
+		return body
+	}
+
+	form := multipart.NewWriter(nil)
+	err := form.SetBoundary(boundary)
+	if err != nil {
+		return err
+	}
+
+	resp, respBody, err := conn.streamRequest("POST", path, form.FormDataContentType(), newBody)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return conn.responseError("POST", path, resp, respBody)
+	}
+	return nil
+}
+
+func writeForm(form *multipart.Writer, fileName string, fields map[string]string, write func(io.Writer) error) error {
+	bits, err := form.CreateFormFile("bits", fileName)
+	if err != nil {
+		return err
+	}
+	err = write(bits)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range fields {
+		err = form.WriteField(name, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return form.Close()
+}
+
+// zipApp writes the application at appPath to out as a zip, as cf push
+// uploads it. A zip file, such as a .jar or .war, is uploaded as it is and
+// any other file on its own.
+func zipApp(appPath string, out io.Writer) error {
+	info, err := os.Stat(appPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return zipDirectory(appPath, out)
+	}
+
+	if archive, err := zip.OpenReader(appPath); err == nil {
+		archive.Close()
+
+		file, err := os.Open(appPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(out, file)
+		return err
+	}
+
+	archive := zip.NewWriter(out)
+	err = addToZip(archive, appPath, info.Name(), info)
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// defaultIgnores are the files cf push never uploads.
+var defaultIgnores = []string{".cfignore", "/manifest.yml", ".gitignore", ".git", ".hg", ".svn", "_darcs", ".DS_Store"}
+
+// zipDirectory writes a zip of the files under dir, as cf push would upload
+// them, to out. Files matched by the .cfignore file in dir are left out, as
+// are version control directories.
+func zipDirectory(dir string, out io.Writer) error {
+	ignore, err := readCFIgnore(dir)
+	if err != nil {
+		return err
+	}
+
+	archive := zip.NewWriter(out)
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		name = filepath.ToSlash(name)
+
+		if ignore.ignores(name, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return addToZip(archive, path, name, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// addToZip adds the file or directory at path to the archive under name.
+func addToZip(archive *zip.Writer, path, name string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	} else {
+		header.Method = zip.Deflate
+	}
+
+	writer, err := archive.CreateHeader(header)
+	if err != nil || info.IsDir() {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+// cfIgnore is the list of patterns in a .cfignore file, which are written as
+// in a .gitignore file.
+type cfIgnore []ignorePattern
+
+type ignorePattern struct {
+	pattern  string
+	negated  bool
+	dirOnly  bool
+	anchored bool
+}
+
+// readCFIgnore reads the .cfignore file in dir, if there is one, on top of
+// the files that are never uploaded.
+func readCFIgnore(dir string) (cfIgnore, error) {
+	lines := append([]string(nil), defaultIgnores...)
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, ".cfignore"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lines = append(lines, strings.Split(string(raw), "\n")...)
+
+	var ignore cfIgnore
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p ignorePattern
+		if strings.HasPrefix(line, "!") {
+			p.negated = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		line = strings.TrimPrefix(line, "**/")
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		p.pattern = line
+		ignore = append(ignore, p)
+	}
+
+	return ignore, nil
+}
+
+// ignores returns whether the file or directory called name, relative to
+// the app's directory, should be left out. The last pattern that matches
+// wins.
+func (ignore cfIgnore) ignores(name string, isDir bool) bool {
+	ignored := false
+	for _, p := range ignore {
+		if p.matches(name, isDir) {
+			ignored = !p.negated
+		}
+	}
+	return ignored
+}
+
+func (p ignorePattern) matches(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+
+	if !p.anchored {
+		name = path.Base(name)
+	}
+	matched, _ := path.Match(p.pattern, name)
+	return matched
+}
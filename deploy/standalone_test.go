@@ -0,0 +1,451 @@
+package deploy
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var _ = Describe("StandaloneConfigFromEnv", func() {
+	var env map[string]string
+
+	BeforeEach(func() {
+		env = map[string]string{
+			"CF_API":           "api.example.com",
+			"CF_CLIENT_ID":     "deployer",
+			"CF_CLIENT_SECRET": "secret",
+			"CF_ORG":           "my-org",
+			"CF_SPACE":         "production",
+		}
+	})
+
+	getenv := func(name string) string {
+		return env[name]
+	}
+
+	It("reads the config from the environment", func() {
+		config, err := StandaloneConfigFromEnv(getenv)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(config).To(Equal(StandaloneConfig{
+			API:          "https://api.example.com",
+			ClientID:     "deployer",
+			ClientSecret: "secret",
+			Org:          "my-org",
+			Space:        "production",
+		}))
+	})
+
+	It("accepts a refresh token instead of client credentials", func() {
+		delete(env, "CF_CLIENT_ID")
+		delete(env, "CF_CLIENT_SECRET")
+		env["CF_REFRESH_TOKEN"] = "refresh"
+
+		config, err := StandaloneConfigFromEnv(getenv)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(config.RefreshToken).To(Equal("refresh"))
+	})
+
+	It("requires an API", func() {
+		delete(env, "CF_API")
+		_, err := StandaloneConfigFromEnv(getenv)
+		Expect(err).To(MatchError(ErrStandaloneNoAPI))
+	})
+
+	It("requires an org and space", func() {
+		delete(env, "CF_SPACE")
+		_, err := StandaloneConfigFromEnv(getenv)
+		Expect(err).To(MatchError(ErrStandaloneNoTarget))
+	})
+
+	It("requires credentials", func() {
+		delete(env, "CF_CLIENT_SECRET")
+		_, err := StandaloneConfigFromEnv(getenv)
+		Expect(err).To(MatchError(ErrStandaloneNoCredentials))
+	})
+})
+
+// fakeFoundation answers the Cloud Controller and UAA requests made by a
+// standalone connection.
+type fakeFoundation struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	tokens   int
+	requests []string
+	rejected bool
+	apps     map[string]string
+
+	// jobState is the state reported for jobs, COMPLETE if empty
+	jobState string
+}
+
+func newFakeFoundation() *fakeFoundation {
+	foundation := &fakeFoundation{apps: map[string]string{"app": "app-guid"}}
+	foundation.server = httptest.NewServer(http.HandlerFunc(foundation.serve))
+	return foundation
+}
+
+func (f *fakeFoundation) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/" {
+		fmt.Fprintf(w, `{"links":{"uaa":{"href":"%s/uaa"},"logging":{"href":"wss://doppler.example.com"}}}`, f.server.URL)
+		return
+	}
+
+	if r.URL.Path == "/uaa/oauth/token" {
+		user, secret, _ := r.BasicAuth()
+		if user != "deployer" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.tokens++
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3600}`, f.tokens)
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "bearer token-") {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	f.requests = append(f.requests, strings.TrimSpace(r.Method+" "+r.URL.RequestURI()+" "+string(body)))
+
+	// reject the first token once to check that it gets refreshed
+	if !f.rejected && r.URL.Path == "/v2/info" {
+		f.rejected = true
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/v2/organizations":
+		fmt.Fprint(w, `{"resources":[{"metadata":{"guid":"org-guid"}}]}`)
+	case r.URL.Path == "/v2/spaces":
+		fmt.Fprint(w, `{"resources":[{"metadata":{"guid":"space-guid"}}]}`)
+	case r.URL.Path == "/v2/apps":
+		name := strings.TrimPrefix(r.URL.Query()["q"][0], "name:")
+		if guid, ok := f.apps[name]; ok {
+			fmt.Fprintf(w, `{"resources":[{"metadata":{"guid":"%s"},"entity":{"state":"STARTED"}}]}`, guid)
+			return
+		}
+		fmt.Fprint(w, `{"resources":[]}`)
+	case r.Method == "DELETE" && r.URL.Path == "/v3/apps/app-guid":
+		w.Header().Set("Location", f.server.URL+"/v3/jobs/job-guid")
+		w.WriteHeader(http.StatusAccepted)
+	case r.URL.Path == "/v3/jobs/job-guid":
+		state := f.jobState
+		if state == "" {
+			state = "COMPLETE"
+		}
+		fmt.Fprintf(w, `{"state":"%s"}`, state)
+	default:
+		fmt.Fprint(w, `{}`)
+	}
+}
+
+var _ = Describe("standaloneConnection", func() {
+	var (
+		foundation *fakeFoundation
+		conn       *standaloneConnection
+		out        *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		foundation = newFakeFoundation()
+		out = &bytes.Buffer{}
+
+		var err error
+		conn, err = newStandaloneConnection(StandaloneConfig{
+			API:          foundation.server.URL,
+			ClientID:     "deployer",
+			ClientSecret: "secret",
+			Org:          "my-org",
+			Space:        "production",
+		}, out)
+		Expect(err).ToNot(HaveOccurred())
+
+		foundation.requests = nil
+	})
+
+	AfterEach(func() {
+		foundation.server.Close()
+	})
+
+	It("logs in and looks up the space", func() {
+		space, err := conn.GetCurrentSpace()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(space.Guid).To(Equal("space-guid"))
+
+		token, err := conn.AccessToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(token).To(Equal("bearer token-1"))
+
+		endpoint, err := conn.DopplerEndpoint()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(endpoint).To(Equal("wss://doppler.example.com"))
+
+		user, err := conn.Username()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(user).To(Equal("deployer"))
+	})
+
+	It("fails to log in with the wrong credentials", func() {
+		_, err := newStandaloneConnection(StandaloneConfig{
+			API:          foundation.server.URL,
+			ClientID:     "deployer",
+			ClientSecret: "wrong",
+			Org:          "my-org",
+			Space:        "production",
+		}, out)
+		Expect(err).To(MatchError(ContainSubstring("cannot log in")))
+	})
+
+	It("answers cf curl", func() {
+		output, err := conn.CliCommandWithoutTerminalOutput("curl", "/v3/apps/app-guid", "-X", "PATCH", "-d", `{"name":"new"}`)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(output).To(Equal([]string{"{}"}))
+		Expect(foundation.requests).To(Equal([]string{`PATCH /v3/apps/app-guid {"name":"new"}`}))
+	})
+
+	It("logs in again when the token is rejected", func() {
+		_, err := conn.CliCommandWithoutTerminalOutput("curl", "v2/info")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(foundation.tokens).To(Equal(2))
+		Expect(foundation.requests).To(Equal([]string{"GET /v2/info", "GET /v2/info"}))
+	})
+
+	It("renames apps", func() {
+		_, err := conn.CliCommand("rename", "app", "app-venerable")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(foundation.requests).To(ContainElement(`PATCH /v3/apps/app-guid {"name":"app-venerable"}`))
+	})
+
+	It("deletes apps and waits for them to be gone", func() {
+		_, err := conn.CliCommand("delete", "app", "-f")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(foundation.requests).To(ContainElement("DELETE /v3/apps/app-guid"))
+		Expect(foundation.requests[len(foundation.requests)-1]).To(Equal("GET /v3/jobs/job-guid"))
+	})
+
+	It("gives up on a job that doesn't finish in time", func() {
+		foundation.jobState = "PROCESSING"
+		conn.startupTimeout = time.Nanosecond
+
+		_, err := conn.CliCommand("delete", "app", "-f")
+		Expect(err).To(BeAssignableToTypeOf(ErrStart{}))
+		Expect(err).To(MatchError("the Cloud Controller job did not finish within 1ns"))
+	})
+
+	It("gives up on an upload that isn't processed in time", func() {
+		conn.startupTimeout = time.Nanosecond
+
+		dir, err := ioutil.TempDir("", "autopilot-upload")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "droplet.tgz"), []byte("droplet"), 0644)).To(Succeed())
+
+		err = conn.uploadPackage("app-guid", dir)
+		Expect(err).To(BeAssignableToTypeOf(ErrStaging{}))
+		Expect(err).To(MatchError("processing the package did not finish within 1ns"))
+
+		err = conn.uploadDroplet("app-guid", filepath.Join(dir, "droplet.tgz"))
+		Expect(err).To(BeAssignableToTypeOf(ErrStaging{}))
+		Expect(err).To(MatchError("processing the droplet did not finish within 1ns"))
+	})
+
+	It("ignores apps that don't exist when deleting", func() {
+		_, err := conn.CliCommand("delete", "missing", "-f")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(out.String()).To(ContainSubstring("App missing does not exist."))
+	})
+
+	It("rejects commands it does not know", func() {
+		_, err := conn.CliCommand("scale", "app", "-i", "2")
+		Expect(err).To(MatchError("cf scale is not supported when running autopilot on its own"))
+	})
+
+	It("rejects plugin calls it cannot answer", func() {
+		_, err := conn.GetApps()
+		Expect(err).To(MatchError(ErrStandaloneUnsupported))
+	})
+})
+
+var _ = Describe("pushManifest", func() {
+	const manifest = `
+applications:
+- name: app
+  path: dist
+  memory: 256M
+  buildpack: ruby_buildpack
+  routes:
+  - route: app.example.com
+`
+
+	parse := func(opts Options, domain string) map[string]interface{} {
+		app, _, err := pushManifest([]byte(manifest), opts, domain)
+		Expect(err).ToNot(HaveOccurred())
+
+		// round trip through yaml so that the result is easy to compare
+		raw, err := yaml.Marshal(app)
+		Expect(err).ToNot(HaveOccurred())
+		var result map[string]interface{}
+		Expect(yaml.Unmarshal(raw, &result)).To(Succeed())
+		return result
+	}
+
+	It("names the app and returns its path", func() {
+		app, path, err := pushManifest([]byte(manifest), Options{AppName: "app-candidate"}, "")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(app["name"]).To(Equal("app-candidate"))
+		Expect(app).ToNot(HaveKey("path"))
+		Expect(path).To(Equal("dist"))
+	})
+
+	It("applies flags over the manifest", func() {
+		app := parse(Options{AppName: "app", Memory: "1G", Instances: "3", Buildpacks: []string{"nodejs_buildpack", "go_buildpack"}, Command: "./run"}, "")
+
+		Expect(app["memory"]).To(Equal("1024M"))
+		Expect(app["instances"]).To(Equal(3))
+		Expect(app["buildpacks"]).To(Equal([]interface{}{"nodejs_buildpack", "go_buildpack"}))
+		Expect(app).ToNot(HaveKey("buildpack"))
+		Expect(app["command"]).To(Equal("./run"))
+	})
+
+	It("removes the routes of an app pushed without a route", func() {
+		app := parse(Options{AppName: "app-candidate", NoRoute: true}, "")
+
+		Expect(app).ToNot(HaveKey("routes"))
+		Expect(app["no-route"]).To(BeTrue())
+	})
+
+	It("builds a route from the route flags", func() {
+		app := parse(Options{AppName: "app", Hostname: "www", RoutePath: "/shop"}, "apps.example.com")
+
+		Expect(app["routes"]).To(Equal([]interface{}{map[interface{}]interface{}{"route": "www.apps.example.com/shop"}}))
+	})
+
+	It("picks the named app from a manifest with several apps", func() {
+		app, _, err := pushManifest([]byte("applications:\n- name: web\n- name: worker\n  memory: 1G\n"), Options{AppName: "worker"}, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(app["memory"]).To(Equal("1G"))
+	})
+})
+
+var _ = Describe("zipDirectory", func() {
+	It("zips the files but not version control directories", func() {
+		dir, err := ioutil.TempDir("", "autopilot-zip")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		Expect(os.MkdirAll(filepath.Join(dir, "lib"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(dir, ".git"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "app.rb"), []byte("puts 'hi'"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "lib", "util.rb"), []byte(""), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte(""), 0644)).To(Succeed())
+
+		var archive bytes.Buffer
+		Expect(zipDirectory(dir, &archive)).To(Succeed())
+
+		reader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+		Expect(err).ToNot(HaveOccurred())
+
+		var names []string
+		for _, file := range reader.File {
+			names = append(names, file.Name)
+		}
+		sort.Strings(names)
+		Expect(names).To(Equal([]string{"app.rb", "lib/", "lib/util.rb"}))
+	})
+
+	It("leaves out the files listed in .cfignore", func() {
+		dir, err := ioutil.TempDir("", "autopilot-zip")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(dir)
+
+		Expect(os.MkdirAll(filepath.Join(dir, "tmp"), 0755)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(dir, "logs"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, ".cfignore"), []byte("*.log\ntmp/\n!keep.log\n"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "manifest.yml"), []byte(""), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "app.rb"), []byte(""), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "keep.log"), []byte(""), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "logs", "app.log"), []byte(""), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "tmp", "cache"), []byte(""), 0644)).To(Succeed())
+
+		var archive bytes.Buffer
+		Expect(zipDirectory(dir, &archive)).To(Succeed())
+		Expect(zipNames(archive)).To(Equal([]string{"app.rb", "keep.log", "logs/"}))
+	})
+})
+
+var _ = Describe("zipApp", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "autopilot-zip")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("uploads an archive as it is", func() {
+		var jar bytes.Buffer
+		writer := zip.NewWriter(&jar)
+		_, err := writer.Create("META-INF/MANIFEST.MF")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+
+		jarPath := filepath.Join(dir, "app.jar")
+		Expect(ioutil.WriteFile(jarPath, jar.Bytes(), 0644)).To(Succeed())
+
+		var archive bytes.Buffer
+		Expect(zipApp(jarPath, &archive)).To(Succeed())
+		Expect(archive.Bytes()).To(Equal(jar.Bytes()))
+	})
+
+	It("zips a single file on its own", func() {
+		binPath := filepath.Join(dir, "server")
+		Expect(ioutil.WriteFile(binPath, []byte("#!/bin/sh"), 0755)).To(Succeed())
+
+		var archive bytes.Buffer
+		Expect(zipApp(binPath, &archive)).To(Succeed())
+		Expect(zipNames(archive)).To(Equal([]string{"server"}))
+	})
+})
+
+func zipNames(archive bytes.Buffer) []string {
+	reader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	Expect(err).ToNot(HaveOccurred())
+
+	var names []string
+	for _, file := range reader.File {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,360 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"code.cloudfoundry.org/cli/plugin"
+	plugin_models "code.cloudfoundry.org/cli/plugin/models"
+)
+
+var (
+	ErrOrgWithoutSpace = errors.New("--org can only be used with --space")
+)
+
+// Target is an org and space to deploy to. A blank org means the currently
+// targeted org.
+type Target struct {
+	Org   string `yaml:"org"`
+	Space string `yaml:"space"`
+}
+
+func (t Target) String() string {
+	return fmt.Sprintf("%s/%s", t.Org, t.Space)
+}
+
+// ResolveTarget looks up the GUIDs of a target's org and space.
+func ResolveTarget(conn plugin.CliConnection, target Target) (plugin_models.Organization, plugin_models.Space, error) {
+	repo := NewApplicationRepo(conn)
+
+	lookup := struct {
+		Resources []struct {
+			Metadata struct {
+				GUID string `json:"guid"`
+			} `json:"metadata"`
+		} `json:"resources"`
+	}{}
+
+	err := repo.curl("GET", "/v2/organizations?q=name:"+url.QueryEscape(target.Org), nil, &lookup)
+	if err != nil {
+		return plugin_models.Organization{}, plugin_models.Space{}, err
+	}
+	if len(lookup.Resources) == 0 {
+		return plugin_models.Organization{}, plugin_models.Space{}, fmt.Errorf("org %s not found", target.Org)
+	}
+
+	var org plugin_models.Organization
+	org.Guid = lookup.Resources[0].Metadata.GUID
+	org.Name = target.Org
+
+	err = repo.curl("GET", fmt.Sprintf("/v2/spaces?q=name:%s&q=organization_guid:%s", url.QueryEscape(target.Space), org.Guid), nil, &lookup)
+	if err != nil {
+		return plugin_models.Organization{}, plugin_models.Space{}, err
+	}
+	if len(lookup.Resources) == 0 {
+		return plugin_models.Organization{}, plugin_models.Space{}, fmt.Errorf("space %s not found in org %s", target.Space, target.Org)
+	}
+
+	var space plugin_models.Space
+	space.Guid = lookup.Resources[0].Metadata.GUID
+	space.Name = target.Space
+
+	return org, space, nil
+}
+
+// cfBinary is the cf CLI that is run to deploy to other spaces.
+var cfBinary = "cf"
+
+// deployToTargets deploys to each target in turn, stopping at the first
+// failure, or to all of them at once if opts.Parallel is set.
+func (d *Deployer) deployToTargets(opts Options, targets []Target) error {
+	currentOrg, err := d.conn.GetCurrentOrg()
+	if err != nil {
+		return err
+	}
+
+	// the targets are copied so that filling in the current org doesn't
+	// change the caller's slice
+	targets = append([]Target(nil), targets...)
+
+	// every target is looked up before anything is deployed so that a typo
+	// doesn't leave a deploy half done
+	orgs := make([]plugin_models.Organization, len(targets))
+	spaces := make([]plugin_models.Space, len(targets))
+	for i, target := range targets {
+		if target.Org == "" {
+			targets[i].Org = currentOrg.Name
+		}
+		orgs[i], spaces[i], err = ResolveTarget(d.conn, targets[i])
+		if err != nil {
+			return ErrPreflight{Err: err}
+		}
+	}
+
+	if !opts.Parallel {
+		for i, target := range targets {
+			fmt.Printf("Deploying %s to %s...\n", opts.AppName, target)
+			err = d.deployToTarget(opts, orgs[i], spaces[i], os.Stdout)
+			if err != nil {
+				return ErrTargetFailed{Target: target.String(), Err: err}
+			}
+		}
+		return nil
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed []ErrTargetFailed
+	)
+	errs := make([]error, len(targets))
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target Target) {
+			defer wg.Done()
+			out := newPrefixWriter(&mu, os.Stdout, fmt.Sprintf("[%s] ", target))
+			errs[i] = d.deployToTarget(opts, orgs[i], spaces[i], out)
+		}(i, target)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, ErrTargetFailed{Target: targets[i].String(), Err: err})
+		}
+	}
+	if len(failed) > 0 {
+		return ErrTargetsFailed{Failures: failed, Total: len(targets)}
+	}
+
+	return nil
+}
+
+func (d *Deployer) deployToTarget(opts Options, org plugin_models.Organization, space plugin_models.Space, out io.Writer) error {
+	targetConn, err := newTargetConnection(d.conn, cfBinary, org, space, out)
+	if err != nil {
+		return ErrPreflight{Err: err}
+	}
+	defer targetConn.Close()
+
+	return d.deployTo(targetConn, opts)
+}
+
+// targetConnection runs cf commands against a space other than the one the
+// user has targeted. It runs cf as a separate process with its own copy of
+// the user's cf config so that the user's target is never changed and several
+// spaces can be deployed to at once.
+//
+// Only the calls made during a deploy are redirected; anything else is
+// answered by the wrapped connection.
+type targetConnection struct {
+	plugin.CliConnection
+
+	cfPath string
+	cfHome string
+	out    io.Writer
+
+	foundation string
+	username   string
+	org        plugin_models.Organization
+	space      plugin_models.Space
+}
+
+// newTargetConnection creates a connection targeted at org and space. The
+// returned connection must be closed to clean up its copy of the cf config.
+func newTargetConnection(conn plugin.CliConnection, cfPath string, org plugin_models.Organization, space plugin_models.Space, out io.Writer) (*targetConnection, error) {
+	target, err := newIsolatedConnection(conn, cfPath, out)
+	if err != nil {
+		return nil, err
+	}
+	target.org = org
+	target.space = space
+
+	err = copyCFConfig(filepath.Join(target.cfHome, ".cf"))
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+
+	_, err = target.CliCommandWithoutTerminalOutput("target", "-o", org.Name, "-s", space.Name)
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+
+	return target, nil
+}
+
+// newIsolatedConnection creates a connection with an empty cf config of its
+// own.
+func newIsolatedConnection(conn plugin.CliConnection, cfPath string, out io.Writer) (*targetConnection, error) {
+	cfHome, err := ioutil.TempDir("", "autopilot-cf-home")
+	if err != nil {
+		return nil, err
+	}
+
+	return &targetConnection{
+		CliConnection: conn,
+		cfPath:        cfPath,
+		cfHome:        cfHome,
+		out:           out,
+	}, nil
+}
+
+func (conn *targetConnection) Close() error {
+	return os.RemoveAll(conn.cfHome)
+}
+
+func (conn *targetConnection) run(stdout io.Writer, env []string, args ...string) ([]string, error) {
+	var output, stderr bytes.Buffer
+
+	cmd := exec.Command(conn.cfPath, args...)
+	cmd.Env = append(append(os.Environ(), "CF_HOME="+conn.cfHome), env...)
+	cmd.Stdout = io.MultiWriter(stdout, &output)
+	cmd.Stderr = io.MultiWriter(stdout, &stderr)
+
+	err := cmd.Run()
+	lines := strings.Split(strings.TrimRight(output.String(), "\n"), "\n")
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return lines, fmt.Errorf("cf %s failed in %s: %s", args[0], conn.description(), message)
+		}
+		return lines, fmt.Errorf("cf %s failed in %s: %s", args[0], conn.description(), err)
+	}
+
+	return lines, nil
+}
+
+func (conn *targetConnection) description() string {
+	if conn.foundation != "" {
+		return fmt.Sprintf("%s (%s/%s)", conn.foundation, conn.org.Name, conn.space.Name)
+	}
+	return fmt.Sprintf("%s/%s", conn.org.Name, conn.space.Name)
+}
+
+func (conn *targetConnection) CliCommand(args ...string) ([]string, error) {
+	return conn.run(conn.out, nil, args...)
+}
+
+func (conn *targetConnection) CliCommandWithoutTerminalOutput(args ...string) ([]string, error) {
+	return conn.run(ioutil.Discard, nil, args...)
+}
+
+func (conn *targetConnection) AccessToken() (string, error) {
+	output, err := conn.CliCommandWithoutTerminalOutput("oauth-token")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output[len(output)-1]), nil
+}
+
+func (conn *targetConnection) DopplerEndpoint() (string, error) {
+	raw, err := ioutil.ReadFile(filepath.Join(conn.cfHome, ".cf", "config.json"))
+	if err != nil {
+		return "", err
+	}
+
+	config := struct {
+		DopplerEndPoint string
+	}{}
+	err = json.Unmarshal(raw, &config)
+	if err != nil {
+		return "", err
+	}
+
+	return config.DopplerEndPoint, nil
+}
+
+func (conn *targetConnection) Username() (string, error) {
+	if conn.username != "" {
+		return conn.username, nil
+	}
+	return conn.CliConnection.Username()
+}
+
+func (conn *targetConnection) GetCurrentOrg() (plugin_models.Organization, error) {
+	return conn.org, nil
+}
+
+func (conn *targetConnection) GetCurrentSpace() (plugin_models.Space, error) {
+	return conn.space, nil
+}
+
+func (conn *targetConnection) HasOrganization() (bool, error) {
+	return true, nil
+}
+
+func (conn *targetConnection) HasSpace() (bool, error) {
+	return true, nil
+}
+
+// copyCFConfig copies the user's cf config, which holds their API endpoint
+// and tokens, into dir.
+func copyCFConfig(dir string) error {
+	home := os.Getenv("CF_HOME")
+	if home == "" {
+		var err error
+		home, err = os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+	}
+
+	config, err := ioutil.ReadFile(filepath.Join(home, ".cf", "config.json"))
+	if err != nil {
+		return fmt.Errorf("cannot read cf config: %s", err)
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, "config.json"), config, 0600)
+}
+
+// prefixWriter prefixes each line written to it so that the output of
+// parallel deploys can be told apart.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func newPrefixWriter(mu *sync.Mutex, out io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{mu: mu, out: out, prefix: prefix}
+}
+
+// Write is safe to call from several goroutines, such as those copying the
+// stdout and stderr of a cf command.
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+
+		_, err := fmt.Fprintf(w.out, "%s%s\n", w.prefix, w.buf[:i])
+		if err != nil {
+			return 0, err
+		}
+
+		w.buf = w.buf[i+1:]
+	}
+}
@@ -0,0 +1,221 @@
+package deploy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	plugin_models "code.cloudfoundry.org/cli/plugin/models"
+	"code.cloudfoundry.org/cli/plugin/pluginfakes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// fakeCF is a cf script that records the CF_HOME, arguments and any
+// credentials it was run with and fails when asked to delete anything.
+const fakeCF = `#!/bin/sh
+echo "$CF_HOME $*${CF_USERNAME:+ with $CF_USERNAME:$CF_PASSWORD}" >> "$FAKE_CF_LOG"
+if [ "$1" = "delete" ]; then
+  echo "delete is not allowed" >&2
+  exit 1
+fi
+echo "ran $1"
+`
+
+var _ = Describe("ResolveTarget", func() {
+	var cliConn *pluginfakes.FakeCliConnection
+
+	BeforeEach(func() {
+		cliConn = &pluginfakes.FakeCliConnection{}
+		cliConn.CliCommandWithoutTerminalOutputStub = func(args ...string) ([]string, error) {
+			switch {
+			case strings.HasPrefix(args[1], "/v2/organizations?q=name:other-org"):
+				return []string{`{"resources":[{"metadata":{"guid":"org-guid"}}]}`}, nil
+			case args[1] == "/v2/spaces?q=name:staging&q=organization_guid:org-guid":
+				return []string{`{"resources":[{"metadata":{"guid":"space-guid"}}]}`}, nil
+			}
+			return []string{`{"resources":[]}`}, nil
+		}
+	})
+
+	It("looks up the org and space", func() {
+		org, space, err := ResolveTarget(cliConn, Target{Org: "other-org", Space: "staging"})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(org.Guid).To(Equal("org-guid"))
+		Expect(org.Name).To(Equal("other-org"))
+		Expect(space.Guid).To(Equal("space-guid"))
+		Expect(space.Name).To(Equal("staging"))
+	})
+
+	It("errors if the org does not exist", func() {
+		_, _, err := ResolveTarget(cliConn, Target{Org: "missing", Space: "staging"})
+		Expect(err).To(MatchError("org missing not found"))
+	})
+
+	It("errors if the space does not exist", func() {
+		_, _, err := ResolveTarget(cliConn, Target{Org: "other-org", Space: "missing"})
+		Expect(err).To(MatchError("space missing not found in org other-org"))
+	})
+
+	It("leaves the caller's targets alone when filling in the current org", func() {
+		org := plugin_models.Organization{}
+		org.Name = "other-org"
+		cliConn.GetCurrentOrgReturns(org, nil)
+
+		targets := []Target{{Space: "missing"}}
+		err := (&Deployer{conn: cliConn}).deployToTargets(Options{AppName: "app"}, targets)
+		Expect(err).To(MatchError("space missing not found in org other-org"))
+
+		Expect(targets).To(Equal([]Target{{Space: "missing"}}))
+	})
+})
+
+var _ = Describe("targetConnection", func() {
+	var (
+		dir     string
+		cfPath  string
+		logPath string
+		out     *bytes.Buffer
+		conn    *targetConnection
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "autopilot-targets")
+		Expect(err).ToNot(HaveOccurred())
+
+		cfPath = filepath.Join(dir, "cf")
+		Expect(ioutil.WriteFile(cfPath, []byte(fakeCF), 0755)).To(Succeed())
+
+		userHome := filepath.Join(dir, "home")
+		Expect(os.MkdirAll(filepath.Join(userHome, ".cf"), 0700)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(userHome, ".cf", "config.json"), []byte(`{"Target":"https://api.example.com"}`), 0600)).To(Succeed())
+
+		logPath = filepath.Join(dir, "cf.log")
+		os.Setenv("FAKE_CF_LOG", logPath)
+		os.Setenv("CF_HOME", userHome)
+
+		out = &bytes.Buffer{}
+		org := plugin_models.Organization{}
+		org.Name = "other-org"
+		space := plugin_models.Space{}
+		space.Name = "staging"
+		space.Guid = "space-guid"
+
+		conn, err = newTargetConnection(&pluginfakes.FakeCliConnection{}, cfPath, org, space, out)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		os.Unsetenv("FAKE_CF_LOG")
+		os.Unsetenv("CF_HOME")
+		os.RemoveAll(dir)
+	})
+
+	commands := func() []string {
+		log, err := ioutil.ReadFile(logPath)
+		Expect(err).ToNot(HaveOccurred())
+		return strings.Split(strings.TrimSpace(string(log)), "\n")
+	}
+
+	It("targets the space using a copy of the user's cf config", func() {
+		Expect(commands()).To(Equal([]string{conn.cfHome + " target -o other-org -s staging"}))
+
+		config, err := ioutil.ReadFile(filepath.Join(conn.cfHome, ".cf", "config.json"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(config)).To(ContainSubstring("api.example.com"))
+	})
+
+	It("runs commands in the targeted space", func() {
+		output, err := conn.CliCommand("push", "app")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(output).To(Equal([]string{"ran push"}))
+		Expect(out.String()).To(Equal("ran push\n"))
+		Expect(commands()).To(ContainElement(conn.cfHome + " push app"))
+	})
+
+	It("hides the output of commands run without terminal output", func() {
+		output, err := conn.CliCommandWithoutTerminalOutput("curl", "/v2/info")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(output).To(Equal([]string{"ran curl"}))
+		Expect(out.String()).To(BeEmpty())
+	})
+
+	It("reports failed commands", func() {
+		_, err := conn.CliCommand("delete", "app", "-f")
+		Expect(err).To(MatchError("cf delete failed in other-org/staging: delete is not allowed"))
+	})
+
+	It("reports the target as the current space", func() {
+		space, err := conn.GetCurrentSpace()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(space.Guid).To(Equal("space-guid"))
+
+		org, err := conn.GetCurrentOrg()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(org.Name).To(Equal("other-org"))
+	})
+
+	It("logs in to a foundation without putting the credentials in its arguments", func() {
+		foundation := Foundation{Name: "eu", API: "https://api.eu.example.com", ClientID: "deployer", ClientSecret: "secret", Org: "other-org", Space: "staging"}
+		_, err := newFoundationConnection(&pluginfakes.FakeCliConnection{}, cfPath, foundation, out)
+		Expect(err).To(HaveOccurred())
+
+		Expect(commands()).To(ContainElement(HaveSuffix(" auth --client-credentials with deployer:secret")))
+		for _, command := range commands() {
+			args := strings.SplitN(command, " with ", 2)[0]
+			Expect(args).ToNot(ContainSubstring("secret"))
+		}
+	})
+
+	It("removes its copy of the cf config when closed", func() {
+		Expect(conn.Close()).To(Succeed())
+
+		_, err := os.Stat(conn.cfHome)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
+
+var _ = Describe("prefixWriter", func() {
+	It("prefixes each complete line", func() {
+		out := &bytes.Buffer{}
+		w := newPrefixWriter(&sync.Mutex{}, out, "[org/space] ")
+
+		w.Write([]byte("one\ntw"))
+		w.Write([]byte("o\nthree"))
+
+		Expect(out.String()).To(Equal("[org/space] one\n[org/space] two\n"))
+	})
+
+	It("can be written to from several goroutines at once", func() {
+		out := &bytes.Buffer{}
+		w := newPrefixWriter(&sync.Mutex{}, out, "[org/space] ")
+
+		// cf's stdout and stderr are copied by goroutines of their own
+		var wg sync.WaitGroup
+		for _, line := range []string{"stdout\n", "stderr\n"} {
+			wg.Add(1)
+			go func(line string) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					w.Write([]byte(line))
+				}
+			}(line)
+		}
+		wg.Wait()
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		Expect(lines).To(HaveLen(200))
+		for _, line := range lines {
+			Expect(line).To(Or(Equal("[org/space] stdout"), Equal("[org/space] stderr")))
+		}
+	})
+})
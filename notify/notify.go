@@ -0,0 +1,144 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type EventType string
+
+const (
+	Started    EventType = "started"
+	Succeeded  EventType = "succeeded"
+	Failed     EventType = "failed"
+	RolledBack EventType = "rolled_back"
+)
+
+// Event describes a point in the life of a deploy.
+type Event struct {
+	Type     EventType
+	App      string
+	Space    string
+	Org      string
+	Duration time.Duration
+	Error    error
+}
+
+type Format string
+
+const (
+	// Generic webhooks receive the event as a flat JSON object.
+	Generic Format = "generic"
+	// Slack webhooks receive a message in the Slack incoming webhook format
+	// which is also understood by Mattermost, Rocket.Chat and friends.
+	Slack Format = "slack"
+)
+
+type Webhook struct {
+	URL    string
+	Format Format
+}
+
+type Notifier struct {
+	Webhooks []Webhook
+	Client   *http.Client
+}
+
+// Notify sends the event to every webhook. All of the webhooks are tried even
+// if some of them fail.
+func (n Notifier) Notify(event Event) error {
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	var failures []string
+	for _, webhook := range n.Webhooks {
+		err := send(client, webhook, event)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", webhook.URL, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to notify %s", strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+func send(client *http.Client, webhook Webhook, event Event) error {
+	var payload interface{}
+	switch webhook.Format {
+	case Slack:
+		payload = slackPayload(event)
+	default:
+		payload = genericPayload(event)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(webhook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+type generic struct {
+	Event           EventType `json:"event"`
+	App             string    `json:"app"`
+	Space           string    `json:"space"`
+	Org             string    `json:"org"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Error           string    `json:"error,omitempty"`
+}
+
+func genericPayload(event Event) generic {
+	payload := generic{
+		Event:           event.Type,
+		App:             event.App,
+		Space:           event.Space,
+		Org:             event.Org,
+		DurationSeconds: event.Duration.Seconds(),
+	}
+	if event.Error != nil {
+		payload.Error = event.Error.Error()
+	}
+	return payload
+}
+
+func slackPayload(event Event) map[string]string {
+	target := fmt.Sprintf("*%s* in %s/%s", event.App, event.Org, event.Space)
+
+	var text string
+	switch event.Type {
+	case Started:
+		text = fmt.Sprintf("Deploying %s", target)
+	case Succeeded:
+		text = fmt.Sprintf("Deployed %s in %s", target, event.Duration.Round(time.Second))
+	case RolledBack:
+		text = fmt.Sprintf("Rolled back deploy of %s after %s", target, event.Duration.Round(time.Second))
+	default:
+		text = fmt.Sprintf("Deploy of %s failed after %s", target, event.Duration.Round(time.Second))
+	}
+
+	if event.Error != nil {
+		text = fmt.Sprintf("%s: %s", text, event.Error)
+	}
+
+	return map[string]string{"text": text}
+}
@@ -0,0 +1,113 @@
+package notify_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/contraband/autopilot/notify"
+)
+
+var _ = Describe("Notifier", func() {
+	var (
+		server   *httptest.Server
+		bodies   []map[string]interface{}
+		status   int
+		notifier notify.Notifier
+	)
+
+	BeforeEach(func() {
+		bodies = nil
+		status = http.StatusOK
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+
+			Expect(r.Method).To(Equal("POST"))
+			Expect(r.Header.Get("Content-Type")).To(Equal("application/json"))
+
+			raw, err := ioutil.ReadAll(r.Body)
+			Expect(err).ToNot(HaveOccurred())
+
+			body := map[string]interface{}{}
+			Expect(json.Unmarshal(raw, &body)).To(Succeed())
+			bodies = append(bodies, body)
+
+			w.WriteHeader(status)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	event := notify.Event{
+		Type:     notify.Failed,
+		App:      "my-app",
+		Space:    "prod",
+		Org:      "my-org",
+		Duration: 90 * time.Second,
+		Error:    errors.New("staging failed"),
+	}
+
+	It("sends generic webhooks the event as JSON", func() {
+		notifier = notify.Notifier{Webhooks: []notify.Webhook{{URL: server.URL, Format: notify.Generic}}}
+
+		Expect(notifier.Notify(event)).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(bodies[0]).To(Equal(map[string]interface{}{
+			"event":            "failed",
+			"app":              "my-app",
+			"space":            "prod",
+			"org":              "my-org",
+			"duration_seconds": float64(90),
+			"error":            "staging failed",
+		}))
+	})
+
+	It("leaves the error out of generic webhooks when there isn't one", func() {
+		notifier = notify.Notifier{Webhooks: []notify.Webhook{{URL: server.URL}}}
+
+		Expect(notifier.Notify(notify.Event{Type: notify.Started, App: "my-app"})).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(bodies[0]).ToNot(HaveKey("error"))
+		Expect(bodies[0]["event"]).To(Equal("started"))
+	})
+
+	It("sends slack webhooks a message", func() {
+		notifier = notify.Notifier{Webhooks: []notify.Webhook{{URL: server.URL, Format: notify.Slack}}}
+
+		Expect(notifier.Notify(event)).To(Succeed())
+
+		Expect(bodies).To(HaveLen(1))
+		Expect(bodies[0]).To(Equal(map[string]interface{}{
+			"text": "Deploy of *my-app* in my-org/prod failed after 1m30s: staging failed",
+		}))
+	})
+
+	It("notifies every webhook", func() {
+		notifier = notify.Notifier{Webhooks: []notify.Webhook{
+			{URL: server.URL, Format: notify.Generic},
+			{URL: server.URL, Format: notify.Slack},
+		}}
+
+		Expect(notifier.Notify(notify.Event{Type: notify.Succeeded})).To(Succeed())
+		Expect(bodies).To(HaveLen(2))
+	})
+
+	It("returns an error if a webhook rejects the notification", func() {
+		status = http.StatusInternalServerError
+		notifier = notify.Notifier{Webhooks: []notify.Webhook{{URL: server.URL}}}
+
+		err := notifier.Notify(event)
+		Expect(err).To(MatchError(ContainSubstring("500")))
+	})
+})
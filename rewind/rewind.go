@@ -1,38 +1,85 @@
 package rewind
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type Actions struct {
 	Actions []Action
 
 	RewindFailureMessage string
+
+	// OnRewind, if set, is called once a failed action has been reversed with
+	// the error that caused the failure and the result of the reversal.
+	OnRewind func(cause error, reverseError error)
+}
+
+// Timing records when an action started and finished.
+type Timing struct {
+	Name    string
+	Kind    string
+	Reverse bool
+	Start   time.Time
+	End     time.Time
+}
+
+func (timing Timing) Duration() time.Duration {
+	return timing.End.Sub(timing.Start)
 }
 
 func (actions Actions) Execute() error {
+	_, err := actions.ExecuteTimed()
+	return err
+}
+
+// ExecuteTimed runs the actions like Execute and also returns when each
+// action that was run, and any reversal, started and finished.
+func (actions Actions) ExecuteTimed() ([]Timing, error) {
+	var timings []Timing
+	run := func(action Action, reverse bool, step func() error) error {
+		timing := Timing{Name: action.Name, Kind: action.Kind, Reverse: reverse, Start: time.Now()}
+		err := step()
+		timing.End = time.Now()
+		timings = append(timings, timing)
+		return err
+	}
+
 	for _, action := range actions.Actions {
-		err := action.Forward()
+		err := run(action, false, action.Forward)
 		if err != nil {
 			if action.ReversePrevious == nil {
-				return err
+				return timings, err
+			}
+
+			reverseError := run(action, true, action.ReversePrevious)
+			if actions.OnRewind != nil {
+				actions.OnRewind(err, reverseError)
 			}
 
-			reverseError := action.ReversePrevious()
 			if reverseError != nil {
 				if actions.RewindFailureMessage != "" {
-					return fmt.Errorf("%s: %s", actions.RewindFailureMessage, reverseError)
+					return timings, fmt.Errorf("%s: %s", actions.RewindFailureMessage, reverseError)
 				} else {
-					return reverseError
+					return timings, reverseError
 				}
 			}
 
-			return err
+			return timings, err
 		}
 	}
 
-	return nil
+	return timings, nil
 }
 
 type Action struct {
+	// Name describes the action, e.g. for reporting how long it took.
+	Name string
+
+	// Kind categorises the action, e.g. so that metrics can pick out the
+	// actions they measure whatever they are named.
+	Kind string
+
 	Forward         func() error
 	ReversePrevious func() error
 }
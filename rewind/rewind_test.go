@@ -2,6 +2,7 @@ package rewind_test
 
 import (
 	"errors"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -164,4 +165,98 @@ var _ = Describe("Rewind", func() {
 		Expect(secondReverseRun).To(BeTrue())
 		Expect(thirdRun).To(BeFalse())
 	})
+
+	It("reports the rewind to the OnRewind hook", func() {
+		var cause, reverseErr error
+		hookRun := false
+
+		actions := rewind.Actions{
+			Actions: []rewind.Action{
+				{
+					Forward: func() error {
+						return errors.New("disaster")
+					},
+					ReversePrevious: func() error {
+						return errors.New("another disaster")
+					},
+				},
+			},
+			OnRewind: func(c error, r error) {
+				hookRun = true
+				cause = c
+				reverseErr = r
+			},
+		}
+
+		err := actions.Execute()
+		Expect(err).To(MatchError("another disaster"))
+
+		Expect(hookRun).To(BeTrue())
+		Expect(cause).To(MatchError("disaster"))
+		Expect(reverseErr).To(MatchError("another disaster"))
+	})
+
+	It("does not call the OnRewind hook if there is nothing to reverse", func() {
+		hookRun := false
+
+		actions := rewind.Actions{
+			Actions: []rewind.Action{
+				{
+					Forward: func() error {
+						return errors.New("disaster")
+					},
+				},
+			},
+			OnRewind: func(error, error) {
+				hookRun = true
+			},
+		}
+
+		err := actions.Execute()
+		Expect(err).To(MatchError("disaster"))
+		Expect(hookRun).To(BeFalse())
+	})
+
+	It("records when each action ran", func() {
+		actions := rewind.Actions{
+			Actions: []rewind.Action{
+				{
+					Name: "first",
+					Kind: "slow",
+					Forward: func() error {
+						time.Sleep(10 * time.Millisecond)
+						return nil
+					},
+				},
+				{
+					Name: "second",
+					Forward: func() error {
+						return errors.New("disaster")
+					},
+					ReversePrevious: func() error {
+						return nil
+					},
+				},
+				{
+					Name: "third",
+					Forward: func() error {
+						return nil
+					},
+				},
+			},
+		}
+
+		timings, err := actions.ExecuteTimed()
+		Expect(err).To(MatchError("disaster"))
+
+		Expect(timings).To(HaveLen(3))
+		Expect(timings[0].Name).To(Equal("first"))
+		Expect(timings[0].Kind).To(Equal("slow"))
+		Expect(timings[0].Duration()).To(BeNumerically(">=", 10*time.Millisecond))
+		Expect(timings[1].Name).To(Equal("second"))
+		Expect(timings[1].Reverse).To(BeFalse())
+		Expect(timings[2].Name).To(Equal("second"))
+		Expect(timings[2].Reverse).To(BeTrue())
+		Expect(timings[1].End).ToNot(BeTemporally(">", timings[2].Start))
+	})
 })